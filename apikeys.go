@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// apiKeyHeader carries the client's API key. It is never forwarded upstream.
+const apiKeyHeader = "X-API-Key"
+
+// APIKey gives the clients presenting Key their own allowed methods and rate
+// limit, e.g. for a paid tier.
+type APIKey struct {
+	Key   string   `toml:",omitempty"`
+	Allow []string `toml:",omitempty"` // methods allowed with this key, empty means the global Allow
+	RPM   int      `toml:",omitempty"` // requests per minute shared by all users of the key, instead of the per-IP limits, 0 means the per-IP limits apply
+}
+
+// apiKey is a parsed APIKey.
+type apiKey struct {
+	matcher *matcher      // nil means the global one
+	limit   *visitorLimit // nil means the per-IP limits
+	limiter *rate.Limiter // enforces limit in memory, without Redis
+}
+
+// apiKeys maps keys to their settings, nil means API keys aren't used.
+type apiKeys map[string]apiKey
+
+// parseAPIKeys compiles the allow rules of each key, which are combined with
+// the global deny rules.
+func parseAPIKeys(keys []APIKey, deny []string) (apiKeys, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ks := make(apiKeys, len(keys))
+	for _, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		if _, ok := ks[k.Key]; ok {
+			return nil, fmt.Errorf("duplicate API key")
+		}
+		if k.RPM < 0 {
+			return nil, fmt.Errorf("negative RPM for API key")
+		}
+		var parsed apiKey
+		if len(k.Allow) > 0 {
+			m, err := newMatcher(k.Allow, deny...)
+			if err != nil {
+				return nil, err
+			}
+			parsed.matcher = &m
+		}
+		if k.RPM > 0 {
+			parsed.limit = &visitorLimit{limit: k.RPM, window: time.Minute}
+			parsed.limiter = rate.NewLimiter(parsed.limit.every())
+		}
+		ks[k.Key] = parsed
+	}
+	return ks, nil
+}
+
+// knownAPIKey reports whether key may be presented: none, or one of the
+// configured keys.
+func (t *myTransport) knownAPIKey(key string) bool {
+	if key == "" || t.apiKeys == nil {
+		return true
+	}
+	_, ok := t.apiKeys[key]
+	return ok
+}
+
+// setAPIKey attributes res to key, if any.
+func setAPIKey(res []ModifiedRequest, key string) {
+	if key == "" {
+		return
+	}
+	for i := range res {
+		res[i].APIKey = key
+	}
+}
+
+func jsonRPCInvalidAPIKey(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCInvalidRequest, "Invalid API key")
+}
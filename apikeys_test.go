@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		keys []APIKey
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"valid", []APIKey{{Key: "a", Allow: []string{"eth_*"}, RPM: 60}, {Key: "b"}}, true},
+		{"empty", []APIKey{{Allow: []string{"eth_*"}}}, false},
+		{"duplicate", []APIKey{{Key: "a"}, {Key: "a"}}, false},
+		{"negative rpm", []APIKey{{Key: "a", RPM: -1}}, false},
+		{"invalid allow", []APIKey{{Key: "a", Allow: []string{"eth_["}}}, false},
+	} {
+		_, err := parseAPIKeys(test.keys, nil)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestBlock_apiKeys(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	var err error
+	tr.apiKeys, err = parseAPIKeys([]APIKey{
+		{Key: "paid", Allow: []string{"eth_chainId", "eth_getLogs"}, RPM: 20},
+		{Key: "free"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		req  ModifiedRequest
+		code int // 0 means allowed
+	}{
+		{"no key", ModifiedRequest{Path: "eth_chainId"}, 0},
+		{"no key unlisted", ModifiedRequest{Path: "eth_getLogs"}, http.StatusMethodNotAllowed},
+		{"free key uses global allow", ModifiedRequest{Path: "eth_getLogs", APIKey: "free"}, http.StatusMethodNotAllowed},
+		{"paid key", ModifiedRequest{Path: "eth_getLogs", APIKey: "paid"}, 0},
+		{"paid key unlisted", ModifiedRequest{Path: "eth_sendRawTransaction", APIKey: "paid"}, http.StatusMethodNotAllowed},
+		{"paid key unlisted uses no tokens", ModifiedRequest{Path: "eth_chainId", APIKey: "paid"}, 0},
+		{"paid key limited", ModifiedRequest{Path: "eth_chainId", APIKey: "paid"}, http.StatusTooManyRequests},
+		{"unknown key", ModifiedRequest{Path: "eth_chainId", APIKey: "stolen"}, http.StatusUnauthorized},
+	} {
+		test.req.RemoteAddr = "1.2.3.4"
+		code, resp := tr.block(context.Background(), []ModifiedRequest{test.req})
+		if test.code == 0 && resp != nil {
+			t.Errorf("%s: expected allowed, got: %d %v", test.name, code, resp)
+		} else if test.code != 0 && code != test.code {
+			t.Errorf("%s: expected %d, got: %d %v", test.name, test.code, code, resp)
+		}
+	}
+}
+
+func TestBlock_apiKeyCosts(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId", "eth_call")
+	var err error
+	tr.apiKeys, err = parseAPIKeys([]APIKey{{Key: "paid", RPM: 20}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.costs, err = methodCosts(map[string]int{"eth_call": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key's burst of 2 is all used by a single eth_call.
+	if _, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_call", APIKey: "paid", RemoteAddr: "1.2.3.4"}}); resp != nil {
+		t.Fatalf("unexpected block: %v", resp)
+	}
+	code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_chainId", APIKey: "paid", RemoteAddr: "1.2.3.4"}})
+	if code != http.StatusTooManyRequests {
+		t.Errorf("expected key to be charged the method cost, got: %d %v", code, resp)
+	}
+}
+
+func TestBlock_apiKeyQuota(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	var err error
+	tr.apiKeys, err = parseAPIKeys([]APIKey{{Key: "paid", RPM: 600}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.quota = newDailyQuota(1)
+	request := func(key, ip string) (int, interface{}) {
+		return tr.block(context.Background(), []ModifiedRequest{{Path: "eth_chainId", APIKey: key, RemoteAddr: ip}})
+	}
+	if _, resp := request("paid", "1.2.3.4"); resp != nil {
+		t.Fatalf("unexpected block: %v", resp)
+	}
+	// The quota goes by key, whatever the IP.
+	code, resp := request("paid", "5.6.7.8")
+	if code != http.StatusTooManyRequests || resp.(ErrResponse).Error.Code != jsonRPCQuotaLimit {
+		t.Errorf("expected quota error, got: %d %v", code, resp)
+	}
+	if _, resp := request("", "1.2.3.4"); resp != nil {
+		t.Errorf("expected IP quota to be separate from the key's, got: %v", resp)
+	}
+}
+
+func TestWebsocketProxy_apiKeys(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	var err error
+	tr.apiKeys, err = parseAPIKeys([]APIKey{{Key: "paid", Allow: []string{"eth_chainId", "eth_getLogs"}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newTestWSProxy(t, &WebsocketProxy{Transport: tr})
+
+	if _, res, err := websocket.DefaultDialer.Dial(u, http.Header{apiKeyHeader: {"stolen"}}); err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unknown key to be rejected at the handshake, got: %v %v", res, err)
+	}
+
+	for _, test := range []struct {
+		key  string
+		code int // 0 means allowed
+	}{
+		{"", jsonRPCMethodNotAllowed},
+		{"paid", 0},
+	} {
+		header := http.Header{}
+		if test.key != "" {
+			header.Set(apiKeyHeader, test.key)
+		}
+		c, _, err := websocket.DefaultDialer.Dial(u, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{}]}`
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := c.ReadMessage()
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp ErrResponse
+		json.Unmarshal(got, &resp)
+		if test.code == 0 && string(got) != msg {
+			t.Errorf("%q: expected echo, got: %s", test.key, got)
+		} else if test.code != 0 && resp.Error.Code != test.code {
+			t.Errorf("%q: expected error %d, got: %s", test.key, test.code, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// tagResolutions returns how many times request needs the head block to
+// resolve a "latest", "pending", "safe" or "finalized" tag, or a missing block
+// param which defaults to latest.
+func tagResolutions(request ModifiedRequest) int {
+	if request.Path == "eth_getLogs" || request.Path == "eth_newFilter" {
+		if len(request.Params) == 0 {
+			return 0
+		}
+		var fq struct {
+			BlockHash *string         `json:"blockHash"`
+			FromBlock json.RawMessage `json:"fromBlock"`
+			ToBlock   json.RawMessage `json:"toBlock"`
+		}
+		if err := json.Unmarshal(request.Params[0], &fq); err != nil || fq.BlockHash != nil {
+			return 0
+		}
+		var n int
+		if fq.FromBlock == nil || isHeadTag(fq.FromBlock) {
+			n++
+		}
+		if fq.ToBlock == nil || isHeadTag(fq.ToBlock) {
+			n++
+		}
+		return n
+	}
+	i, ok := blockParamIndex[request.Path]
+	if !ok {
+		return 0
+	}
+	if i >= len(request.Params) || isHeadTag(request.Params[i]) {
+		return 1
+	}
+	return 0
+}
+
+// isHeadTag reports whether the block param p, a tag, number or EIP-1898
+// object, is resolved against the head block. Null defaults to latest.
+func isHeadTag(p json.RawMessage) bool {
+	var tag *string
+	if err := json.Unmarshal(p, &tag); err != nil {
+		var obj struct {
+			BlockNumber *string `json:"blockNumber"`
+		}
+		if err := json.Unmarshal(p, &obj); err != nil || obj.BlockNumber == nil {
+			return false
+		}
+		tag = obj.BlockNumber
+	}
+	if tag == nil {
+		return true
+	}
+	switch *tag {
+	case "latest", "pending", "safe", "finalized":
+		return true
+	}
+	return false
+}
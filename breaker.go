@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker stops requests to an upstream after too many failures. Once
+// at least minRequests outcomes have been recorded, the breaker opens if the
+// failure ratio reached errorRatio, otherwise the counts are reset. After
+// cooldown, a single probe request is let through (half-open), which either
+// closes the breaker or opens it again.
+type circuitBreaker struct {
+	name        string // For logging.
+	errorRatio  float64
+	minRequests int
+	cooldown    time.Duration
+
+	mu        sync.Mutex // Protects everything below.
+	state     breakerState
+	successes int
+	failures  int
+	openedAt  time.Time
+	probing   bool // Set while the half-open probe is in flight.
+}
+
+func newCircuitBreaker(name string, errorRatio float64, minRequests int, cooldown time.Duration) *circuitBreaker {
+	if minRequests <= 0 {
+		minRequests = 20
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{name: name, errorRatio: errorRatio, minRequests: minRequests, cooldown: cooldown}
+}
+
+// allow returns true if a request may be sent upstream. Every allowed request
+// must be followed by a call to record.
+func (b *circuitBreaker) allow(ctx context.Context) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(ctx, breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record records the outcome of an allowed request.
+func (b *circuitBreaker) record(ctx context.Context, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if success {
+			b.setState(ctx, breakerClosed)
+		} else {
+			b.setState(ctx, breakerOpen)
+		}
+		return
+	}
+	if success {
+		b.successes++
+	} else {
+		b.failures++
+	}
+	total := b.successes + b.failures
+	if total < b.minRequests {
+		return
+	}
+	if float64(b.failures)/float64(total) >= b.errorRatio {
+		b.setState(ctx, breakerOpen)
+		return
+	}
+	b.successes, b.failures = 0, 0
+}
+
+// setState transitions to state. b.mu must be held.
+func (b *circuitBreaker) setState(ctx context.Context, state breakerState) {
+	gotils.L(ctx).Info().Printf("Circuit breaker %s: %s -> %s", b.name, b.state, state)
+	b.state = state
+	b.successes, b.failures = 0, 0
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// current returns the current state.
+func (b *circuitBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	b := newCircuitBreaker("test", 0.5, 4, 10*time.Millisecond)
+
+	for _, ok := range []bool{true, false, true, true} {
+		if !b.allow(ctx) {
+			t.Fatal("expected closed breaker to allow requests")
+		}
+		b.record(ctx, ok)
+	}
+	if s := b.current(); s != breakerClosed {
+		t.Fatalf("expected closed after 25%% failures, got %s", s)
+	}
+
+	for _, ok := range []bool{false, false, true, false} {
+		b.allow(ctx)
+		b.record(ctx, ok)
+	}
+	if s := b.current(); s != breakerOpen {
+		t.Fatalf("expected open after 75%% failures, got %s", s)
+	}
+	if b.allow(ctx) {
+		t.Fatal("expected open breaker to block requests")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow(ctx) {
+		t.Fatal("expected a probe after cooldown")
+	}
+	if b.allow(ctx) {
+		t.Fatal("expected only a single probe while half-open")
+	}
+	b.record(ctx, false)
+	if s := b.current(); s != breakerOpen {
+		t.Fatalf("expected open after failed probe, got %s", s)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	b.allow(ctx)
+	b.record(ctx, true)
+	if s := b.current(); s != breakerClosed {
+		t.Fatalf("expected closed after successful probe, got %s", s)
+	}
+}
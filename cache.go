@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gochain/gochain/v3/rpc"
+	"github.com/treeder/gotils/v2"
+)
+
+// CachePolicy describes how responses to a single method are cached.
+type CachePolicy struct {
+	Cache           bool          `toml:",omitempty"` // whether responses are cached at all
+	TTL             time.Duration `toml:",omitempty"` // how long a response is served from cache
+	Finalized       bool          `toml:",omitempty"` // only cache requests for blocks at least FinalityDepth behind head
+	NormalizeParams bool          `toml:",omitempty"` // canonicalize params JSON when building the cache key
+}
+
+// defaultCachePolicies are used when caching is enabled, for methods whose
+// responses never change, or never change once their block is final.
+var defaultCachePolicies = map[string]CachePolicy{
+	"eth_chainId":                             {Cache: true, TTL: time.Hour},
+	"net_version":                             {Cache: true, TTL: time.Hour},
+	"eth_getBlockByHash":                      {Cache: true, TTL: time.Hour},
+	"eth_getBlockTransactionCountByHash":      {Cache: true, TTL: time.Hour},
+	"eth_getTransactionByBlockHashAndIndex":   {Cache: true, TTL: time.Hour},
+	"eth_getBlockByNumber":                    {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getBlockTransactionCountByNumber":    {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getTransactionByBlockNumberAndIndex": {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getBalance":                          {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getCode":                             {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getStorageAt":                        {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_getTransactionCount":                 {Cache: true, TTL: time.Hour, Finalized: true},
+	"eth_call":                                {Cache: true, TTL: time.Hour, Finalized: true, NormalizeParams: true},
+	"eth_getLogs":                             {Cache: true, TTL: time.Hour, Finalized: true, NormalizeParams: true},
+}
+
+// blockParamIndex is the position of the block number/tag param for methods
+// which take one.
+var blockParamIndex = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_call":                                1,
+	"eth_getStorageAt":                        2,
+}
+
+const (
+	defaultCacheSize       = 10000
+	defaultFinalityDepth   = 64
+	defaultCleanupInterval = time.Minute
+)
+
+// cachePolicies returns the effective per-method policies: the built-in
+// defaults, or only the methods in ttls if any are given, overridden by
+// configured entries. An error is returned for invalid policies.
+func cachePolicies(configured map[string]CachePolicy, ttls map[string]time.Duration) (map[string]CachePolicy, error) {
+	ps := make(map[string]CachePolicy, len(defaultCachePolicies)+len(configured))
+	if len(ttls) == 0 {
+		for m, p := range defaultCachePolicies {
+			ps[m] = p
+		}
+	}
+	for m, ttl := range ttls {
+		if ttl < 0 {
+			return nil, fmt.Errorf("cache TTL for %s must not be negative", m)
+		}
+		if ttl == 0 {
+			continue
+		}
+		// Cached for ttl whatever the block, but keys are still built the
+		// same way as with the built-in policy.
+		ps[m] = CachePolicy{Cache: true, TTL: ttl, NormalizeParams: defaultCachePolicies[m].NormalizeParams}
+	}
+	for m, p := range configured {
+		if m == "" {
+			return nil, fmt.Errorf("cache policy with empty method name")
+		}
+		if p.Cache && p.TTL <= 0 {
+			return nil, fmt.Errorf("cache policy for %s: TTL must be positive when caching is enabled", m)
+		}
+		ps[m] = p
+	}
+	return ps, nil
+}
+
+// responseCache is a size bounded LRU cache of JSON-RPC results.
+type responseCache struct {
+	max int
+
+	mu      sync.Mutex // Protects everything below.
+	entries map[string]*list.Element
+	lru     *list.List // Front is most recently used.
+	stats   map[string]*cacheStats
+	off     map[string]struct{} // Methods turned off at runtime, which aren't served from or stored in the cache.
+}
+
+// cacheStats counts the lookups and evictions of a method's responses.
+type cacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"` // Removed as least recently used to make room.
+	HitRatio  float64 `json:"hitRatio"`  // Hits over lookups, set by stats.
+}
+
+type cacheEntry struct {
+	key     string
+	result  json.RawMessage
+	expires time.Time
+	block   uint64 // Highest block the result depends on, if tracked.
+	tracked bool
+	head    bool // Set if the result depends on the latest block.
+}
+
+func newResponseCache(max int) *responseCache {
+	if max <= 0 {
+		max = defaultCacheSize
+	}
+	return &responseCache{max: max, entries: make(map[string]*list.Element), lru: list.New(), stats: make(map[string]*cacheStats), off: make(map[string]struct{})}
+}
+
+// get returns the cached result for key, if present and not expired.
+func (c *responseCache) get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, off := c.off[keyMethod(key)]; off {
+		return nil, false
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.result, true
+}
+
+// set caches result under key for ttl, evicting the least recently used
+// entry if the cache is full.
+func (c *responseCache) set(key string, result json.RawMessage, ttl time.Duration) {
+	c.put(&cacheEntry{key: key, result: result, expires: time.Now().Add(ttl)})
+}
+
+// setBlock is like set, but records that result depends on block, so that it
+// is dropped by invalidate if the block is reorged.
+func (c *responseCache) setBlock(key string, result json.RawMessage, ttl time.Duration, block uint64) {
+	c.put(&cacheEntry{key: key, result: result, expires: time.Now().Add(ttl), block: block, tracked: true})
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, off := c.off[keyMethod(e.key)]; off {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		key := oldest.Value.(*cacheEntry).key
+		delete(c.entries, key)
+		c.methodStats(keyMethod(key)).Evictions++
+	}
+}
+
+// count records a lookup of a method's response in the cache.
+func (c *responseCache) count(method string, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.methodStats(method)
+	if hit {
+		st.Hits++
+	} else {
+		st.Misses++
+	}
+}
+
+// methodStats returns the stats of method, adding them if needed. c.mu must
+// be held.
+func (c *responseCache) methodStats(method string) *cacheStats {
+	st, ok := c.stats[method]
+	if !ok {
+		st = &cacheStats{}
+		c.stats[method] = st
+	}
+	return st
+}
+
+// statsSnapshot returns a copy of the stats of each method, with hit ratios.
+func (c *responseCache) statsSnapshot() map[string]cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make(map[string]cacheStats, len(c.stats))
+	for method, st := range c.stats {
+		cp := *st
+		if lookups := cp.Hits + cp.Misses; lookups > 0 {
+			cp.HitRatio = float64(cp.Hits) / float64(lookups)
+		}
+		stats[method] = cp
+	}
+	return stats
+}
+
+// keyMethod returns the method of a key made by cacheKey, or errorCacheable.
+func keyMethod(key string) string {
+	key = strings.TrimPrefix(key, errorKeyPrefix)
+	if i := strings.IndexByte(key, 0); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// keys returns the keys of the unexpired entries for method.
+func (c *responseCache) keys(method string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, el := range c.entries {
+		if key != method && !strings.HasPrefix(key, method+"\x00") {
+			continue
+		}
+		if now.After(el.Value.(*cacheEntry).expires) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// removeExpired removes every expired entry, returning the number removed.
+// Expired entries are otherwise only removed when they are looked up or
+// evicted as least recently used.
+func (c *responseCache) removeExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); now.After(e.expires) {
+			c.lru.Remove(el)
+			delete(c.entries, e.key)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// cleanup removes expired entries every interval, until ctx is done.
+func (c *responseCache) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := c.removeExpired(now); n > 0 {
+				gotils.L(ctx).Debug().Printf("Removed %d expired cached responses", n)
+			}
+		}
+	}
+}
+
+// invalidate removes entries which depend on block from or later, returning
+// the number removed.
+func (c *responseCache) invalidate(from uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeWhere(func(e *cacheEntry) bool { return e.tracked && e.block >= from })
+}
+
+// invalidateHead removes entries which depend on the latest block, returning
+// the number removed.
+func (c *responseCache) invalidateHead() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeWhere(func(e *cacheEntry) bool { return e.head })
+}
+
+// removeWhere removes the entries matching remove, returning the number
+// removed. c.mu must be held.
+func (c *responseCache) removeWhere(remove func(*cacheEntry) bool) int {
+	var n int
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); remove(e) {
+			c.lru.Remove(el)
+			delete(c.entries, e.key)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// setEnabled turns caching of method on or off at runtime. Its entries are
+// dropped when it is turned off, so they can't be served stale once it is
+// turned back on.
+func (c *responseCache) setEnabled(method string, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		delete(c.off, method)
+		return
+	}
+	c.off[method] = struct{}{}
+	c.removeWhere(func(e *cacheEntry) bool { return keyMethod(e.key) == method })
+}
+
+// enabled returns false if caching of method was turned off by setEnabled.
+func (c *responseCache) enabled(method string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, off := c.off[method]
+	return !off
+}
+
+// disabled returns the methods caching was turned off for, sorted.
+func (c *responseCache) disabled() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	methods := make([]string, 0, len(c.off))
+	for m := range c.off {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// flush removes every entry, returning the number removed. Stats are kept.
+func (c *responseCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return n
+}
+
+// cacheKey returns the key for request, or an error if params can't be
+// normalized.
+func cacheKey(request ModifiedRequest, normalize bool) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(request.Path)
+	for _, p := range request.Params {
+		sb.WriteByte(0)
+		if !normalize {
+			sb.Write(p)
+			continue
+		}
+		b, err := normalizeJSON(p)
+		if err != nil {
+			return "", err
+		}
+		sb.Write(b)
+	}
+	return sb.String(), nil
+}
+
+// normalizeJSON returns p with object keys sorted and whitespace removed.
+// Numbers are preserved as written.
+func normalizeJSON(p json.RawMessage) (json.RawMessage, error) {
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// cacheable returns the cache key and policy for parsedRequests if the
+// response may be served from, or stored in, the cache. Only single requests
+// are cached.
+func (t *myTransport) cacheable(ctx context.Context, parsedRequests []ModifiedRequest) (string, CachePolicy, bool) {
+	if t.cache == nil || len(parsedRequests) != 1 {
+		return "", CachePolicy{}, false
+	}
+	request := parsedRequests[0]
+	p, ok := t.cachePolicies[request.Path]
+	if !ok || !p.Cache || !t.cache.enabled(request.Path) {
+		return "", CachePolicy{}, false
+	}
+	if p.Finalized && !t.finalized(ctx, request) {
+		return "", CachePolicy{}, false
+	}
+	key, err := cacheKey(request, p.NormalizeParams)
+	if err != nil {
+		return "", CachePolicy{}, false
+	}
+	return key, p, true
+}
+
+// finalized returns true if request only refers to blocks at least
+// finalityDepth behind the latest block.
+func (t *myTransport) finalized(ctx context.Context, request ModifiedRequest) bool {
+	end, ok := t.highestBlock(ctx, request)
+	if !ok {
+		return false
+	}
+	latest, err := t.latestBlock.get(ctx)
+	if err != nil {
+		return false
+	}
+	return end+t.finalityDepth <= latest
+}
+
+// highestBlock returns the highest block number request refers to. Block
+// tags and missing block params resolve to the latest block. It returns false
+// if request doesn't refer to a block number, or it can't be determined.
+func (t *myTransport) highestBlock(ctx context.Context, request ModifiedRequest) (uint64, bool) {
+	if request.Path == "eth_getLogs" {
+		r, invalid, err := t.parseRange(ctx, request)
+		if r == nil || invalid != nil || err != nil {
+			return 0, false
+		}
+		return r.end, true
+	}
+	i, ok := blockParamIndex[request.Path]
+	if !ok {
+		return 0, false
+	}
+	if i < len(request.Params) {
+		var bn rpc.BlockNumber
+		if err := json.Unmarshal(request.Params[i], &bn); err != nil {
+			return 0, false
+		}
+		if bn >= 0 {
+			return uint64(bn), true
+		}
+	}
+	latest, err := t.latestBlock.get(ctx)
+	if err != nil {
+		return 0, false
+	}
+	return latest, true
+}
+
+// cacheSet caches result for request under key according to policy. The TTL
+// of finalized results is capped at finalizedMaxAge. When entries are
+// invalidated on reorgs, the highest block request refers to is recorded with
+// it. Whether it follows the head is recorded too, for invalidateHead.
+func (t *myTransport) cacheSet(ctx context.Context, key string, request ModifiedRequest, result json.RawMessage, policy CachePolicy) {
+	ttl := policy.TTL
+	if policy.Finalized && t.finalizedMaxAge > 0 && ttl > t.finalizedMaxAge {
+		ttl = t.finalizedMaxAge
+	}
+	e := &cacheEntry{key: key, result: result, expires: time.Now().Add(ttl), head: followsHead(request)}
+	if t.reorgs != nil {
+		e.block, e.tracked = t.highestBlock(ctx, request)
+	}
+	t.cache.put(e)
+}
+
+// headMethods are methods without a block param whose results change with
+// the latest block.
+var headMethods = map[string]struct{}{
+	"eth_blockNumber": {},
+	"eth_gasPrice":    {},
+}
+
+// followsHead returns true if the result of request depends on the latest
+// block, because it refers to it by a block tag, or implicitly.
+func followsHead(request ModifiedRequest) bool {
+	if _, ok := headMethods[request.Path]; ok {
+		return true
+	}
+	if request.Path == "eth_getLogs" {
+		if len(request.Params) == 0 {
+			return true
+		}
+		var fq struct {
+			FromBlock *rpc.BlockNumber `json:"fromBlock"`
+			ToBlock   *rpc.BlockNumber `json:"toBlock"`
+			BlockHash *string          `json:"blockHash"`
+		}
+		if err := json.Unmarshal(request.Params[0], &fq); err != nil {
+			return false
+		}
+		if fq.BlockHash != nil {
+			return false
+		}
+		return fq.FromBlock == nil || fq.ToBlock == nil || *fq.FromBlock < 0 || *fq.ToBlock < 0
+	}
+	i, ok := blockParamIndex[request.Path]
+	if !ok {
+		return false
+	}
+	if i >= len(request.Params) {
+		return true
+	}
+	var bn rpc.BlockNumber
+	if err := json.Unmarshal(request.Params[i], &bn); err != nil {
+		return false
+	}
+	return bn < 0
+}
+
+// cachedResponse returns a JSON-RPC response for id with a cached result.
+func cachedResponse(id json.RawMessage, result json.RawMessage) interface{} {
+	return struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result"`
+	}{Version: "2.0", ID: responseID(id), Result: result}
+}
+
+// cacheResult returns the result of a successful, non-null JSON-RPC response
+// body, or nil if it should not be cached.
+func cacheResult(body []byte) json.RawMessage {
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil
+	}
+	if len(r.Error) > 0 || len(r.Result) == 0 || string(r.Result) == "null" {
+		return nil
+	}
+	return r.Result
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestCachePoliciesTOML(t *testing.T) {
+	data := `EnableCache = true
+[Cache.eth_blockNumber]
+Cache = true
+TTL = "2s"
+[Cache.eth_call]
+Cache = false
+`
+	var cfg ConfigData
+	if err := toml.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	ps, err := cachePolicies(cfg.Cache, nil)
+	if err != nil {
+		t.Fatalf("invalid policies: %v", err)
+	}
+	if p := ps["eth_blockNumber"]; !p.Cache || p.TTL != 2*time.Second {
+		t.Errorf("unexpected eth_blockNumber policy: %+v", p)
+	}
+	if p := ps["eth_call"]; p.Cache {
+		t.Errorf("expected eth_call caching to be disabled: %+v", p)
+	}
+	if p := ps["eth_chainId"]; !p.Cache {
+		t.Errorf("expected default eth_chainId policy: %+v", p)
+	}
+
+	if _, err := cachePolicies(map[string]CachePolicy{"eth_chainId": {Cache: true}}, nil); err == nil {
+		t.Error("expected error for missing TTL")
+	}
+}
+
+func TestCachePolicies_ttl(t *testing.T) {
+	ps, err := cachePolicies(map[string]CachePolicy{
+		"eth_getBalance": {Cache: true, TTL: time.Minute, Finalized: true},
+	}, map[string]time.Duration{
+		"eth_getBlockByNumber": 2 * time.Second,
+		"eth_chainId":          time.Hour,
+		"eth_call":             2 * time.Second,
+		"eth_getLogs":          0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]CachePolicy{
+		"eth_getBlockByNumber": {Cache: true, TTL: 2 * time.Second},
+		"eth_chainId":          {Cache: true, TTL: time.Hour},
+		"eth_call":             {Cache: true, TTL: 2 * time.Second, NormalizeParams: true},
+		"eth_getBalance":       {Cache: true, TTL: time.Minute, Finalized: true},
+	}
+	if !reflect.DeepEqual(ps, exp) {
+		t.Errorf("expected policies %+v, got %+v", exp, ps)
+	}
+
+	if _, err := cachePolicies(nil, map[string]time.Duration{"eth_chainId": -time.Second}); err == nil {
+		t.Error("expected error for negative TTL")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(2)
+	c.set("a", json.RawMessage(`1`), time.Minute)
+	c.set("b", json.RawMessage(`2`), time.Minute)
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.set("c", json.RawMessage(`3`), time.Minute)
+	if _, ok := c.get("b"); ok {
+		t.Error("expected least recently used b to be evicted")
+	}
+	c.set("d", json.RawMessage(`4`), -time.Second)
+	if _, ok := c.get("d"); ok {
+		t.Error("expected d to be expired")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	a := ModifiedRequest{Path: "eth_call", Params: []json.RawMessage{
+		json.RawMessage(`{"to": "0x01", "data": "0x02"}`), json.RawMessage(`"0x10"`)}}
+	b := ModifiedRequest{Path: "eth_call", Params: []json.RawMessage{
+		json.RawMessage(`{"data":"0x02","to":"0x01"}`), json.RawMessage(`"0x10"`)}}
+	ka, err := cacheKey(a, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := cacheKey(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ka != kb {
+		t.Errorf("expected normalized keys to match:\n\t%q\n\t%q", ka, kb)
+	}
+	if ka, _ = cacheKey(a, false); ka == kb {
+		t.Error("expected raw keys to differ")
+	}
+}
+
+func TestResponseCacheInvalidate(t *testing.T) {
+	c := newResponseCache(10)
+	c.set("static", json.RawMessage(`"0x1"`), time.Minute)
+	c.setBlock("old", json.RawMessage(`"0x2"`), time.Minute, 99)
+	c.setBlock("new", json.RawMessage(`"0x3"`), time.Minute, 100)
+	c.setBlock("newer", json.RawMessage(`"0x4"`), time.Minute, 105)
+	if n := c.invalidate(100); n != 2 {
+		t.Errorf("expected 2 entries invalidated but got %d", n)
+	}
+	for _, key := range []string{"static", "old"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected %s to remain cached", key)
+		}
+	}
+	for _, key := range []string{"new", "newer"} {
+		if _, ok := c.get(key); ok {
+			t.Errorf("expected %s to be invalidated", key)
+		}
+	}
+}
+
+func TestResponseCacheRemoveExpired(t *testing.T) {
+	c := newResponseCache(10)
+	c.set("a", json.RawMessage(`1`), time.Minute)
+	c.set("b", json.RawMessage(`2`), time.Hour)
+	if n := c.removeExpired(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Errorf("expected 1 entry removed but got %d", n)
+	}
+	if _, ok := c.entries["a"]; ok {
+		t.Error("expected a to be removed")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Error("expected b to remain cached")
+	}
+}
+
+func TestCacheSet_finalizedMaxAge(t *testing.T) {
+	tr := newTestTransport(t)
+	tr.cache = newResponseCache(10)
+	tr.finalizedMaxAge = time.Minute
+	ctx := context.Background()
+	tr.cacheSet(ctx, "final", ModifiedRequest{}, json.RawMessage(`1`), CachePolicy{Cache: true, TTL: time.Hour, Finalized: true})
+	tr.cacheSet(ctx, "static", ModifiedRequest{}, json.RawMessage(`2`), CachePolicy{Cache: true, TTL: time.Hour})
+	later := time.Now().Add(2 * time.Minute)
+	if n := tr.cache.removeExpired(later); n != 1 {
+		t.Errorf("expected 1 entry removed but got %d", n)
+	}
+	if _, ok := tr.cache.get("static"); !ok {
+		t.Error("expected non-finalized entry to keep its TTL")
+	}
+}
+
+func TestRoundTrip_errorCache(t *testing.T) {
+	var calls int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "eth_getCode":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node"}}`))
+		case "eth_chainId":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limit exceeded"}}`))
+		}
+	})
+
+	tr := newTestTransport(t, "eth_*")
+	tr.cache = newResponseCache(10)
+	tr.errorCacheTTL = time.Minute
+	roundTrip := func(body string) []byte {
+		resp := testRoundTrip(t, tr, upstream.URL, body)
+		b, _ := ioutil.ReadAll(resp.Body)
+		return b
+	}
+
+	const getCode = `"method":"eth_getCode","params":["0x0000000000000000000000000000000000000001","latest"]}`
+	roundTrip(`{"jsonrpc":"2.0","id":1,` + getCode)
+	body := roundTrip(`{"jsonrpc":"2.0","id":"b",` + getCode)
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("expected 1 upstream call, got %d", c)
+	}
+	var errResp ErrResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || string(errResp.ID) != `"b"` || errResp.Error.Message != "missing trie node" {
+		t.Errorf("unexpected cached error response: %s", body)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	roundTrip(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	roundTrip(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("expected limit errors not to be cached, got %d upstream calls", c)
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		body  string
+		cache bool
+	}{
+		{"result", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, false},
+		{"null error", `{"jsonrpc":"2.0","id":1,"error":null}`, false},
+		{"execution error", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node"}}`, true},
+		{"limit exceeded", `{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limit exceeded"}}`, false},
+		{"unauthorized code", `{"jsonrpc":"2.0","id":1,"error":{"code":401,"message":"invalid project id"}}`, false},
+		{"forbidden code", `{"jsonrpc":"2.0","id":1,"error":{"code":403,"message":"origin not allowed"}}`, false},
+		{"rate limit code", `{"jsonrpc":"2.0","id":1,"error":{"code":429,"message":"slow down"}}`, false},
+		{"rate limit message", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Rate limit reached"}}`, false},
+		{"unauthorized message", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"Unauthorized: invalid API key"}}`, false},
+	} {
+		if got := cacheError([]byte(test.body)); (got != nil) != test.cache {
+			t.Errorf("%s: expected cached %t, got: %s", test.name, test.cache, got)
+		}
+	}
+}
+
+func TestResponseCache_stats(t *testing.T) {
+	c := newResponseCache(2)
+	c.count("eth_call", false)
+	c.set("eth_call\x00a", json.RawMessage(`"0x1"`), time.Minute)
+	c.count("eth_call", true)
+	c.count("eth_call", true)
+	c.set("eth_getLogs\x00b", json.RawMessage(`[]`), time.Minute)
+	c.set(errorKeyPrefix+"eth_getLogs\x00c", json.RawMessage(`{}`), time.Minute) // Evicts eth_call.
+
+	exp := map[string]cacheStats{
+		"eth_call": {Hits: 2, Misses: 1, Evictions: 1, HitRatio: 2.0 / 3},
+	}
+	if got := c.statsSnapshot(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %+v, got %+v", exp, got)
+	}
+	if m := keyMethod(errorKeyPrefix + "eth_getLogs\x00c"); m != "eth_getLogs" {
+		t.Errorf("expected eth_getLogs, got %q", m)
+	}
+}
+
+func TestResponseCache_setEnabled(t *testing.T) {
+	c := newResponseCache(10)
+	c.set("eth_call\x00a", json.RawMessage(`"0x1"`), time.Minute)
+	c.set(errorKeyPrefix+"eth_call\x00b", json.RawMessage(`{}`), time.Minute)
+	c.set("eth_getBalance\x00a", json.RawMessage(`"0x2"`), time.Minute)
+
+	c.setEnabled("eth_call", false)
+	if c.enabled("eth_call") || !c.enabled("eth_getBalance") {
+		t.Fatal("expected only eth_call to be turned off")
+	}
+	c.set("eth_call\x00c", json.RawMessage(`"0x3"`), time.Minute)
+	for _, key := range []string{"eth_call\x00a", errorKeyPrefix + "eth_call\x00b", "eth_call\x00c"} {
+		if _, ok := c.get(key); ok {
+			t.Errorf("%q: expected no entry while turned off", key)
+		}
+	}
+	if !reflect.DeepEqual(c.disabled(), []string{"eth_call"}) {
+		t.Errorf("expected eth_call to be reported as turned off, got %v", c.disabled())
+	}
+
+	c.setEnabled("eth_call", true)
+	if _, ok := c.get("eth_call\x00a"); ok {
+		t.Error("expected entries dropped when turned off to stay dropped")
+	}
+	c.set("eth_call\x00a", json.RawMessage(`"0x1"`), time.Minute)
+	if _, ok := c.get("eth_call\x00a"); !ok {
+		t.Error("expected caching to resume once turned back on")
+	}
+
+	if n := c.flush(); n != 2 {
+		t.Errorf("expected 2 entries flushed, got %d", n)
+	}
+	if _, ok := c.get("eth_getBalance\x00a"); ok {
+		t.Error("expected no entries after a flush")
+	}
+}
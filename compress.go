@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// acceptsGzip returns true if the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			parts := strings.Split(enc, ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			if len(parts) > 1 && strings.ReplaceAll(strings.TrimSpace(parts[1]), " ", "") == "q=0" {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter gzips responses of at least minBytes which aren't
+// already encoded. Smaller responses are buffered and written as is by Close.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool // Set once the response is being written, compressed or not.
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, minBytes int) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes, status: http.StatusOK}
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) < g.minBytes {
+		return len(p), nil
+	}
+	if err := g.start(g.ResponseWriter.Header().Get("Content-Encoding") == ""); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start writes the header and buffered body, compressing from now on if
+// compress is true.
+func (g *gzipResponseWriter) start(compress bool) error {
+	g.decided = true
+	h := g.ResponseWriter.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	buf := g.buf
+	g.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(buf)
+	} else {
+		_, err = g.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush flushes compressed data written so far. A response still being
+// buffered is not flushed, since it may yet be compressed.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		return
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any buffered response and completes the gzip stream.
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		return g.start(false)
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
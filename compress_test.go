@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, exp := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"br":                false,
+		"gzip;q=0":          false,
+		"gzip; q=0":         false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if got := acceptsGzip(r); got != exp {
+			t.Errorf("%q: expected %t, got %t", header, exp, got)
+		}
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	large := strings.Repeat(`{"jsonrpc":"2.0","id":1,"result":"0x0"}`, 100)
+	for _, test := range []struct {
+		name     string
+		body     string
+		encoding string // Content-Encoding already set by the handler.
+		gzipped  bool
+	}{
+		{"small", `{"jsonrpc":"2.0","id":1,"result":"0x0"}`, "", false},
+		{"large", large, "", true},
+		{"encoded", large, "br", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			gw := newGzipResponseWriter(rec, 1024)
+			gw.Header().Set("Content-Length", "1")
+			if test.encoding != "" {
+				gw.Header().Set("Content-Encoding", test.encoding)
+			}
+			gw.WriteHeader(http.StatusAccepted)
+			for i := 0; i < len(test.body); i += 100 {
+				end := i + 100
+				if end > len(test.body) {
+					end = len(test.body)
+				}
+				gw.Write([]byte(test.body[i:end]))
+			}
+			if err := gw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusAccepted {
+				t.Errorf("expected status %d, got %d", http.StatusAccepted, rec.Code)
+			}
+			body := rec.Body.String()
+			if test.gzipped {
+				if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "" {
+					t.Errorf("unexpected headers: %v", rec.Header())
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			} else if rec.Header().Get("Content-Encoding") != test.encoding {
+				t.Errorf("expected Content-Encoding %q, got %q", test.encoding, rec.Header().Get("Content-Encoding"))
+			}
+			if body != test.body {
+				t.Errorf("expected body %q, got %q", test.body, body)
+			}
+		})
+	}
+}
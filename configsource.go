@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFetchTimeout bounds fetching a remote config at startup.
+const configFetchTimeout = 10 * time.Second
+
+// loadConfig reads the config at location, either a file path or an http(s)
+// URL, into cfg. YAML is read instead of TOML if a remote config's
+// Content-Type says so, or the location ends in .yaml or .yml.
+func loadConfig(ctx context.Context, location string, cfg *ConfigData) error {
+	if u, err := url.Parse(location); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		data, contentType, err := fetchConfig(ctx, location)
+		if err != nil {
+			return fmt.Errorf("failed to fetch config: %v", err)
+		}
+		return parseConfig(data, configFormat(contentType, u.Path), cfg)
+	}
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return err
+	}
+	return parseConfig(data, configFormat("", location), cfg)
+}
+
+// fetchConfig gets the config at u, returning its body and Content-Type.
+func fetchConfig(ctx context.Context, u string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, configFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, res.Header.Get("Content-Type"), nil
+}
+
+// configFormat returns "yaml" or "toml" based on contentType, falling back to
+// the extension of name, and to TOML.
+func configFormat(contentType, name string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch {
+		case strings.HasSuffix(mt, "yaml"):
+			return "yaml"
+		case strings.HasSuffix(mt, "toml"):
+			return "toml"
+		}
+	}
+	switch path.Ext(name) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "toml"
+}
+
+// parseConfig parses data in format into cfg. YAML keys are the same as the
+// TOML ones.
+func parseConfig(data []byte, format string, cfg *ConfigData) error {
+	var tree *toml.Tree
+	var err error
+	if format == "yaml" {
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("invalid yaml config: %v", err)
+		}
+		tree, err = toml.TreeFromMap(m)
+	} else {
+		tree, err = toml.LoadBytes(data)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s config: %v", format, err)
+	}
+	return tree.Unmarshal(cfg)
+}
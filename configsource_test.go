@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testTOMLConfig = `URL = "http://node:8040"
+Allow = ["eth_chainId", "eth_call"]
+MethodTimeouts = { debug_traceTransaction = "2m" }
+`
+	testYAMLConfig = `URL: http://node:8040
+Allow:
+  - eth_chainId
+  - eth_call
+MethodTimeouts:
+  debug_traceTransaction: 2m
+`
+)
+
+func checkTestConfig(t *testing.T, name string, cfg ConfigData) {
+	t.Helper()
+	if cfg.URL != "http://node:8040" || len(cfg.Allow) != 2 || cfg.MethodTimeouts["debug_traceTransaction"] != 2*time.Minute {
+		t.Errorf("%s: unexpected config: %+v", name, cfg)
+	}
+}
+
+func TestLoadConfig_remote(t *testing.T) {
+	srv := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config":
+			w.Header().Set("Content-Type", "application/toml")
+			w.Write([]byte(testTOMLConfig))
+		case "/config.yaml":
+			w.Write([]byte(testYAMLConfig))
+		case "/yaml":
+			w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+			w.Write([]byte(testYAMLConfig))
+		case "/invalid":
+			w.Write([]byte(`URL = `))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	for _, path := range []string{"/config", "/config.yaml", "/yaml"} {
+		var cfg ConfigData
+		if err := loadConfig(context.Background(), srv.URL+path, &cfg); err != nil {
+			t.Errorf("%s: unexpected error: %v", path, err)
+			continue
+		}
+		checkTestConfig(t, path, cfg)
+	}
+	for _, path := range []string{"/missing", "/invalid"} {
+		var cfg ConfigData
+		if err := loadConfig(context.Background(), srv.URL+path, &cfg); err == nil {
+			t.Errorf("%s: expected error", path)
+		}
+	}
+}
+
+func TestLoadConfig_file(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"config.toml": testTOMLConfig, "config.yml": testYAMLConfig} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var cfg ConfigData
+		if err := loadConfig(context.Background(), path, &cfg); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		checkTestConfig(t, name, cfg)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// sharedResponse is an upstream response shared by identical concurrent
+// requests.
+type sharedResponse struct {
+	res  *http.Response // Body is not set.
+	body []byte
+	err  error // Set if reading the body failed.
+}
+
+// forwardShared forwards req like forwardWithRetries, except that identical
+// concurrent requests for idempotent methods share a single upstream request
+// when deduplication is enabled. Each caller gets its own copy of the
+// response, with its own request id.
+func (t *myTransport) forwardShared(ctx context.Context, req *http.Request, parsedRequests []ModifiedRequest) (*http.Response, error) {
+	if t.inflight == nil || len(parsedRequests) != 1 || !idempotent(parsedRequests) {
+		return t.forwardWithRetries(ctx, req, parsedRequests)
+	}
+	key, err := cacheKey(parsedRequests[0], false)
+	if err != nil {
+		return t.forwardWithRetries(ctx, req, parsedRequests)
+	}
+	key += "\x00" + req.URL.String()
+
+	var leader bool
+	v, err, _ := t.inflight.Do(key, func() (interface{}, error) {
+		leader = true
+		res, err := t.forwardWithRetries(ctx, req, parsedRequests)
+		if err != nil {
+			return nil, err
+		}
+		body, err := readBody(res, t.maxResponseBytes)
+		res.Body = nil
+		return &sharedResponse{res: res, body: body, err: err}, nil
+	})
+	if err != nil {
+		if !leader && errors.Is(err, context.Canceled) && req.Context().Err() == nil {
+			// The request we were waiting on was cancelled by its client.
+			return t.forwardWithRetries(ctx, req, parsedRequests)
+		}
+		return nil, err
+	}
+	shared := v.(*sharedResponse)
+	res := new(http.Response)
+	*res = *shared.res
+	res.Header = shared.res.Header.Clone()
+	res.Request = req
+	if shared.err != nil {
+		res.Body = ioutil.NopCloser(errReader{shared.err})
+		return res, nil
+	}
+	body := shared.body
+	if !leader {
+		if res.Header.Get("Content-Encoding") != "" {
+			return t.forwardWithRetries(ctx, req, parsedRequests)
+		}
+		body, err = withID(body, parsedRequests[0].ID)
+		if err != nil {
+			return t.forwardWithRetries(ctx, req, parsedRequests)
+		}
+		res.Header.Del("Content-Length")
+	}
+	res.ContentLength = int64(len(body))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// withID returns a copy of the JSON-RPC response body with its id replaced.
+func withID(body []byte, id json.RawMessage) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	resp["id"] = responseID(id)
+	return json.Marshal(resp)
+}
+
+// errReader returns err from every Read.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sunsetDateFormat is the format of configured sunset dates.
+const sunsetDateFormat = "2006-01-02"
+
+// deprecations maps deprecated methods to their sunset, the start of the day
+// (UTC) from which they are rejected. Until then they are forwarded with a
+// warning.
+type deprecations map[string]time.Time
+
+// parseDeprecations parses configured method -> sunset date entries.
+func parseDeprecations(configured map[string]string) (deprecations, error) {
+	d := make(deprecations, len(configured))
+	for m, date := range configured {
+		if m == "" {
+			return nil, fmt.Errorf("deprecation with empty method name")
+		}
+		sunset, err := time.Parse(sunsetDateFormat, date)
+		if err != nil {
+			return nil, fmt.Errorf("deprecation of %s: invalid sunset date %q, expected YYYY-MM-DD", m, date)
+		}
+		d[m] = sunset
+	}
+	return d, nil
+}
+
+// removed returns the sunset of method if it has passed at now.
+func (d deprecations) removed(method string, now time.Time) (time.Time, bool) {
+	sunset, ok := d[method]
+	if !ok || now.Before(sunset) {
+		return time.Time{}, false
+	}
+	return sunset, true
+}
+
+// pending returns the deprecated methods, sorted, which are still forwarded
+// at now.
+func (d deprecations) pending(methods []string, now time.Time) []string {
+	var ms []string
+	for _, m := range methods {
+		if sunset, ok := d[m]; ok && now.Before(sunset) {
+			ms = append(ms, m)
+		}
+	}
+	sort.Strings(ms)
+	return ms
+}
+
+// warn adds headers to res announcing the sunset of methods: a Warning for
+// each, Deprecation, and Sunset with the earliest date.
+func (d deprecations) warn(res *http.Response, methods []string) {
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	var earliest time.Time
+	for _, m := range methods {
+		sunset := d[m]
+		res.Header.Add("Warning", fmt.Sprintf(`299 rpc-proxy "%s is deprecated and will be removed on %s"`, m, sunset.Format(sunsetDateFormat)))
+		if earliest.IsZero() || sunset.Before(earliest) {
+			earliest = sunset
+		}
+	}
+	res.Header.Set("Deprecation", "true")
+	res.Header.Set("Sunset", earliest.Format(http.TimeFormat))
+}
+
+func jsonRPCMethodRemoved(id json.RawMessage, method string, sunset time.Time) interface{} {
+	return jsonRPCError(id, jsonRPCMethodNotAllowed, fmt.Sprintf("%s was removed on %s", method, sunset.Format(sunsetDateFormat)))
+}
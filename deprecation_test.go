@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDeprecations(t *testing.T) {
+	d, err := parseDeprecations(map[string]string{"eth_old": "2030-01-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC); !d["eth_old"].Equal(want) {
+		t.Errorf("expected sunset %s, got %s", want, d["eth_old"])
+	}
+	for _, bad := range []map[string]string{
+		{"eth_old": "2030-13-01"},
+		{"eth_old": "01/02/2030"},
+		{"": "2030-01-02"},
+	} {
+		if _, err := parseDeprecations(bad); err == nil {
+			t.Errorf("%v: expected error", bad)
+		}
+	}
+}
+
+func TestRoundTrip_deprecations(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_*")
+	var err error
+	tr.deprecations, err = parseDeprecations(map[string]string{
+		"eth_soon":  time.Now().AddDate(0, 0, 2).UTC().Format(sunsetDateFormat),
+		"eth_later": time.Now().AddDate(0, 0, 10).UTC().Format(sunsetDateFormat),
+		"eth_gone":  "2020-01-01",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func(body string) *http.Response {
+		resp := testRoundTrip(t, tr, upstream.URL, body)
+		return resp
+	}
+
+	resp := roundTrip(`[{"jsonrpc":"2.0","id":1,"method":"eth_later"},{"jsonrpc":"2.0","id":2,"method":"eth_soon"}]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if w := resp.Header.Values("Warning"); len(w) != 2 || !strings.Contains(w[0], "eth_later") || !strings.Contains(w[1], "eth_soon") {
+		t.Errorf("expected a warning per deprecated method, got %q", w)
+	}
+	if got, want := resp.Header.Get("Sunset"), tr.deprecations["eth_soon"].Format(http.TimeFormat); got != want {
+		t.Errorf("expected Sunset %q, got %q", want, got)
+	}
+
+	resp = roundTrip(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if resp.Header.Get("Warning") != "" || resp.Header.Get("Sunset") != "" {
+		t.Errorf("unexpected deprecation headers: %v", resp.Header)
+	}
+
+	resp = roundTrip(`{"jsonrpc":"2.0","id":1,"method":"eth_gone"}`)
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("expected status %d, got %d", http.StatusGone, resp.StatusCode)
+	}
+}
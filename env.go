@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased ConfigData field name to form the
+// environment variable name, e.g. RPCPROXY_URL or RPCPROXY_BLOCKRANGELIMIT.
+const envPrefix = "RPCPROXY_"
+
+// loadEnv populates unset fields of cfg from environment variables looked up
+// with lookup. Fields which already hold a non-zero value are left untouched,
+// so the environment has the lowest precedence. List values are comma
+// separated, like their flag equivalents, and map values are comma separated
+// key=value pairs. Lists and maps of tables, like Keys or Cache, are JSON.
+func (cfg *ConfigData) loadEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() || !f.IsZero() {
+			continue
+		}
+		name := envPrefix + strings.ToUpper(t.Field(i).Name)
+		s, ok := lookup(name)
+		if !ok || s == "" {
+			continue
+		}
+		if err := setFromString(f, s); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setFromString parses s according to the kind of f and stores the result.
+func setFromString(f reflect.Value, s string) error {
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(f.Type().Elem())
+		if err := setFromString(p.Elem(), s); err != nil {
+			return err
+		}
+		f.Set(p)
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(i)
+	case reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetUint(u)
+	case reflect.Float64:
+		fl, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(fl)
+	case reflect.Slice:
+		switch f.Type().Elem().Kind() {
+		case reflect.Struct:
+			return setFromJSON(f, s)
+		case reflect.String:
+			f.Set(reflect.ValueOf(strings.Split(s, ",")))
+		default:
+			return fmt.Errorf("unsupported type: %s", f.Type())
+		}
+	case reflect.Map:
+		if f.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type: %s", f.Type())
+		}
+		if f.Type().Elem().Kind() == reflect.Struct {
+			return setFromJSON(f, s)
+		}
+		m := reflect.MakeMap(f.Type())
+		for _, entry := range strings.Split(s, ",") {
+			kv := strings.SplitN(entry, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid entry %q, expected key=value", entry)
+			}
+			v := reflect.New(f.Type().Elem()).Elem()
+			if err := setFromString(v, kv[1]); err != nil {
+				return fmt.Errorf("%s: %v", kv[0], err)
+			}
+			m.SetMapIndex(reflect.ValueOf(kv[0]).Convert(f.Type().Key()), v)
+		}
+		f.Set(m)
+	default:
+		return fmt.Errorf("unsupported type: %s", f.Type())
+	}
+	return nil
+}
+
+// setFromJSON parses the JSON value s like the config file's value for f
+// would be, with the same keys and e.g. durations as strings, and stores the
+// result. JSON is valid YAML, so it is decoded like YAML config files are,
+// which unlike encoding/json keeps integers apart from floats.
+func setFromJSON(f reflect.Value, s string) error {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return err
+	}
+	tree, err := toml.TreeFromMap(map[string]interface{}{"v": v})
+	if err != nil {
+		return err
+	}
+	p := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: f.Type(), Tag: `toml:"v"`}}))
+	if err := tree.Unmarshal(p.Interface()); err != nil {
+		return err
+	}
+	f.Set(p.Elem().Field(0))
+	return nil
+}
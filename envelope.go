@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// invalidRequestError is returned for a message which parses, but isn't a
+// valid JSON-RPC 2.0 request.
+type invalidRequestError struct {
+	id     json.RawMessage // Of the offending request, nil if unknown.
+	reason string
+}
+
+func (e *invalidRequestError) Error() string {
+	return "invalid request: " + e.reason
+}
+
+// envelope holds the members every JSON-RPC 2.0 request must have. They are
+// kept raw so that wrong types are reported instead of failing to decode.
+type envelope struct {
+	JSONRPC json.RawMessage `json:"jsonrpc"`
+	Method  json.RawMessage `json:"method"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// checkEnvelope returns an *invalidRequestError if the request, or any
+// request of the batch, in body lacks "jsonrpc": "2.0", has a missing or
+// empty method, or has an id which isn't a string, number or null. Batches
+// must not repeat ids, except for notifications without one.
+func checkEnvelope(body []byte) error {
+	var envs []envelope
+	if isBatch(body) {
+		if err := json.Unmarshal(body, &envs); err != nil {
+			return &invalidRequestError{reason: err.Error()}
+		}
+	} else {
+		var env envelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			return &invalidRequestError{reason: err.Error()}
+		}
+		envs = append(envs, env)
+	}
+	seen := make(map[string]struct{}, len(envs)) // ids of the batch
+	for _, env := range envs {
+		if !validID(env.ID) {
+			return &invalidRequestError{reason: "id must be a string, number or null"}
+		}
+		if key, ok := idKey(env.ID); ok {
+			if _, dup := seen[key]; dup {
+				return &invalidRequestError{id: env.ID, reason: "duplicate id in batch"}
+			}
+			seen[key] = struct{}{}
+		}
+		if !bytes.Equal(env.JSONRPC, []byte(`"2.0"`)) {
+			return &invalidRequestError{id: env.ID, reason: `jsonrpc must be "2.0"`}
+		}
+		var method string
+		if err := json.Unmarshal(env.Method, &method); err != nil || method == "" {
+			return &invalidRequestError{id: env.ID, reason: "method must be a non-empty string"}
+		}
+	}
+	return nil
+}
+
+// validID returns true if id is absent, null, a string or a number.
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch c := id[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	}
+	return bytes.Equal(id, []byte("null"))
+}
+
+// idKey returns a key identifying the valid id, so that the same string with
+// different escaping matches, or false for a notification's absent or null
+// id. Strings and numbers never match each other.
+func idKey(id json.RawMessage) (string, bool) {
+	if len(id) == 0 || bytes.Equal(id, []byte("null")) {
+		return "", false
+	}
+	if id[0] == '"' {
+		var s string
+		if err := json.Unmarshal(id, &s); err == nil {
+			return "s" + s, true
+		}
+	}
+	return "n" + string(id), true
+}
+
+// ID types requests may be coerced to with IDType.
+const (
+	idTypeNumber = "number"
+	idTypeString = "string"
+)
+
+// parseIDType returns an error unless s is "", which leaves ids unchanged,
+// idTypeNumber or idTypeString.
+func parseIDType(s string) (string, error) {
+	switch s {
+	case "", idTypeNumber, idTypeString:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown id type %q, must be %q or %q", s, idTypeNumber, idTypeString)
+}
+
+// coerceIDs rewrites the body of req so that every request with an id has
+// one of idType, for upstreams which only accept one. Ids are replaced by
+// their position, so they stay unique. It returns the original ids keyed by
+// the new ones, for restoreIDs, or nil if every id already had the type.
+func coerceIDs(req *http.Request, parsedRequests []ModifiedRequest, idType string) (map[string]json.RawMessage, error) {
+	wantString := idType == idTypeString
+	var mismatched bool
+	for _, r := range parsedRequests {
+		if _, ok := idKey(r.ID); ok && (r.ID[0] == '"') != wantString {
+			mismatched = true
+			break
+		}
+	}
+	if !mismatched {
+		return nil, nil
+	}
+	origIDs := make(map[string]json.RawMessage, len(parsedRequests))
+	err := rewriteRequests(req, func(reqs []map[string]json.RawMessage) (bool, error) {
+		for i, r := range reqs {
+			if _, ok := idKey(r["id"]); !ok {
+				continue // Notifications have no response to correlate.
+			}
+			id := json.RawMessage(strconv.Itoa(i + 1))
+			if idType == idTypeString {
+				id = json.RawMessage(strconv.Quote(string(id)))
+			}
+			origIDs[string(id)] = r["id"]
+			r["id"] = id
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return origIDs, nil
+}
+
+// restoreIDs replaces the ids in the response body with the originals
+// returned by coerceIDs, so that clients can correlate the responses.
+func restoreIDs(body []byte, origIDs map[string]json.RawMessage) ([]byte, error) {
+	restore := func(resp map[string]json.RawMessage) {
+		if id, ok := origIDs[string(resp["id"])]; ok {
+			resp["id"] = id
+		}
+	}
+	if isBatch(body) {
+		var resps []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &resps); err != nil {
+			return nil, err
+		}
+		for _, resp := range resps {
+			restore(resp)
+		}
+		return json.Marshal(resps)
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	restore(resp)
+	return json.Marshal(resp)
+}
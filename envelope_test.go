@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckEnvelope(t *testing.T) {
+	for _, test := range []struct {
+		body  string
+		valid bool
+		id    string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, true, ""},
+		{`{"jsonrpc":"2.0","id":"a","method":"eth_chainId"}`, true, ""},
+		{`{"jsonrpc":"2.0","id":null,"method":"eth_chainId"}`, true, ""},
+		{`{"jsonrpc":"2.0","method":"eth_chainId"}`, true, ""},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":-2,"method":"eth_blockNumber"}]`, true, ""},
+		{`{"id":1,"method":"eth_chainId"}`, false, "1"},
+		{`{"jsonrpc":"1.0","id":1,"method":"eth_chainId"}`, false, "1"},
+		{`{"jsonrpc":2.0,"id":1,"method":"eth_chainId"}`, false, "1"},
+		{`{"jsonrpc":"2.0","id":1}`, false, "1"},
+		{`{"jsonrpc":"2.0","id":1,"method":""}`, false, "1"},
+		{`{"jsonrpc":"2.0","id":1,"method":1}`, false, "1"},
+		{`{"jsonrpc":"2.0","id":{},"method":"eth_chainId"}`, false, ""},
+		{`{"jsonrpc":"2.0","id":true,"method":"eth_chainId"}`, false, ""},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2}]`, false, "2"},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}]`, false, "1"},
+		{`[{"jsonrpc":"2.0","id":"a","method":"eth_chainId"},{"jsonrpc":"2.0","id":"\u0061","method":"eth_blockNumber"}]`, false, `"\u0061"`},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":"1","method":"eth_blockNumber"}]`, true, ""},
+		{`[{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","method":"eth_blockNumber"},{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}]`, true, ""},
+		{`[{"jsonrpc":"2.0","id":null,"method":"eth_chainId"},{"jsonrpc":"2.0","id":null,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`, true, ""},
+		{`[{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","id":3,"method":"eth_chainId"},{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}]`, false, "3"},
+	} {
+		err := checkEnvelope([]byte(test.body))
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.body, err)
+			}
+			continue
+		}
+		var invalid *invalidRequestError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s: expected invalid request error, got: %v", test.body, err)
+		} else if string(invalid.id) != test.id {
+			t.Errorf("%s: expected id %q, got %q", test.body, test.id, invalid.id)
+		}
+	}
+}
+
+func TestRoundTrip_invalidRequest(t *testing.T) {
+	var called bool
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	resp := testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"1.0","id":4,"method":"eth_chainId"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	var errResp ErrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code != jsonRPCInvalidRequest || string(errResp.ID) != "4" {
+		t.Errorf("expected invalid request error, got: %+v %v", errResp, err)
+	}
+	if called {
+		t.Error("invalid request was forwarded")
+	}
+}
+
+func TestCoerceIDs(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		idType  string
+		body    string
+		expBody string // empty if unchanged
+		resp    string // upstream response to the coerced body
+		expResp string // resp with the original ids
+	}{
+		{
+			name:   "already numbers",
+			idType: idTypeNumber,
+			body:   `{"jsonrpc":"2.0","id":7,"method":"eth_chainId"}`,
+		},
+		{
+			name:    "string to number",
+			idType:  idTypeNumber,
+			body:    `{"jsonrpc":"2.0","id":"abc","method":"eth_chainId"}`,
+			expBody: `{"id":1,"jsonrpc":"2.0","method":"eth_chainId"}`,
+			resp:    `{"jsonrpc":"2.0","id":1,"result":"0x1"}`,
+			expResp: `{"id":"abc","jsonrpc":"2.0","result":"0x1"}`,
+		},
+		{
+			name:    "batch to strings",
+			idType:  idTypeString,
+			body:    `[{"jsonrpc":"2.0","id":"a","method":"eth_chainId"},{"jsonrpc":"2.0","id":1,"method":"net_version"},{"jsonrpc":"2.0","method":"eth_blockNumber"}]`,
+			expBody: `[{"id":"1","jsonrpc":"2.0","method":"eth_chainId"},{"id":"2","jsonrpc":"2.0","method":"net_version"},{"jsonrpc":"2.0","method":"eth_blockNumber"}]`,
+			resp:    `[{"jsonrpc":"2.0","id":"2","result":"1"},{"jsonrpc":"2.0","id":"1","result":"0x1"}]`,
+			expResp: `[{"id":1,"jsonrpc":"2.0","result":"1"},{"id":"a","jsonrpc":"2.0","result":"0x1"}]`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			_, _, parsed, err := parseRequests(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			origIDs, err := coerceIDs(req, parsed, test.idType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expBody == "" {
+				if origIDs != nil || string(body) != test.body {
+					t.Errorf("expected the request to be unchanged, got %s", body)
+				}
+				return
+			}
+			if string(body) != test.expBody {
+				t.Errorf("expected body %s but got %s", test.expBody, body)
+			}
+			resp, err := restoreIDs([]byte(test.resp), origIDs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp) != test.expResp {
+				t.Errorf("expected response %s but got %s", test.expResp, resp)
+			}
+		})
+	}
+}
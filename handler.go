@@ -1,36 +1,144 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gochain/gochain/v3/common/hexutil"
 	"github.com/gochain/gochain/v3/goclient"
 	"github.com/gochain/gochain/v3/rpc"
 	"github.com/treeder/gotils/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/sync/singleflight"
 )
 
 type myTransport struct {
-	blockRangeLimit uint64 // 0 means none
+	blockRangeLimit      uint64 // 0 means none
+	maxTopicAlternatives int    // 0 means none
+	maxLogAddresses      int    // addresses per logs filter, 0 means none
+	maxLogResults        int    // logs per eth_getLogs or eth_getFilterLogs result, 0 means none
+	subscriptions        subscriptionFilter
+	allowSendTransaction bool
+	readOnly             int32                     // 1 rejects writeMethods, accessed atomically so it can be toggled at runtime
+	syncing              int32                     // 1 rejects reads while the upstream is syncing, accessed atomically
+	blockedSenders       blockedSenders            // eth_sendRawTransaction senders rejected, nil means none
+	minGasPrice          *big.Int                  // eth_sendRawTransaction gas price floor in wei, nil means none
+	maxBatchSize         int                       // requests per batch, 0 means none
+	maxTagResolutions    int                       // latest or pending block tags per request, 0 means none
+	minParams            map[string]int            // method -> minimum number of params
+	validators           map[string]paramValidator // method -> param validator
+	deprecations         deprecations              // method -> sunset
+	requireJSON          bool                      // reject POSTs without a JSON Content-Type
+	queryRequests        bool                      // rewrite GETs with a JSON-RPC call in the query as POSTs
+	idType               string                    // type request ids are coerced to, "" means they're passed through
+	fillParams           bool                      // add an empty params array to requests without params
 
 	matcher
 	limiters
+	apiKeys apiKeys // per-key matchers and limiters, nil means none
+
+	clientIDHeader string // identifies clients for rate limiting when set by one of trustedProxies, "" means none
+	trustedProxies ipSet
 
 	latestBlock
+	finalityDepth uint64
+
+	cache           *responseCache // nil means disabled
+	cachePolicies   map[string]CachePolicy
+	finalizedMaxAge time.Duration // caps the TTL of finalized responses, 0 means none
+	errorCacheTTL   time.Duration // how long upstream errors are cached, 0 means never
+	splitLogQueries bool          // split eth_getLogs at the finality boundary
+	refreshedHead   uint64        // last head cached results were refreshed for, accessed atomically
+
+	forwardHeaders  map[string]struct{}      // canonical client headers forwarded besides the defaults
+	upstreamHeaders map[string]string        // headers set on every upstream request
+	upstream        http.RoundTripper        // nil means http.DefaultTransport
+	upstreamTimeout time.Duration            // 0 means none
+	methodTimeouts  map[string]time.Duration // method -> timeout, overriding upstreamTimeout
+
+	maxRetries   int           // retries of idempotent requests, 0 means none
+	retryBackoff time.Duration // delay before the first retry, doubled for each one after
+
+	routes       map[string]*url.URL        // method -> upstream, others go to the primary upstream
+	archive      *url.URL                   // nil means none
+	archiveDepth uint64                     // blocks behind head served by the archive upstream
+	breakers     map[string]*circuitBreaker // upstream url -> breaker, nil means disabled
+
+	shadowURL        *url.URL // upstream idempotent requests are mirrored to, nil means none
+	shadowSampleRate float64  // fraction of idempotent requests mirrored
+
+	maxResponseBytes      int64 // 0 means none
+	maxBatchResponseBytes int64 // combined batch response limit, 0 means none
+	streamResponses       bool  // relay responses which are only size limited as they arrive
+
+	retryAfter time.Duration // base Retry-After when the upstream is unavailable, 0 means none
+
+	inflight *singleflight.Group // shares upstream requests between identical ones, nil means disabled
+
+	pipelines map[string]*pipeline // method -> request and response transforms
+
+	latency latencyWindow // recent upstream response times, for the admin status
+}
+
+// idempotentMethods are read-only methods which are safe to send upstream
+// more than once.
+var idempotentMethods = map[string]struct{}{
+	"eth_blockNumber":                         {},
+	"eth_call":                                {},
+	"eth_chainId":                             {},
+	"eth_createAccessList":                    {},
+	"eth_estimateGas":                         {},
+	"eth_gasPrice":                            {},
+	"eth_getBalance":                          {},
+	"eth_getBlockByHash":                      {},
+	"eth_getBlockByNumber":                    {},
+	"eth_getBlockTransactionCountByHash":      {},
+	"eth_getBlockTransactionCountByNumber":    {},
+	"eth_getCode":                             {},
+	"eth_getLogs":                             {},
+	"eth_getStorageAt":                        {},
+	"eth_getTransactionByBlockHashAndIndex":   {},
+	"eth_getTransactionByBlockNumberAndIndex": {},
+	"eth_getTransactionByHash":                {},
+	"eth_getTransactionCount":                 {},
+	"eth_getTransactionReceipt":               {},
+	"net_version":                             {},
+	"web3_clientVersion":                      {},
+}
+
+// idempotent returns true if every request is for an idempotent method.
+func idempotent(parsedRequests []ModifiedRequest) bool {
+	for _, r := range parsedRequests {
+		if _, ok := idempotentMethods[r.Path]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 type ModifiedRequest struct {
 	Path       string
 	RemoteAddr string // Original IP, not CloudFlare or load balancer.
+	APIKey     string // Presented in the X-API-Key header, "" means none.
+	ClientID   string // Set by a trusted proxy in the ClientIDHeader, "" means none.
 	ID         json.RawMessage
 	Params     []json.RawMessage
 }
@@ -45,19 +153,78 @@ func isBatch(msg []byte) bool {
 	return false
 }
 
+// clientID returns the client identity in the clientIDHeader of req, if it
+// came straight from one of the trustedProxies, otherwise "".
+func (t *myTransport) clientID(req *http.Request) string {
+	if t.clientIDHeader == "" || !t.trustedProxies.contains(normalizeIP(req.RemoteAddr)) {
+		return ""
+	}
+	return strings.TrimSpace(req.Header.Get(t.clientIDHeader))
+}
+
+// setClientID sets the ClientID of each request in res to id, if any.
+func setClientID(res []ModifiedRequest, id string) {
+	if id == "" {
+		return
+	}
+	for i := range res {
+		res[i].ClientID = id
+	}
+}
+
 // getIP returns the original IP address from the request, checking special headers before falling back to RemoteAddr.
+// The result is normalized with normalizeIP.
 func getIP(r *http.Request) string {
 	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
+		return normalizeIP(ip)
 	}
 	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
 		// Trim off any others: A.B.C.D[,X.X.X.X,Y.Y.Y.Y,]
-		return strings.SplitN(ip, ",", 1)[0]
+		return normalizeIP(strings.SplitN(ip, ",", 2)[0])
+	}
+	return normalizeIP(r.RemoteAddr)
+}
+
+// normalizeIP returns the canonical form of an IP address which may include
+// a port or brackets, so that each client has a single limiter key. IPv6
+// addresses are compressed and IPv4-mapped ones reduced to IPv4. Anything
+// which isn't an IP is returned trimmed but otherwise unchanged.
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
 	}
-	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// ipPrefix returns the network of ip with its first v4 or v6 bits kept, e.g.
+// "192.0.2.0/24", so that a whole subnet shares one key. ip is returned as is
+// if it isn't an IP, or if the prefix length is 0 or covers the whole address.
+func ipPrefix(ip string, v4, v6 int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
 		return ip
 	}
-	return r.RemoteAddr
+	bits, ones := 8*net.IPv6len, v6
+	if p4 := parsed.To4(); p4 != nil {
+		parsed, bits, ones = p4, 8*net.IPv4len, v4
+	}
+	if ones <= 0 || ones >= bits {
+		return ip
+	}
+	mask := net.CIDRMask(ones, bits)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// isJSON returns true if contentType is application/json, with any
+// parameters such as charset.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
 }
 
 func parseRequests(r *http.Request) (string, []string, []ModifiedRequest, error) {
@@ -69,12 +236,20 @@ func parseRequests(r *http.Request) (string, []string, []ModifiedRequest, error)
 		r.Body.Close()
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(body)) // must be done, even when err
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to read body: %v", err)
+			return "", nil, nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
 		}
 		methods, res, err = parseMessage(body, ip)
 		if err != nil {
 			return "", nil, nil, err
 		}
+		if len(res) > 0 {
+			if err := checkEnvelope(body); err != nil {
+				return "", nil, nil, err
+			}
+		}
 	}
 	if len(res) == 0 {
 		methods = append(methods, r.URL.Path)
@@ -83,6 +258,7 @@ func parseRequests(r *http.Request) (string, []string, []ModifiedRequest, error)
 			RemoteAddr: ip,
 		})
 	}
+	setAPIKey(res, r.Header.Get(apiKeyHeader))
 	return ip, methods, res, nil
 }
 
@@ -124,27 +300,87 @@ func parseMessage(body []byte, ip string) (methods []string, res []ModifiedReque
 	return methods, res, nil
 }
 
+// JSON-RPC error codes of the proxy's own errors. Each rejection reason has a
+// stable code, documented in the README, so clients can tell them apart.
 const (
-	jsonRPCTimeout       = -32000
-	jsonRPCUnavailable   = -32601
-	jsonRPCInvalidParams = -32602
-	jsonRPCInternal      = -32603
+	jsonRPCInvalidRequest   = -32600 // not a valid JSON-RPC 2.0 request
+	jsonRPCMethodNotAllowed = -32601 // method, subscription or sender not allowed
+	jsonRPCInvalidParams    = -32602
+	jsonRPCInternal         = -32603
+	jsonRPCRateLimited      = -32000 // rate or concurrency limit hit, retry later
+	jsonRPCUpstreamTimeout  = -32002
+	jsonRPCUpstreamDown     = -32003
+	jsonRPCResponseLimit    = -32004 // response too large
+	jsonRPCQuotaLimit       = -32005 // daily quota used up
+	jsonRPCBlockRangeWide   = -32010 // eth_getLogs or eth_newFilter block range over the limit
+	jsonRPCGasPriceTooLow   = -32011 // raw transaction gas price under the minimum
+	jsonRPCBatchTooLarge    = -32012 // more requests in a batch than allowed
+	jsonRPCTooManyTags      = -32013 // more latest or pending block tags than allowed
+	jsonRPCReadOnly         = -32014 // transactions rejected in read-only mode
+	jsonRPCTooManyLogs      = -32015 // more logs in a result than allowed
+	jsonRPCSyncing          = -32016 // reads rejected while the upstream is syncing
 )
 
 type ErrResponse struct {
 	Version string          `json:"jsonrpc"`
 	ID      json.RawMessage `json:"id"`
 	Error   struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
+		Code    int         `json:"code"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data,omitempty"`
 	} `json:"error"`
 }
 
+// retryData is the data of rate limit errors, telling clients how many
+// seconds to wait before trying again, like the Retry-After header.
+type retryData struct {
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+// retryAfterSeconds rounds d up to whole seconds, as used by Retry-After.
+func retryAfterSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// withRetryAfter returns the error response resp with a retry hint of d
+// attached. A d of 0 or less leaves resp unchanged.
+func withRetryAfter(resp interface{}, d time.Duration) interface{} {
+	e, ok := resp.(ErrResponse)
+	if !ok || d <= 0 {
+		return resp
+	}
+	e.Error.Data = retryData{RetryAfter: retryAfterSeconds(d)}
+	return e
+}
+
+// setRetryAfterHeader sets the Retry-After header of res from the retry hint
+// of the error response resp, if it has one.
+func setRetryAfterHeader(res *http.Response, resp interface{}) {
+	e, ok := resp.(ErrResponse)
+	if !ok || res == nil {
+		return
+	}
+	if d, ok := e.Error.Data.(retryData); ok {
+		res.Header.Set("Retry-After", strconv.FormatInt(d.RetryAfter, 10))
+	}
+}
+
+// responseID returns the id to echo in a synthetic response for a request
+// with the raw id bytes, verbatim so that its type and representation are
+// preserved (e.g. "1", 1 and 1.0 stay distinct). Requests without an id get
+// null.
+func responseID(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
 func jsonRPCError(id json.RawMessage, jsonCode int, msg string) interface{} {
 
 	resp := ErrResponse{
 		Version: "2.0",
-		ID:      id,
+		ID:      responseID(id),
 	}
 	resp.Error.Code = jsonCode
 	resp.Error.Message = msg
@@ -152,15 +388,74 @@ func jsonRPCError(id json.RawMessage, jsonCode int, msg string) interface{} {
 }
 
 func jsonRPCUnauthorized(id json.RawMessage, method string) interface{} {
-	return jsonRPCError(id, jsonRPCUnavailable, "You are not authorized to make this request: "+method)
+	return jsonRPCError(id, jsonRPCMethodNotAllowed, "You are not authorized to make this request: "+method)
+}
+
+func jsonRPCLimit(id json.RawMessage, retryAfter time.Duration) interface{} {
+	return withRetryAfter(jsonRPCError(id, jsonRPCRateLimited, "You hit the request limit"), retryAfter)
+}
+
+func jsonRPCSendTransaction(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCMethodNotAllowed, "eth_sendTransaction is not supported, sign the transaction locally and use eth_sendRawTransaction")
+}
+
+func jsonRPCConcurrencyLimit(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCRateLimited, "You have too many requests in flight")
+}
+
+func jsonRPCUpstreamTimeoutError(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCUpstreamTimeout, "Upstream request timed out")
+}
+
+func jsonRPCUpstreamUnavailable(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCUpstreamDown, "Upstream is unavailable, try again later")
+}
+
+func jsonRPCInvalidUpstreamResponse(id json.RawMessage, status int) interface{} {
+	return jsonRPCError(id, jsonRPCUpstreamDown, fmt.Sprintf("Upstream returned an invalid response (HTTP %d), try again later", status))
+}
+
+func jsonRPCResponseTooLarge(id json.RawMessage, limit int64) interface{} {
+	return jsonRPCError(id, jsonRPCResponseLimit, fmt.Sprintf("Response is larger than limit (%d bytes), try a smaller request.", limit))
+}
+
+func jsonRPCBatchResponseTooLarge(limit int64) interface{} {
+	return jsonRPCError(nil, jsonRPCResponseLimit, fmt.Sprintf("Batch response is larger than limit (%d bytes), try smaller batches.", limit))
+}
+
+// blockRangeData is the data of block range errors, so that clients can split
+// the requested range into queries of at most Limit blocks.
+type blockRangeData struct {
+	Limit     uint64         `json:"limit"`
+	Requested uint64         `json:"requested"`
+	FromBlock hexutil.Uint64 `json:"fromBlock"`
+	ToBlock   hexutil.Uint64 `json:"toBlock"`
+}
+
+func jsonRPCBlockRangeLimit(id json.RawMessage, r blockRange, limit uint64) interface{} {
+	e := jsonRPCError(id, jsonRPCBlockRangeWide, fmt.Sprintf("Requested range of blocks (%d) is larger than limit (%d).", r.len(), limit)).(ErrResponse)
+	e.Error.Data = blockRangeData{Limit: limit, Requested: r.len(), FromBlock: hexutil.Uint64(r.start), ToBlock: hexutil.Uint64(r.end)}
+	return e
+}
+
+func jsonRPCBatchLimit(size, limit int) interface{} {
+	return jsonRPCError(nil, jsonRPCBatchTooLarge, fmt.Sprintf("Batch of %d requests is larger than limit (%d), try smaller batches.", size, limit))
 }
 
-func jsonRPCLimit(id json.RawMessage) interface{} {
-	return jsonRPCError(id, jsonRPCTimeout, "You hit the request limit")
+func jsonRPCTagLimit(tags, limit int) interface{} {
+	return jsonRPCError(nil, jsonRPCTooManyTags, fmt.Sprintf("Request has %d latest, pending, safe or finalized block tags, more than limit (%d), try block numbers.", tags, limit))
 }
 
-func jsonRPCBlockRangeLimit(id json.RawMessage, blocks, limit uint64) interface{} {
-	return jsonRPCError(id, jsonRPCInvalidParams, fmt.Sprintf("Requested range of blocks (%d) is larger than limit (%d).", blocks, limit))
+func jsonRPCLogLimit(id json.RawMessage, logs, limit int) interface{} {
+	return jsonRPCError(id, jsonRPCTooManyLogs, fmt.Sprintf("Query returned %d logs, more than limit (%d), try a narrower block range.", logs, limit))
+}
+
+func jsonRPCNodeSyncing(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCSyncing, "Node is syncing, try again later")
+}
+
+func jsonRPCReadOnlyMode(id json.RawMessage, method string) interface{} {
+	return jsonRPCError(id, jsonRPCReadOnly, method+" is unavailable during maintenance, try again later")
 }
 
 // jsonRPCResponse returns a JSON response containing v, or a plaintext generic
@@ -176,58 +471,779 @@ func jsonRPCResponse(httpCode int, v interface{}) (*http.Response, error) {
 	return &http.Response{
 		Body:       ioutil.NopCloser(bytes.NewReader(body)),
 		StatusCode: httpCode,
+		Header:     http.Header{"Content-Type": {"application/json"}},
 	}, nil
 }
 
-func (t *myTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	ctx := req.Context()
+// credentialHeaders are removed from requests before forwarding, so client
+// credentials meant for the proxy never reach the upstream.
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// defaultForwardHeaders are the client request headers forwarded upstream
+// besides those in ForwardHeaders. X-Forwarded-For is set by the reverse
+// proxy.
+var defaultForwardHeaders = map[string]struct{}{
+	"Accept":                                 {},
+	"Accept-Encoding":                        {},
+	"Content-Encoding":                       {},
+	"Content-Type":                           {},
+	"User-Agent":                             {},
+	"X-Forwarded-For":                        {},
+	http.CanonicalHeaderKey(requestIDHeader): {},
+}
+
+// filterHeaders removes the client headers of req which are not to be
+// forwarded, and any credentials. The configured upstream headers are added
+// by forward.
+func (t *myTransport) filterHeaders(req *http.Request) {
+	for h := range req.Header {
+		if _, ok := defaultForwardHeaders[h]; ok {
+			continue
+		}
+		if _, ok := t.forwardHeaders[h]; !ok {
+			req.Header.Del(h)
+		}
+	}
+	for _, h := range credentialHeaders {
+		req.Header.Del(h)
+	}
+}
+
+// wsDialHeaders are set by the websocket dialer itself, which refuses them.
+var wsDialHeaders = map[string]struct{}{
+	"Connection":               {},
+	"Sec-Websocket-Extensions": {},
+	"Sec-Websocket-Key":        {},
+	"Sec-Websocket-Version":    {},
+	"Upgrade":                  {},
+}
+
+// wsHeaders copies the client headers of in listed in ForwardHeaders, never
+// credentials, and the configured upstream headers to out, the headers of the
+// websocket upstream handshake.
+func (t *myTransport) wsHeaders(in *http.Request, out http.Header) {
+	for h := range t.forwardHeaders {
+		if _, ok := wsDialHeaders[h]; ok {
+			continue
+		}
+		for _, v := range in.Header[h] {
+			out.Add(h, v)
+		}
+	}
+	for _, h := range credentialHeaders {
+		out.Del(h)
+	}
+	for h, v := range t.upstreamHeaders {
+		out.Set(h, v)
+	}
+}
+
+// requestIDHeader carries the request ID to the upstream and back to the
+// client.
+const requestIDHeader = "X-Request-ID"
+
+func (t *myTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	ctx, span := startSpan(req)
+	defer func() { endSpan(span, res, err) }()
 	if reqID := middleware.GetReqID(req.Context()); reqID != "" {
 		ctx = gotils.With(ctx, "requestID", reqID)
+		// Forward the ID so proxy and node logs can be correlated. The
+		// middleware already adopted one supplied by the client.
+		if req.Header.Get(requestIDHeader) == "" {
+			req.Header.Set(requestIDHeader, reqID)
+		}
+		defer func() {
+			if res == nil {
+				return
+			}
+			if res.Header == nil {
+				res.Header = make(http.Header)
+			}
+			res.Header.Set(requestIDHeader, req.Header.Get(requestIDHeader))
+		}()
+	}
+
+	if t.queryRequests && req.Method == http.MethodGet {
+		if err := queryRequest(req); err != nil {
+			gotils.L(ctx).Info().Printf("Request blocked: Invalid GET request: %v", err)
+			resp, err := jsonRPCResponse(http.StatusBadRequest, jsonRPCError(nil, jsonRPCInvalidParams, err.Error()))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+			}
+			return resp, nil
+		}
+	}
+
+	if t.requireJSON && req.Method == http.MethodPost && !isJSON(req.Header.Get("Content-Type")) {
+		gotils.L(ctx).Info().Printf("Request blocked: Unsupported Content-Type: %q", req.Header.Get("Content-Type"))
+		resp, err := jsonRPCResponse(http.StatusUnsupportedMediaType, jsonRPCError(nil, jsonRPCInvalidRequest, "Content-Type must be application/json"))
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		return resp, nil
 	}
 
 	ip, methods, parsedRequests, err := parseRequests(req)
 	if err != nil {
 		gotils.L(ctx).Error().Printf("Failed to parse requests: %v", err)
-		resp, err := jsonRPCResponse(http.StatusBadRequest, jsonRPCError(json.RawMessage("1"), jsonRPCInvalidParams, err.Error()))
+		status, errResp := http.StatusBadRequest, jsonRPCError(nil, jsonRPCInvalidParams, err.Error())
+		var invalid *invalidRequestError
+		if errors.As(err, &invalid) {
+			errResp = jsonRPCError(invalid.id, jsonRPCInvalidRequest, err.Error())
+		} else if isTimeout(err) {
+			status, errResp = http.StatusRequestTimeout, jsonRPCError(nil, jsonRPCInvalidRequest, "Timed out reading request body")
+		}
+		resp, err := jsonRPCResponse(status, errResp)
 		if err != nil {
 			gotils.L(ctx).Error().Printf("Failed to construct invalid params response: %v", err)
 		}
 		return resp, nil
 	}
 
+	if id := t.clientID(req); id != "" {
+		setClientID(parsedRequests, id)
+		ctx = gotils.With(ctx, "clientId", id)
+	}
 	ctx = gotils.With(ctx, "remoteIp", ip)
 	ctx = gotils.With(ctx, "methods", methods)
+	setMethods(span, methods)
 	errorCode, resp := t.block(ctx, parsedRequests)
 	if resp != nil {
-		resp, err := jsonRPCResponse(errorCode, resp)
+		res, err := jsonRPCResponse(errorCode, resp)
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		setRetryAfterHeader(res, resp)
+		return res, nil
+	}
+	if deprecated := t.deprecations.pending(methods, time.Now()); len(deprecated) > 0 {
+		defer func() {
+			if res != nil {
+				t.deprecations.warn(res, deprecated)
+			}
+		}()
+	}
+
+	if !t.acquire(ip) {
+		gotils.L(ctx).Info().Print("Request blocked: Too many concurrent requests")
+		resp, err := jsonRPCResponse(http.StatusTooManyRequests, jsonRPCConcurrencyLimit(parsedRequests[0].ID))
 		if err != nil {
 			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
 		}
 		return resp, nil
 	}
+	defer t.release(ip)
 
-	gotils.L(ctx).Info().Print("Forwarding request")
+	if err := t.transformRequests(req, parsedRequests); err != nil {
+		gotils.L(ctx).Info().Printf("Request blocked: Transform failed: %v", err)
+		resp, err := jsonRPCResponse(http.StatusBadRequest, jsonRPCError(parsedRequests[0].ID, jsonRPCInvalidParams, err.Error()))
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		return resp, nil
+	}
+	var origIDs map[string]json.RawMessage // nil unless ids were coerced
+	if t.idType != "" {
+		origIDs, err = coerceIDs(req, parsedRequests, t.idType)
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to coerce request ids: %v", err)
+			resp, err := jsonRPCResponse(http.StatusInternalServerError, jsonRPCError(parsedRequests[0].ID, jsonRPCInternal, "Failed to rewrite request ids"))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+			}
+			return resp, nil
+		}
+	}
+	if t.fillParams {
+		// Last, since the rewrites above drop empty params.
+		if err := fillParams(req); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to fill empty params: %v", err)
+		}
+	}
+	transformResponses := t.hasResponseTransforms(methods)
+	limitLogs := t.maxLogResults > 0 && hasLogMethod(methods)
+	if transformResponses || origIDs != nil || limitLogs {
+		req.Header.Del("Accept-Encoding") // Results must be readable.
+	}
+
+	cacheKey, cachePolicy, cacheable := t.cacheable(ctx, parsedRequests)
+	if cacheable {
+		if result, ok := t.cache.get(cacheKey); ok {
+			gotils.L(ctx).Info().Print("Serving cached response")
+			span.SetAttributes(cacheAttr.String("hit"))
+			t.cache.count(parsedRequests[0].Path, true)
+			resp, err := jsonRPCResponse(http.StatusOK, cachedResponse(parsedRequests[0].ID, result))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a cached response: %v", err)
+			}
+			return resp, nil
+		}
+	}
+	if cacheable {
+		span.SetAttributes(cacheAttr.String("miss"))
+		t.cache.count(parsedRequests[0].Path, false)
+	}
+	errorKey, errorCacheable := t.errorCacheable(parsedRequests)
+	if errorCacheable {
+		if e, ok := t.cache.get(errorKey); ok {
+			gotils.L(ctx).Info().Print("Serving cached error")
+			span.SetAttributes(cacheAttr.String("hit"))
+			resp, err := jsonRPCResponse(http.StatusOK, cachedErrorResponse(parsedRequests[0].ID, e))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a cached response: %v", err)
+			}
+			return resp, nil
+		}
+	}
+
+	upstream := t.url
+	u := t.route(parsedRequests)
+	if u == nil {
+		u = t.archiveRoute(ctx, parsedRequests)
+	}
+	if u != nil {
+		upstream = u.String()
+		req.URL.Scheme, req.URL.Host, req.URL.Path, req.URL.RawPath = u.Scheme, u.Host, u.Path, u.RawPath
+		ctx = gotils.With(ctx, "upstream", u.Host)
+	}
+	breaker := t.breakers[upstream]
+	if breaker != nil {
+		if !breaker.allow(ctx) {
+			gotils.L(ctx).Info().Print("Request blocked: Circuit breaker open")
+			resp, err := jsonRPCResponse(http.StatusServiceUnavailable, jsonRPCUpstreamUnavailable(parsedRequests[0].ID))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+			}
+			t.setRetryAfter(resp)
+			return resp, nil
+		}
+	}
+
+	// Hop-by-hop headers were already removed by the reverse proxy.
+	t.filterHeaders(req)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	req.Host = req.RemoteAddr //workaround for CloudFlare
-	return http.DefaultTransport.RoundTrip(req)
+	if !cacheable && len(parsedRequests) == 1 {
+		if resp := t.splitLogs(ctx, req, parsedRequests[0]); resp != nil {
+			gotils.L(ctx).Info().Print("Served logs query split at finality boundary")
+			if breaker != nil {
+				breaker.record(ctx, true)
+			}
+			return resp, nil
+		}
+	}
+
+	shadowed := t.shadowSampled(parsedRequests)
+	gotils.L(ctx).Info().Print("Forwarding request")
+	start := time.Now()
+	res, err = t.forwardShared(ctx, req, parsedRequests)
+	if err != nil && req.Context().Err() != nil {
+		// The client went away, and the upstream request was cancelled with
+		// it. That says nothing about the upstream, so it isn't recorded.
+		gotils.L(ctx).Info().Print("Client disconnected, upstream request cancelled")
+		return nil, err
+	}
+	failed := transientFailure(res, err) || isTimeout(err)
+	t.latency.record(time.Since(start), failed)
+	if breaker != nil {
+		breaker.record(ctx, !failed)
+	}
+	if err != nil && isTimeout(err) {
+		gotils.L(ctx).Error().Printf("Upstream request timed out after %s", t.timeout(parsedRequests))
+		resp, err := jsonRPCResponse(http.StatusGatewayTimeout, jsonRPCUpstreamTimeoutError(parsedRequests[0].ID))
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		return resp, nil
+	}
+	if err == nil {
+		if ok, start := isJSONResponse(res); !ok {
+			res.Body.Close()
+			gotils.L(ctx).Error().Printf("Upstream returned a non-JSON response, status: %d Content-Type: %q", res.StatusCode, res.Header.Get("Content-Type"))
+			gotils.L(ctx).Debug().Printf("Non-JSON upstream response: %q", start)
+			var id json.RawMessage
+			if len(parsedRequests) == 1 {
+				id = parsedRequests[0].ID
+			}
+			resp, err := jsonRPCResponse(http.StatusBadGateway, jsonRPCInvalidUpstreamResponse(id, res.StatusCode))
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+			}
+			t.setRetryAfter(resp)
+			return resp, nil
+		}
+	}
+	if err == nil && res.StatusCode == http.StatusServiceUnavailable {
+		t.setRetryAfter(res)
+	}
+	maxBytes, batchLimit := t.maxResponseBytes, false
+	if len(parsedRequests) > 1 && t.maxBatchResponseBytes > 0 && (maxBytes <= 0 || t.maxBatchResponseBytes < maxBytes) {
+		maxBytes, batchLimit = t.maxBatchResponseBytes, true
+	}
+	needsBody := cacheable || errorCacheable || transformResponses || shadowed || origIDs != nil || limitLogs
+	if err != nil || (!needsBody && maxBytes <= 0) {
+		return res, err
+	}
+	tooLarge := func() *http.Response {
+		gotils.L(ctx).Error().Printf("Upstream response exceeds limit of %d bytes", maxBytes)
+		tooLarge := jsonRPCResponseTooLarge(parsedRequests[0].ID, maxBytes)
+		if batchLimit {
+			tooLarge = jsonRPCBatchResponseTooLarge(maxBytes)
+		}
+		resp, err := jsonRPCResponse(http.StatusBadGateway, tooLarge)
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		return resp
+	}
+	if !needsBody && t.streamResponses {
+		if res.ContentLength > maxBytes {
+			res.Body.Close()
+			return tooLarge(), nil
+		}
+		// Too late for an error response once the body is being relayed, so a
+		// response found too large midway is cut off.
+		res.Body = &limitedBody{ReadCloser: res.Body, n: maxBytes}
+		return res, nil
+	}
+	body, err := readBody(res, maxBytes)
+	if errors.Is(err, errResponseTooLarge) {
+		return tooLarge(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if origIDs != nil && res.Header.Get("Content-Encoding") == "" {
+		if restored, err := restoreIDs(body, origIDs); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to restore response ids: %v", err)
+		} else {
+			body = restored
+			res.ContentLength = int64(len(body))
+			res.Header.Del("Content-Length")
+		}
+	}
+	if limitLogs && res.StatusCode == http.StatusOK && res.Header.Get("Content-Encoding") == "" {
+		if capped, ok, err := capLogs(body, parsedRequests, t.maxLogResults); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to count logs: %v", err)
+		} else if ok {
+			gotils.L(ctx).Info().Println("Request blocked: Too many logs, limit:", t.maxLogResults)
+			body = capped
+			res.ContentLength = int64(len(body))
+			res.Header.Del("Content-Length")
+		}
+	}
+	if shadowed && res.StatusCode == http.StatusOK && res.Header.Get("Content-Encoding") == "" {
+		go t.mirror(ctx, req, body)
+	}
+	if transformResponses && res.StatusCode == http.StatusOK && res.Header.Get("Content-Encoding") == "" {
+		if transformed, err := t.transformResponses(body, methods, parsedRequests); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to transform response: %v", err)
+		} else {
+			body = transformed
+			res.ContentLength = int64(len(body))
+			res.Header.Del("Content-Length")
+		}
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if cacheable && res.StatusCode == http.StatusOK && res.Header.Get("Content-Encoding") == "" {
+		if result := cacheResult(body); result != nil {
+			t.cacheSet(ctx, cacheKey, parsedRequests[0], result, cachePolicy)
+		}
+	}
+	if errorCacheable && res.StatusCode == http.StatusOK && res.Header.Get("Content-Encoding") == "" {
+		if e := cacheError(body); e != nil {
+			t.cache.set(errorKey, e, t.errorCacheTTL)
+		}
+	}
+	return res, nil
+}
+
+var errResponseTooLarge = errors.New("response too large")
+
+// readBody reads and closes the response body, returning errResponseTooLarge
+// if it is longer than max bytes. A max of 0 means no limit.
+func readBody(res *http.Response, max int64) ([]byte, error) {
+	defer res.Body.Close()
+	if max <= 0 {
+		return ioutil.ReadAll(res.Body)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, errResponseTooLarge
+	}
+	return body, nil
+}
+
+// limitedBody fails with errResponseTooLarge once more than n bytes have
+// been read, so a response can be relayed as it arrives without exceeding a
+// limit.
+type limitedBody struct {
+	io.ReadCloser
+	n int64 // Bytes left.
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.n {
+		n, b.n = int(b.n), 0
+		return n, errResponseTooLarge
+	}
+	b.n -= int64(n)
+	return n, err
+}
+
+// sniffBytes is how much of an upstream response is inspected, and logged,
+// to tell whether it is JSON.
+const sniffBytes = 512
+
+// isJSONResponse returns false if res isn't JSON, like an HTML error page from
+// a load balancer in front of the node, along with the start of its body.
+// Compressed bodies are only judged by their Content-Type. res.Body can still
+// be read in full afterwards.
+func isJSONResponse(res *http.Response) (bool, []byte) {
+	ct := res.Header.Get("Content-Type")
+	if isJSON(ct) {
+		return true, nil
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		return ct == "", nil
+	}
+	br := bufio.NewReaderSize(res.Body, sniffBytes)
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, res.Body}
+	start, err := br.Peek(sniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return true, nil // Let the read error surface to the client.
+	}
+	trimmed := bytes.TrimLeft(start, " \t\r\n")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['), start
+}
+
+// route returns the upstream configured for the methods of parsedRequests, or
+// nil for the primary upstream. Batches which mix methods routed to different
+// upstreams go to the primary upstream.
+func (t *myTransport) route(parsedRequests []ModifiedRequest) *url.URL {
+	if len(t.routes) == 0 {
+		return nil
+	}
+	var u *url.URL
+	for i, r := range parsedRequests {
+		ru := t.routes[r.Path]
+		if i > 0 && ru != u {
+			return nil
+		}
+		u = ru
+	}
+	return u
+}
+
+// archiveRoute returns the archive upstream if any of parsedRequests refers
+// to a block more than archiveDepth behind head, otherwise nil. Block tags like
+// latest and pending are always served by the primary upstream.
+func (t *myTransport) archiveRoute(ctx context.Context, parsedRequests []ModifiedRequest) *url.URL {
+	if t.archive == nil {
+		return nil
+	}
+	var latest *uint64
+	for _, r := range parsedRequests {
+		var start uint64
+		if r.Path == "eth_getLogs" {
+			br, invalid, err := t.parseRange(ctx, r)
+			if br == nil || invalid != nil || err != nil {
+				continue
+			}
+			start = br.start
+		} else {
+			i, ok := blockParamIndex[r.Path]
+			if !ok || i >= len(r.Params) {
+				continue
+			}
+			var bn rpc.BlockNumber
+			if err := json.Unmarshal(r.Params[i], &bn); err != nil || bn < 0 {
+				continue
+			}
+			start = uint64(bn)
+		}
+		if latest == nil {
+			l, err := t.latestBlock.get(ctx)
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to get latest block for archive routing: %v", err)
+				return nil
+			}
+			latest = &l
+		}
+		if start+t.archiveDepth < *latest {
+			return t.archive
+		}
+	}
+	return nil
+}
+
+// setRetryAfter sets a Retry-After header on resp of retryAfter plus up to 50%
+// random jitter, so that clients don't all retry at once.
+func (t *myTransport) setRetryAfter(resp *http.Response) {
+	if t.retryAfter <= 0 {
+		return
+	}
+	d := t.retryAfter + time.Duration(rand.Int63n(int64(t.retryAfter)/2+1))
+	secs := int64(d.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// timeout returns the upstream timeout for parsedRequests. A method's
+// methodTimeouts entry takes precedence over upstreamTimeout, and a batch gets
+// the longest timeout of its methods. 0 means none.
+func (t *myTransport) timeout(parsedRequests []ModifiedRequest) time.Duration {
+	var max time.Duration
+	for _, r := range parsedRequests {
+		d, ok := t.methodTimeouts[r.Path]
+		if !ok {
+			d = t.upstreamTimeout
+		}
+		if d <= 0 {
+			return 0
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// forward sends req to the upstream with the configured upstream headers,
+// bounded by timeout. Every request to the upstream goes through here, whether
+// it came from a client or from the proxy itself. The timeout covers reading
+// the response body, so the deadline is only released once the body is
+// closed. A timeout of 0 means none.
+func (t *myTransport) forward(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	for h, v := range t.upstreamHeaders {
+		req.Header.Set(h, v)
+	}
+	upstream := t.upstream
+	if upstream == nil {
+		upstream = http.DefaultTransport
+	}
+	if timeout <= 0 {
+		return upstream.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	res, err := upstream.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// forwardWithRetries forwards req, retrying idempotent requests up to
+// maxRetries times when the upstream fails transiently.
+func (t *myTransport) forwardWithRetries(ctx context.Context, req *http.Request, parsedRequests []ModifiedRequest) (*http.Response, error) {
+	timeout := t.timeout(parsedRequests)
+	res, err := t.forward(req, timeout)
+	if t.maxRetries <= 0 || req.GetBody == nil || !idempotent(parsedRequests) {
+		return res, err
+	}
+	backoff := t.retryBackoff
+	for i := 0; i < t.maxRetries && transientFailure(res, err); i++ {
+		if err == nil {
+			res.Body.Close()
+		}
+		gotils.L(ctx).Info().Printf("Retrying request after transient upstream failure, attempt: %d", i+1)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		res, err = t.forward(req, timeout)
+	}
+	return res, err
+}
+
+// transientFailure returns true if the upstream response or error may succeed
+// on retry.
+func transientFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return !isTimeout(err) && !errors.Is(err, context.Canceled)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isTimeout returns true if err was caused by a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// cancelBody cancels a context once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 // block returns a response only if the request should be blocked, otherwise it returns nil if allowed.
 func (t *myTransport) block(ctx context.Context, parsedRequests []ModifiedRequest) (int, interface{}) {
+	if t.maxBatchSize > 0 && len(parsedRequests) > t.maxBatchSize {
+		gotils.L(ctx).Info().Println("Request blocked: Batch too large, size:", len(parsedRequests), "limit:", t.maxBatchSize)
+		return http.StatusRequestEntityTooLarge, jsonRPCBatchLimit(len(parsedRequests), t.maxBatchSize)
+	}
+	if t.maxTagResolutions > 0 {
+		var tags int
+		for _, r := range parsedRequests {
+			tags += tagResolutions(r)
+		}
+		if tags > t.maxTagResolutions {
+			gotils.L(ctx).Info().Println("Request blocked: Too many block tags, tags:", tags, "limit:", t.maxTagResolutions)
+			return http.StatusBadRequest, jsonRPCTagLimit(tags, t.maxTagResolutions)
+		}
+	}
 	var union *blockRange
+	var quotaUsed map[string]int // client -> requests, counted once all are allowed
+	now := time.Now()
 	for _, parsedRequest := range parsedRequests {
 		ctx = gotils.With(ctx, "ip", parsedRequest.RemoteAddr)
-		if allowed, added := t.AllowVisitor(parsedRequest); !allowed {
+		key, ok := t.apiKeys[parsedRequest.APIKey]
+		if t.apiKeys != nil && parsedRequest.APIKey != "" && !ok {
+			gotils.L(ctx).Info().Print("Request blocked: Invalid API key")
+			return http.StatusUnauthorized, jsonRPCInvalidAPIKey(parsedRequest.ID)
+		}
+		// Methods are checked first, so calls which would be rejected anyway
+		// don't use up the client's limits.
+		m := t.matcher
+		if key.matcher != nil {
+			m = *key.matcher
+		}
+		if !m.MatchAnyRule(parsedRequest.Path) {
+			gotils.L(ctx).Info().Print("Request blocked: Method not allowed")
+			return http.StatusMethodNotAllowed, jsonRPCUnauthorized(parsedRequest.ID, parsedRequest.Path)
+		}
+		if key.limit != nil {
+			if !t.AllowKey(parsedRequest, *key.limit, key.limiter) {
+				gotils.L(ctx).Info().Print("Request blocked: API key rate limited")
+				return http.StatusTooManyRequests, jsonRPCLimit(parsedRequest.ID, key.limit.retryAfter())
+			}
+		} else if allowed, added := t.AllowVisitor(parsedRequest); !allowed {
 			gotils.L(ctx).Info().Print("Request blocked: Rate limited")
-			return http.StatusTooManyRequests, jsonRPCLimit(parsedRequest.ID)
+			return http.StatusTooManyRequests, jsonRPCLimit(parsedRequest.ID, t.rateLimit().retryAfter())
 		} else if added {
 			gotils.L(ctx).Info().Printf("Added new visitor, ip: %v", parsedRequest.RemoteAddr)
 		}
-
-		if !t.MatchAnyRule(parsedRequest.Path) {
-			gotils.L(ctx).Info().Print("Request blocked: Method not allowed")
-			return http.StatusMethodNotAllowed, jsonRPCUnauthorized(parsedRequest.ID, parsedRequest.Path)
+		if client := t.quotaClient(parsedRequest); t.quota != nil && client != "" {
+			if !t.quota.available(client, quotaUsed[client]+1, now) {
+				gotils.L(ctx).Info().Print("Request blocked: Daily quota exhausted")
+				return http.StatusTooManyRequests, jsonRPCQuotaExceeded(parsedRequest.ID, t.quota.limit, quotaReset(now).Sub(now))
+			}
+			if quotaUsed == nil {
+				quotaUsed = make(map[string]int)
+			}
+			quotaUsed[client]++
+		}
+		if sunset, ok := t.deprecations.removed(parsedRequest.Path, time.Now()); ok {
+			gotils.L(ctx).Info().Print("Request blocked: Method removed")
+			return http.StatusGone, jsonRPCMethodRemoved(parsedRequest.ID, parsedRequest.Path, sunset)
+		}
+		if _, ok := writeMethods[parsedRequest.Path]; ok && t.isReadOnly() {
+			gotils.L(ctx).Info().Printf("Request blocked: Read-only mode: %s", parsedRequest.Path)
+			return http.StatusServiceUnavailable, jsonRPCReadOnlyMode(parsedRequest.ID, parsedRequest.Path)
+		}
+		if _, ok := writeMethods[parsedRequest.Path]; !ok && parsedRequest.Path != "eth_syncing" && t.isSyncing() {
+			gotils.L(ctx).Info().Printf("Request blocked: Upstream syncing: %s", parsedRequest.Path)
+			return http.StatusServiceUnavailable, jsonRPCNodeSyncing(parsedRequest.ID)
+		}
+		if min := t.minParams[parsedRequest.Path]; len(parsedRequest.Params) < min {
+			gotils.L(ctx).Info().Print("Request blocked: Missing params")
+			return http.StatusBadRequest, jsonRPCMissingParams(parsedRequest.ID, parsedRequest.Path, min)
+		}
+		if err := t.validateParams(parsedRequest); err != nil {
+			gotils.L(ctx).Info().Printf("Request blocked: %v", err)
+			return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+		}
+		if (t.blockedSenders != nil || t.minGasPrice != nil) && parsedRequest.Path == "eth_sendRawTransaction" && len(parsedRequest.Params) > 0 {
+			tx, err := decodeRawTx(parsedRequest.Params[0])
+			if err != nil {
+				gotils.L(ctx).Info().Printf("Request blocked: %v", err)
+				return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+			}
+			if t.minGasPrice != nil && tx.GasPrice().Cmp(t.minGasPrice) < 0 {
+				gotils.L(ctx).Info().Printf("Request blocked: Gas price too low, price: %s", tx.GasPrice())
+				return http.StatusBadRequest, jsonRPCGasPriceLimit(parsedRequest.ID, tx.GasPrice(), t.minGasPrice)
+			}
+			if t.blockedSenders != nil {
+				from, err := recoverSender(tx)
+				if err != nil {
+					gotils.L(ctx).Info().Printf("Request blocked: %v", err)
+					return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+				}
+				if t.blockedSenders.contains(from) {
+					gotils.L(ctx).Info().Printf("Request blocked: Blocked sender, from: %s", from.Hex())
+					return http.StatusForbidden, jsonRPCSenderBlocked(parsedRequest.ID)
+				}
+			}
 		}
-		if t.blockRangeLimit > 0 && parsedRequest.Path == "eth_getLogs" {
+		if !t.allowSendTransaction && parsedRequest.Path == "eth_sendTransaction" {
+			gotils.L(ctx).Info().Print("Request blocked: eth_sendTransaction")
+			return http.StatusMethodNotAllowed, jsonRPCSendTransaction(parsedRequest.ID)
+		}
+		if parsedRequest.Path == "eth_getLogs" && len(parsedRequest.Params) > 0 {
+			if err := checkTopics(parsedRequest.Params[0], t.maxTopicAlternatives); err != nil {
+				gotils.L(ctx).Info().Printf("Request blocked: Invalid topics: %v", err)
+				return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+			}
+			if err := checkAddresses(parsedRequest.Params[0], t.maxLogAddresses); err != nil {
+				gotils.L(ctx).Info().Printf("Request blocked: Invalid addresses: %v", err)
+				return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+			}
+		}
+		if parsedRequest.Path == "eth_subscribe" && len(parsedRequest.Params) > 0 {
+			var kind string
+			if err := json.Unmarshal(parsedRequest.Params[0], &kind); err != nil {
+				gotils.L(ctx).Info().Printf("Request blocked: Invalid subscription: %v", err)
+				return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, "invalid subscription type")
+			}
+			if !t.subscriptions.allowed(kind) {
+				gotils.L(ctx).Info().Printf("Request blocked: Subscription not allowed, type: %s", kind)
+				return http.StatusMethodNotAllowed, jsonRPCSubscriptionNotAllowed(parsedRequest.ID, kind)
+			}
+			if kind == "logs" && len(parsedRequest.Params) > 1 {
+				if err := checkTopics(parsedRequest.Params[1], t.maxTopicAlternatives); err != nil {
+					gotils.L(ctx).Info().Printf("Request blocked: Invalid topics: %v", err)
+					return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+				}
+				if err := checkAddresses(parsedRequest.Params[1], t.maxLogAddresses); err != nil {
+					gotils.L(ctx).Info().Printf("Request blocked: Invalid addresses: %v", err)
+					return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, err.Error())
+				}
+			}
+		}
+		if _, ok := rangeLimitedMethods[parsedRequest.Path]; ok && t.blockRangeLimit > 0 {
 			r, invalid, err := t.parseRange(ctx, parsedRequest)
 			if err != nil {
 				return http.StatusInternalServerError, jsonRPCError(parsedRequest.ID, jsonRPCInternal, err.Error())
@@ -238,7 +1254,7 @@ func (t *myTransport) block(ctx context.Context, parsedRequests []ModifiedReques
 			if r != nil {
 				if l := r.len(); l > t.blockRangeLimit {
 					gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", t.blockRangeLimit)
-					return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, t.blockRangeLimit)
+					return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, *r, t.blockRangeLimit)
 				}
 				if union == nil {
 					union = r
@@ -246,15 +1262,29 @@ func (t *myTransport) block(ctx context.Context, parsedRequests []ModifiedReques
 					union.extend(r)
 					if l := union.len(); l > t.blockRangeLimit {
 						gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", t.blockRangeLimit)
-						return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, t.blockRangeLimit)
+						return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, *union, t.blockRangeLimit)
 					}
 				}
 			}
 		}
 	}
+	// Only requests which passed every check count against the quota, and
+	// concurrent ones may have used it up since.
+	if quotaUsed != nil && !t.quota.take(quotaUsed, now) {
+		gotils.L(ctx).Info().Print("Request blocked: Daily quota exhausted")
+		return http.StatusTooManyRequests, jsonRPCQuotaExceeded(parsedRequests[0].ID, t.quota.limit, quotaReset(now).Sub(now))
+	}
 	return 0, nil
 }
 
+// rangeLimitedMethods take a log filter whose block range is limited by
+// blockRangeLimit. Filters are checked when created, since eth_getFilterLogs
+// only refers to them by id.
+var rangeLimitedMethods = map[string]struct{}{
+	"eth_getLogs":   {},
+	"eth_newFilter": {},
+}
+
 type blockRange struct{ start, end uint64 }
 
 func (b blockRange) len() uint64 {
@@ -323,9 +1353,45 @@ func (t *myTransport) parseRange(ctx context.Context, request ModifiedRequest) (
 	return &blockRange{start: start, end: end}, nil, nil
 }
 
+// maxTopics is the number of topic positions in a log filter.
+const maxTopics = 4
+
+// checkTopics returns an error if the topics of the filter query are
+// malformed, have more than maxTopics positions, or if any position has more
+// than maxAlternatives OR-alternatives. A maxAlternatives of 0 means none.
+func checkTopics(filter json.RawMessage, maxAlternatives int) error {
+	var fq struct {
+		Topics []json.RawMessage `json:"topics"`
+	}
+	if err := json.Unmarshal(filter, &fq); err != nil {
+		return err
+	}
+	if len(fq.Topics) > maxTopics {
+		return fmt.Errorf("too many topic positions (%d), limit is %d", len(fq.Topics), maxTopics)
+	}
+	for i, topic := range fq.Topics {
+		if len(topic) == 0 || topic[0] != '[' {
+			continue // Single topic or null wildcard.
+		}
+		var alts []*string
+		if err := json.Unmarshal(topic, &alts); err != nil {
+			return fmt.Errorf("invalid topic at position %d: %v", i, err)
+		}
+		if maxAlternatives > 0 && len(alts) > maxAlternatives {
+			return fmt.Errorf("too many alternatives (%d) for topic at position %d, limit is %d", len(alts), i, maxAlternatives)
+		}
+	}
+	return nil
+}
+
 type latestBlock struct {
-	url    string
-	client *goclient.Client
+	url       string
+	headers   map[string]string // set on every request, like upstreamHeaders
+	client    *goclient.Client
+	rpcClient *rpc.Client
+
+	reorgs  *reorgDetector    // nil means reorgs aren't detected
+	onReorg func(from uint64) // called with the lowest reorged height
 
 	mu sync.RWMutex // Protects everything below.
 
@@ -364,6 +1430,35 @@ func (l *latestBlock) get(ctx context.Context) (uint64, error) {
 
 }
 
+// updateHead fetches the latest block header and checks it for reorgs,
+// returning its number.
+func (l *latestBlock) updateHead(ctx context.Context) (uint64, error) {
+	head, err := l.header(ctx, "latest")
+	if err != nil {
+		return 0, err
+	}
+	from, reorged, err := l.reorgs.observe(head, func(n uint64) (blockHeader, error) {
+		return l.header(ctx, hexutil.EncodeUint64(n))
+	})
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to check for reorg: %v", err)
+	} else if reorged {
+		gotils.L(ctx).Info().Printf("Reorg detected, from block: %d head: %d", from, uint64(head.Number))
+		if l.onReorg != nil {
+			l.onReorg(from)
+		}
+	}
+	return uint64(head.Number), nil
+}
+
+// expire forgets the last result, so that the next get fetches the latest
+// block again.
+func (l *latestBlock) expire() {
+	l.mu.Lock()
+	l.at = nil
+	l.mu.Unlock()
+}
+
 // update updates (num, err, at). Only one instance may run at a time, and it
 // spot is reserved by setting next, which is closed when the operation completes.
 // Returns a chan to wait on if another instance is already running. Otherwise
@@ -382,9 +1477,17 @@ func (l *latestBlock) update() (chan struct{}, uint64, error) {
 	var latest uint64
 	var err error
 	if l.client == nil {
-		l.client, err = goclient.Dial(l.url)
+		l.rpcClient, err = rpc.Dial(rpcDialURL(l.url))
+		if err == nil {
+			for h, v := range l.headers {
+				l.rpcClient.SetHeader(h, v)
+			}
+			l.client = goclient.NewClient(l.rpcClient)
+		}
 	}
-	if err == nil {
+	if err == nil && l.reorgs != nil {
+		latest, err = l.updateHead(context.Background())
+	} else if err == nil {
 		var lBig *big.Int
 		lBig, err = l.client.LatestBlockNumber(context.Background())
 		if err == nil {
@@ -0,0 +1,1212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+func newTestTransport(t *testing.T, allow ...string) *myTransport {
+	t.Helper()
+	defaultLimit := requestLimit
+	t.Cleanup(func() { requestLimit = defaultLimit })
+	requestLimit = 1000
+	m, err := newMatcher(allow)
+	if err != nil {
+		t.Fatalf("failed to create matcher: %v", err)
+	}
+	tr := &myTransport{matcher: m}
+	tr.visitors = make(map[string]*rate.Limiter)
+	tr.noLimitIPs = make(map[string]struct{})
+	tr.inFlight = make(map[string]int)
+	tr.validators = newParamValidators()
+	return tr
+}
+
+// newTestUpstream starts an upstream server running handler, which is closed
+// when the test ends.
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// newTestRequest returns a POST of body to url as a client request arrives,
+// ready for RoundTrip.
+func newTestRequest(url, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.RequestURI = ""
+	return req
+}
+
+// testRoundTrip sends body to url through tr, failing the test on error.
+func testRoundTrip(t *testing.T, tr *myTransport, url, body string) *http.Response {
+	t.Helper()
+	resp, err := tr.RoundTrip(newTestRequest(url, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestBlock_sendTransaction(t *testing.T) {
+	tr := newTestTransport(t, "eth_sendTransaction")
+	reqs := []ModifiedRequest{{Path: "eth_sendTransaction", RemoteAddr: "1.2.3.4"}}
+	if code, resp := tr.block(context.Background(), reqs); resp == nil || code != http.StatusMethodNotAllowed {
+		t.Errorf("expected eth_sendTransaction to be blocked, got: %d %v", code, resp)
+	}
+	tr.allowSendTransaction = true
+	if code, resp := tr.block(context.Background(), reqs); resp != nil {
+		t.Errorf("expected eth_sendTransaction to be allowed, got: %d %v", code, resp)
+	}
+}
+
+func TestRoundTrip_upstreamTimeout(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.upstreamTimeout = 50 * time.Millisecond
+	resp := testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}`)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+	var errResp ErrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code != jsonRPCUpstreamTimeout {
+		t.Errorf("expected upstream timeout error, got: %+v %v", errResp, err)
+	}
+}
+
+// timeoutReader fails like a client body read past its deadline.
+type timeoutReader struct{}
+
+func (timeoutReader) Read([]byte) (int, error) { return 0, os.ErrDeadlineExceeded }
+
+func TestRoundTrip_clientBodyTimeout(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", timeoutReader{})
+	req.RequestURI = ""
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("expected status %d, got %d", http.StatusRequestTimeout, resp.StatusCode)
+	}
+	var errResp ErrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code != jsonRPCInvalidRequest {
+		t.Errorf("expected invalid request error, got: %+v %v", errResp, err)
+	}
+}
+
+func TestRoundTrip_methodTimeouts(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId", "debug_traceTransaction")
+	tr.upstreamTimeout = 50 * time.Millisecond
+	tr.methodTimeouts = map[string]time.Duration{"debug_traceTransaction": time.Second}
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, http.StatusGatewayTimeout},
+		{`{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction","params":["0x01"]}`, http.StatusOK},
+		{`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"debug_traceTransaction","params":["0x01"]}]`, http.StatusOK},
+	} {
+		resp := testRoundTrip(t, tr, upstream.URL, test.body)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.body, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tr := newTestTransport(t)
+	tr.upstreamTimeout = 30 * time.Second
+	tr.methodTimeouts = map[string]time.Duration{"debug_traceTransaction": 2 * time.Minute, "eth_blockNumber": time.Second}
+	for _, test := range []struct {
+		methods []string
+		exp     time.Duration
+	}{
+		{[]string{"eth_call"}, 30 * time.Second},
+		{[]string{"eth_blockNumber"}, time.Second},
+		{[]string{"debug_traceTransaction"}, 2 * time.Minute},
+		{[]string{"eth_blockNumber", "eth_call"}, 30 * time.Second},
+		{[]string{"eth_call", "debug_traceTransaction"}, 2 * time.Minute},
+	} {
+		var reqs []ModifiedRequest
+		for _, m := range test.methods {
+			reqs = append(reqs, ModifiedRequest{Path: m})
+		}
+		if got := tr.timeout(reqs); got != test.exp {
+			t.Errorf("%v: expected %s, got %s", test.methods, test.exp, got)
+		}
+	}
+}
+
+func TestRoundTrip_retries(t *testing.T) {
+	var calls int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	tr := newTestTransport(t, "eth_call", "eth_sendRawTransaction")
+	tr.maxRetries = 2
+	tr.retryBackoff = time.Millisecond
+	for _, test := range []struct {
+		method string
+		status int
+		calls  int32
+	}{
+		{"eth_call", http.StatusOK, 2},
+		{"eth_sendRawTransaction", http.StatusBadGateway, 1},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		body := `{"jsonrpc":"2.0","id":1,"method":"` + test.method + `"}`
+		resp := testRoundTrip(t, tr, upstream.URL, body)
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.method, test.status, resp.StatusCode)
+		}
+		if test.status == http.StatusOK && string(got) != body {
+			t.Errorf("%s: expected replayed body %s, got %s", test.method, body, got)
+		}
+		if c := atomic.LoadInt32(&calls); c != test.calls {
+			t.Errorf("%s: expected %d upstream calls, got %d", test.method, test.calls, c)
+		}
+	}
+}
+
+func TestCheckTopics(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		max    int
+		valid  bool
+	}{
+		{`{}`, 2, true},
+		{`{"topics":["0x01",null,["0x02","0x03"]]}`, 2, true},
+		{`{"topics":[["0x01","0x02","0x03"]]}`, 2, false},
+		{`{"topics":[["0x01","0x02","0x03"]]}`, 0, true},
+		{`{"topics":["0x01","0x02","0x03","0x04","0x05"]}`, 0, false},
+		{`{"topics":[[1]]}`, 0, false},
+	} {
+		err := checkTopics(json.RawMessage(test.filter), test.max)
+		if test.valid && err != nil {
+			t.Errorf("%s (max %d): unexpected error: %v", test.filter, test.max, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s (max %d): expected error", test.filter, test.max)
+		}
+	}
+}
+
+func TestResponseID(t *testing.T) {
+	for _, test := range []struct {
+		id, exp string
+	}{
+		{`1`, `1`},
+		{`"1"`, `"1"`},
+		{`1.0`, `1.0`},
+		{`1e3`, `1e3`},
+		{`"abc"`, `"abc"`},
+		{``, `null`},
+		{`null`, `null`},
+	} {
+		body := `{"jsonrpc":"2.0","method":"eth_chainId"}`
+		if test.id != "" {
+			body = `{"jsonrpc":"2.0","id":` + test.id + `,"method":"eth_chainId"}`
+		}
+		_, reqs, err := parseMessage([]byte(body), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, v := range map[string]interface{}{
+			"error":  jsonRPCError(reqs[0].ID, jsonRPCInternal, "test"),
+			"cached": cachedResponse(reqs[0].ID, json.RawMessage(`"0x1"`)),
+		} {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp struct {
+				ID json.RawMessage `json:"id"`
+			}
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if string(resp.ID) != test.exp {
+				t.Errorf("%s response for id %q: expected %s, got %s", name, test.id, test.exp, resp.ID)
+			}
+		}
+	}
+}
+
+func TestRoundTrip_maxResponseBytes(t *testing.T) {
+	const result = `{"jsonrpc":"2.0","id":1,"result":"0x0123456789"}`
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(result))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	for _, test := range []struct {
+		max    int64
+		status int
+	}{
+		{int64(len(result)), http.StatusOK},
+		{int64(len(result)) - 1, http.StatusBadGateway},
+	} {
+		tr.maxResponseBytes = test.max
+		resp := testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != test.status {
+			t.Errorf("max %d: expected status %d, got %d", test.max, test.status, resp.StatusCode)
+		}
+		if test.status == http.StatusOK && string(body) != result {
+			t.Errorf("max %d: expected body %s, got %s", test.max, result, body)
+		}
+		var errResp ErrResponse
+		if test.status != http.StatusOK && (json.Unmarshal(body, &errResp) != nil || errResp.Error.Code != jsonRPCResponseLimit) {
+			t.Errorf("max %d: expected response limit error, got %s", test.max, body)
+		}
+	}
+}
+
+func TestRoundTrip_streamResponses(t *testing.T) {
+	const first, rest = `{"jsonrpc":"2.0","id":1,"result":[`, `"0x01","0x02"]}`
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("length") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(first+rest)))
+			w.Write([]byte(first + rest))
+			return
+		}
+		w.Write([]byte(first))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(rest))
+	})
+
+	tr := newTestTransport(t, "eth_getLogs")
+	tr.streamResponses = true
+	roundTrip := func(query string) *http.Response {
+		t.Helper()
+		resp := testRoundTrip(t, tr, upstream.URL+query, `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{}]}`)
+		return resp
+	}
+
+	// Relayed as it arrives, within the limit.
+	tr.maxResponseBytes = int64(len(first + rest))
+	resp := roundTrip("")
+	buf := make([]byte, len(first))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != first {
+		t.Fatalf("expected %s before the upstream finished, got %s %v", first, buf, err)
+	}
+	release <- struct{}{}
+	if b, err := ioutil.ReadAll(resp.Body); err != nil || string(b) != rest {
+		t.Errorf("expected %s, got %s %v", rest, b, err)
+	}
+	resp.Body.Close()
+
+	// Cut off once the limit is exceeded midway.
+	tr.maxResponseBytes = int64(len(first)) + 1
+	resp = roundTrip("")
+	go func() { release <- struct{}{} }()
+	b, err := ioutil.ReadAll(resp.Body)
+	if !errors.Is(err, errResponseTooLarge) || int64(len(b)) != tr.maxResponseBytes {
+		t.Errorf("expected %d bytes then a too large error, got %d %v", tr.maxResponseBytes, len(b), err)
+	}
+	resp.Body.Close()
+
+	// Rejected up front when the length is known.
+	resp = roundTrip("?length=1")
+	defer resp.Body.Close()
+	var errResp ErrResponse
+	if resp.StatusCode != http.StatusBadGateway || json.NewDecoder(resp.Body).Decode(&errResp) != nil || errResp.Error.Code != jsonRPCResponseLimit {
+		t.Errorf("expected response limit error, got %d %+v", resp.StatusCode, errResp)
+	}
+}
+
+func TestRoundTrip_maxBatchResponseBytes(t *testing.T) {
+	const result = `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":"0x1"}]`
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(result))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.maxResponseBytes = 1000
+	tr.maxBatchResponseBytes = int64(len(result)) - 1
+	resp := testRoundTrip(t, tr, upstream.URL, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+	var errResp ErrResponse
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error.Code != jsonRPCResponseLimit || !strings.Contains(errResp.Error.Message, "smaller batches") {
+		t.Errorf("expected batch response limit error, got %s", body)
+	}
+
+	// Single requests are only subject to maxResponseBytes.
+	resp = testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d for single request, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	archive, _ := url.Parse("http://archive:8545")
+	tr := newTestTransport(t)
+	tr.routes = map[string]*url.URL{"trace_block": archive, "debug_traceTransaction": archive}
+	for _, test := range []struct {
+		methods []string
+		exp     *url.URL
+	}{
+		{[]string{"eth_call"}, nil},
+		{[]string{"trace_block"}, archive},
+		{[]string{"trace_block", "debug_traceTransaction"}, archive},
+		{[]string{"trace_block", "eth_call"}, nil},
+		{[]string{"eth_call", "trace_block"}, nil},
+	} {
+		var reqs []ModifiedRequest
+		for _, m := range test.methods {
+			reqs = append(reqs, ModifiedRequest{Path: m})
+		}
+		if got := tr.route(reqs); got != test.exp {
+			t.Errorf("%v: expected %v, got %v", test.methods, test.exp, got)
+		}
+	}
+}
+
+func TestArchiveRoute(t *testing.T) {
+	archive, _ := url.Parse("http://archive:8545")
+	tr := newTestTransport(t)
+	tr.archive, tr.archiveDepth = archive, 100
+	now := time.Now()
+	tr.latestBlock.num, tr.latestBlock.at = 1000, &now
+	for _, test := range []struct {
+		method, params string
+		exp            *url.URL
+	}{
+		{"eth_getBalance", `["0x01","latest"]`, nil},
+		{"eth_getBalance", `["0x01","pending"]`, nil},
+		{"eth_getBalance", `["0x01"]`, nil},
+		{"eth_getBalance", `["0x01","0x3e8"]`, nil},
+		{"eth_getBalance", `["0x01","0x384"]`, nil},
+		{"eth_getBalance", `["0x01","0x383"]`, archive},
+		{"eth_getBalance", `["0x01","earliest"]`, archive},
+		{"eth_call", `[{},"0x10"]`, archive},
+		{"eth_getStorageAt", `["0x01","0x0","0x10"]`, archive},
+		{"eth_getLogs", `[{"fromBlock":"0x10"}]`, archive},
+		{"eth_getLogs", `[{"fromBlock":"latest"}]`, nil},
+		{"eth_chainId", `[]`, nil},
+	} {
+		var params []json.RawMessage
+		if err := json.Unmarshal([]byte(test.params), &params); err != nil {
+			t.Fatal(err)
+		}
+		reqs := []ModifiedRequest{{Path: test.method, Params: params}}
+		if got := tr.archiveRoute(context.Background(), reqs); got != test.exp {
+			t.Errorf("%s %s: expected %v, got %v", test.method, test.params, test.exp, got)
+		}
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	tr := newTestTransport(t)
+	tr.retryAfter = 4 * time.Second
+	for i := 0; i < 20; i++ {
+		resp := &http.Response{}
+		tr.setRetryAfter(resp)
+		secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secs < 4 || secs > 6 {
+			t.Errorf("expected Retry-After between 4 and 6 seconds, got %d", secs)
+		}
+	}
+}
+
+func TestRoundTrip_dedup(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":"0x10"}`))
+	})
+
+	tr := newTestTransport(t, "eth_blockNumber")
+	tr.inflight = new(singleflight.Group)
+	const n = 5
+	errs := make(chan error, n)
+	for i := 1; i <= n; i++ {
+		go func(id int) {
+			body := `{"jsonrpc":"2.0","id":` + strconv.Itoa(id) + `,"method":"eth_blockNumber"}`
+			req := newTestRequest(upstream.URL, body)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			var got struct {
+				ID     int    `json:"id"`
+				Result string `json:"result"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				errs <- err
+				return
+			}
+			if got.ID != id || got.Result != "0x10" {
+				errs <- fmt.Errorf("request %d: unexpected response %+v", id, got)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // Let the others join.
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("expected 1 upstream call, got %d", c)
+	}
+}
+
+func TestBlock_errorCodes(t *testing.T) {
+	tr := newTestTransport(t, "eth_getLogs", "eth_chainId")
+	tr.blockRangeLimit = 10
+	tr.maxBatchSize = 2
+	for _, test := range []struct {
+		name     string
+		requests []ModifiedRequest
+		status   int
+		code     int
+	}{
+		{"method not allowed", []ModifiedRequest{{Path: "eth_sign", RemoteAddr: "1.2.3.4"}}, http.StatusMethodNotAllowed, jsonRPCMethodNotAllowed},
+		{"block range too wide", []ModifiedRequest{{Path: "eth_getLogs", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"0x1","toBlock":"0x100"}`)}}}, http.StatusBadRequest, jsonRPCBlockRangeWide},
+		{"batch too large", []ModifiedRequest{{Path: "eth_chainId", RemoteAddr: "1.2.3.4"}, {Path: "eth_chainId", RemoteAddr: "1.2.3.4"}, {Path: "eth_chainId", RemoteAddr: "1.2.3.4"}}, http.StatusRequestEntityTooLarge, jsonRPCBatchTooLarge},
+	} {
+		status, resp := tr.block(context.Background(), test.requests)
+		errResp, ok := resp.(ErrResponse)
+		if !ok || status != test.status || errResp.Error.Code != test.code {
+			t.Errorf("%s: expected status %d and code %d, got %d %v", test.name, test.status, test.code, status, resp)
+		}
+	}
+	if status, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_chainId", RemoteAddr: "1.2.3.4"}, {Path: "eth_chainId", RemoteAddr: "1.2.3.4"}}); resp != nil {
+		t.Errorf("unexpected block: %d %v", status, resp)
+	}
+}
+
+func TestBlock_minParams(t *testing.T) {
+	tr := newTestTransport(t, "eth_*")
+	var err error
+	tr.minParams, err = minParams(map[string]int{"eth_getLogs": 0, "eth_custom": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method string
+		params []json.RawMessage
+		ok     bool
+	}{
+		{"eth_getBalance", nil, false},
+		{"eth_getBalance", []json.RawMessage{json.RawMessage(`"0x0000000000000000000000000000000000000001"`)}, true},
+		{"eth_getStorageAt", []json.RawMessage{json.RawMessage(`"0x0000000000000000000000000000000000000001"`)}, false},
+		{"eth_getBlockByNumber", []json.RawMessage{json.RawMessage(`"latest"`), json.RawMessage(`false`)}, true},
+		{"eth_call", nil, false},
+		{"eth_getLogs", nil, true},
+		{"eth_custom", []json.RawMessage{json.RawMessage(`1`), json.RawMessage(`2`)}, false},
+		{"eth_blockNumber", nil, true},
+	} {
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: test.method, RemoteAddr: "1.2.3.4", Params: test.params}})
+		if test.ok && resp != nil {
+			t.Errorf("%s with %d params: unexpected block: %v", test.method, len(test.params), resp)
+		} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+			t.Errorf("%s with %d params: expected invalid params, got: %d %v", test.method, len(test.params), code, resp)
+		}
+	}
+	if _, err := minParams(map[string]int{"eth_call": -1}); err == nil {
+		t.Error("expected error for negative minimum")
+	}
+}
+
+func TestBlock_validateParams(t *testing.T) {
+	const (
+		addr = `"0x0000000000000000000000000000000000000001"`
+		hash = `"0x0000000000000000000000000000000000000000000000000000000000000001"`
+		bad  = `"0x01"`
+	)
+	type paramTest struct {
+		params []string
+		ok     bool
+	}
+	accountTests := []paramTest{
+		{[]string{addr}, true},
+		{[]string{addr, `"latest"`}, true},
+		{[]string{addr, `"0x10"`}, true},
+		{[]string{addr, `"safe"`}, true},
+		{[]string{addr, `"finalized"`}, true},
+		{[]string{addr, `{"blockNumber":"0x10"}`}, true},
+		{[]string{addr, `{"blockNumber":"finalized"}`}, true},
+		{[]string{addr, `{"blockHash":` + hash + `}`}, true},
+		{[]string{addr, `{"blockHash":` + hash + `,"requireCanonical":true}`}, true},
+		{[]string{bad, `"latest"`}, false},
+		{[]string{`1`, `"latest"`}, false},
+		{[]string{addr, `"newest"`}, false},
+		{[]string{addr, `""`}, false},
+		{[]string{addr, `16`}, false},
+		{[]string{addr, `{}`}, false},
+		{[]string{addr, `{"blockNumber":"newest"}`}, false},
+		{[]string{addr, `{"blockHash":"0x01"}`}, false},
+		{[]string{addr, `{"blockHash":` + hash + `,"blockNumber":"0x10"}`}, false},
+	}
+	for method, tests := range map[string][]paramTest{
+		"eth_getBalance":          accountTests,
+		"eth_getCode":             accountTests,
+		"eth_getTransactionCount": accountTests,
+		"eth_getStorageAt": {
+			{[]string{addr, `"0x0"`}, true},
+			{[]string{addr, `"0x0000000000000000000000000000000000000000000000000000000000000001"`, `"pending"`}, true},
+			{[]string{bad, `"0x0"`, `"latest"`}, false},
+			{[]string{addr, `"slot"`, `"latest"`}, false},
+			{[]string{addr, `"0x0"`, `"newest"`}, false},
+			{[]string{addr, `"0x0"`, `{"blockHash":` + hash + `}`}, true},
+			{[]string{addr, `"0x0"`, `{"blockHash":null}`}, false},
+		},
+	} {
+		t.Run(method, func(t *testing.T) {
+			tr := newTestTransport(t, method)
+			for _, test := range tests {
+				var params []json.RawMessage
+				for _, p := range test.params {
+					params = append(params, json.RawMessage(p))
+				}
+				code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: method, RemoteAddr: "1.2.3.4", Params: params}})
+				if test.ok && resp != nil {
+					t.Errorf("%v: unexpected block: %v", test.params, resp)
+				} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+					t.Errorf("%v: expected invalid params, got: %d %v", test.params, code, resp)
+				}
+			}
+		})
+	}
+}
+
+func TestBlock_callObject(t *testing.T) {
+	const addr = `"0x0000000000000000000000000000000000000001"`
+	for _, method := range []string{"eth_call", "eth_estimateGas", "eth_createAccessList"} {
+		t.Run(method, func(t *testing.T) {
+			tr := newTestTransport(t, method)
+			for _, test := range []struct {
+				params []string
+				ok     bool
+			}{
+				{[]string{`{"to":` + addr + `,"data":"0x70a08231"}`}, true},
+				{[]string{`{"from":` + addr + `,"to":` + addr + `,"input":"0x"}`, `"latest"`}, true},
+				{[]string{`{"to":null,"data":"0x6080"}`, `"0x10"`}, true},
+				{[]string{`{"to":"0x01"}`}, false},
+				{[]string{`{"from":1}`}, false},
+				{[]string{`{"to":` + addr + `,"data":"0xabc"}`}, false},
+				{[]string{`{"to":` + addr + `,"data":"abcd"}`}, false},
+				{[]string{`"0x01"`}, false},
+				{[]string{`{"to":` + addr + `}`, `"newest"`}, false},
+			} {
+				var params []json.RawMessage
+				for _, p := range test.params {
+					params = append(params, json.RawMessage(p))
+				}
+				code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: method, RemoteAddr: "1.2.3.4", Params: params}})
+				if test.ok && resp != nil {
+					t.Errorf("%v: unexpected block: %v", test.params, resp)
+				} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+					t.Errorf("%v: expected invalid params, got: %d %v", test.params, code, resp)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterValidator(t *testing.T) {
+	tr := newTestTransport(t, "eth_*")
+	errCustom := errors.New("second param must be true")
+	tr.registerValidator("eth_custom", positionalParams(hexHash))
+	tr.registerValidator("eth_custom", func(params []json.RawMessage) error {
+		if len(params) > 1 && string(params[1]) != "true" {
+			return errCustom
+		}
+		return nil
+	})
+	const hash = `"0x0000000000000000000000000000000000000000000000000000000000000001"`
+	for _, test := range []struct {
+		params []string
+		ok     bool
+	}{
+		{[]string{hash, `true`}, true},
+		{[]string{`"0x01"`, `true`}, false},
+		{[]string{hash, `false`}, false},
+	} {
+		var params []json.RawMessage
+		for _, p := range test.params {
+			params = append(params, json.RawMessage(p))
+		}
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_custom", RemoteAddr: "1.2.3.4", Params: params}})
+		if test.ok && resp != nil {
+			t.Errorf("%v: unexpected block: %v", test.params, resp)
+		} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+			t.Errorf("%v: expected invalid params, got: %d %v", test.params, code, resp)
+		}
+	}
+	if _, ok := defaultParamValidators["eth_custom"]; ok {
+		t.Error("registering modified the default validators")
+	}
+}
+
+func TestBlock_maxCallGas(t *testing.T) {
+	tr := newTestTransport(t, "eth_*")
+	for _, m := range callMethods {
+		tr.registerValidator(m, maxCallGas(1000000))
+	}
+	const to = `"to":"0x0000000000000000000000000000000000000001"`
+	for _, test := range []struct {
+		method string
+		call   string
+		ok     bool
+	}{
+		{"eth_call", `{` + to + `}`, true},
+		{"eth_call", `{` + to + `,"gas":null}`, true},
+		{"eth_call", `{` + to + `,"gas":"0xf4240"}`, true},
+		{"eth_call", `{` + to + `,"gas":"0xf4241"}`, false},
+		{"eth_estimateGas", `{` + to + `,"gas":"0xffffffffffff"}`, false},
+		{"eth_createAccessList", `{` + to + `,"gas":"0xffffffffffff"}`, false},
+		{"eth_call", `{` + to + `,"gas":"1000"}`, false},
+	} {
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: test.method, RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(test.call), json.RawMessage(`"latest"`)}}})
+		if test.ok && resp != nil {
+			t.Errorf("%s %s: unexpected block: %v", test.method, test.call, resp)
+		} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+			t.Errorf("%s %s: expected invalid params, got: %d %v", test.method, test.call, code, resp)
+		}
+	}
+}
+
+func TestBlock_maxCallData(t *testing.T) {
+	tr := newTestTransport(t, "eth_*")
+	for _, m := range callMethods {
+		tr.registerValidator(m, maxCallData(4))
+	}
+	const to = `"to":"0x0000000000000000000000000000000000000001"`
+	for _, test := range []struct {
+		method string
+		call   string
+		block  string
+		ok     bool
+	}{
+		{"eth_call", `{` + to + `}`, `"latest"`, true},
+		{"eth_call", `{` + to + `,"data":"0x70a08231"}`, `"latest"`, true},
+		{"eth_call", `{` + to + `,"data":"0x70a0823100"}`, `"latest"`, false},
+		{"eth_estimateGas", `{` + to + `,"input":"0x70a0823100"}`, `"latest"`, false},
+		{"eth_createAccessList", `{` + to + `,"data":"0x70a0823100"}`, `"latest"`, false},
+		{"eth_createAccessList", `{` + to + `,"data":"0x70a08231"}`, `{"blockNumber":"0x10"}`, true},
+		{"eth_createAccessList", `{` + to + `}`, `{"blockHash":"0x0000000000000000000000000000000000000000000000000000000000000001"}`, true},
+		{"eth_call", `{` + to + `}`, `{"blockHash":"0x01"}`, false},
+	} {
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: test.method, RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(test.call), json.RawMessage(test.block)}}})
+		if test.ok && resp != nil {
+			t.Errorf("%s %s %s: unexpected block: %v", test.method, test.call, test.block, resp)
+		} else if !test.ok && (code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCInvalidParams) {
+			t.Errorf("%s %s %s: expected invalid params, got: %d %v", test.method, test.call, test.block, code, resp)
+		}
+	}
+}
+
+func TestRoundTrip_requestID(t *testing.T) {
+	var forwarded string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(requestIDHeader)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	for _, test := range []struct {
+		name     string
+		clientID string
+	}{
+		{"generated", ""},
+		{"client", "client-id-1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var resp *http.Response
+			h := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req := httptest.NewRequest(http.MethodPost, upstream.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)).WithContext(r.Context())
+				req.Header = r.Header.Clone()
+				req.RequestURI = ""
+				var err error
+				resp, err = tr.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if test.clientID != "" {
+				r.Header.Set(requestIDHeader, test.clientID)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if forwarded == "" || (test.clientID != "" && forwarded != test.clientID) {
+				t.Errorf("unexpected forwarded request ID %q", forwarded)
+			}
+			if got := resp.Header.Get(requestIDHeader); got != forwarded {
+				t.Errorf("expected response request ID %q, got %q", forwarded, got)
+			}
+		})
+	}
+}
+
+func TestRoundTrip_credentialHeaders(t *testing.T) {
+	var forwarded http.Header
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	req := newTestRequest(upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range credentialHeaders {
+		if v := forwarded.Get(h); v != "" {
+			t.Errorf("%s forwarded: %q", h, v)
+		}
+	}
+	if forwarded.Get("Content-Type") != "application/json" {
+		t.Errorf("expected Content-Type to be forwarded, got %v", forwarded)
+	}
+}
+
+func TestRoundTrip_forwardHeaders(t *testing.T) {
+	var forwarded http.Header
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.forwardHeaders = map[string]struct{}{"X-Tenant-Id": {}}
+	tr.upstreamHeaders = map[string]string{"Authorization": "Bearer node-secret"}
+	req := newTestRequest(upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", "acme")
+	req.Header.Set("X-Internal", "leak")
+	req.Header.Set("Authorization", "Bearer client-secret")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	for h, exp := range map[string]string{
+		"Content-Type":  "application/json",
+		"X-Tenant-Id":   "acme",
+		"X-Internal":    "",
+		"Authorization": "Bearer node-secret",
+	} {
+		if got := forwarded.Get(h); got != exp {
+			t.Errorf("expected %s %q to be forwarded, got %q", h, exp, got)
+		}
+	}
+}
+
+func TestUpstreamHeaders_internalRequests(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer node-secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "eth_syncing":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":false}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+		}
+	})
+
+	tr := newTestTransport(t)
+	tr.url = upstream.URL
+	tr.upstreamHeaders = map[string]string{"Authorization": "Bearer node-secret"}
+	tr.latestBlock.headers = tr.upstreamHeaders
+	if syncing, err := tr.probeSyncing(context.Background()); err != nil || syncing {
+		t.Errorf("expected the syncing probe to authenticate, got %t %v", syncing, err)
+	}
+	if _, num, err := tr.latestBlock.update(); err != nil || num != 0x10 {
+		t.Errorf("expected the latest block client to authenticate, got %d %v", num, err)
+	}
+}
+
+func TestRoundTrip_requireJSON(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.requireJSON = true
+	for _, test := range []struct {
+		method, contentType string
+		exp                 int
+	}{
+		{http.MethodPost, "application/json", http.StatusOK},
+		{http.MethodPost, "application/json; charset=utf-8", http.StatusOK},
+		{http.MethodPost, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", http.StatusUnsupportedMediaType},
+		{http.MethodGet, "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, upstream.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+		req.RequestURI = ""
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.exp {
+			t.Errorf("%s with Content-Type %q: expected status %d but got %d", test.method, test.contentType, test.exp, res.StatusCode)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	for _, test := range []struct {
+		in, exp string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{" 1.2.3.4 ", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8:0::1]:8545", "2001:db8::1"},
+		{"[::1]:80", "::1"},
+		{"not-an-ip", "not-an-ip"},
+	} {
+		if got := normalizeIP(test.in); got != test.exp {
+			t.Errorf("normalizeIP(%q) = %q, expected %q", test.in, got, test.exp)
+		}
+	}
+}
+
+func TestIPPrefix(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		v4, v6 int
+		exp    string
+	}{
+		{"1.2.3.4", 0, 0, "1.2.3.4"},
+		{"1.2.3.4", 32, 128, "1.2.3.4"},
+		{"1.2.3.4", 24, 64, "1.2.3.0/24"},
+		{"1.2.3.4", 16, 64, "1.2.0.0/16"},
+		{"2001:db8:1:2:3::4", 24, 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:3::4", 24, 0, "2001:db8:1:2:3::4"},
+		{"not-an-ip", 24, 64, "not-an-ip"},
+	} {
+		if got := ipPrefix(test.in, test.v4, test.v6); got != test.exp {
+			t.Errorf("ipPrefix(%q, %d, %d) = %q, expected %q", test.in, test.v4, test.v6, got, test.exp)
+		}
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		exp     string
+	}{
+		{"remote", "1.2.3.4:5678", nil, "1.2.3.4"},
+		{"remote ipv6", "[2001:db8:0::1]:5678", nil, "2001:db8::1"},
+		{"cloudflare", "10.0.0.1:80", map[string]string{"CF-Connecting-IP": "2001:DB8::1"}, "2001:db8::1"},
+		{"forwarded", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"forwarded port", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "[::1]:1234"}, "::1"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if got := getIP(r); got != test.exp {
+			t.Errorf("%s: expected %q, got %q", test.name, test.exp, got)
+		}
+	}
+}
+
+func TestBlock_maxTagResolutions(t *testing.T) {
+	tr := newTestTransport(t, "eth_getBalance", "eth_getLogs", "eth_getBlockByNumber")
+	tr.maxTagResolutions = 3
+	addr := json.RawMessage(`"0x0000000000000000000000000000000000000000"`)
+	for _, test := range []struct {
+		name string
+		reqs []ModifiedRequest
+		exp  int
+	}{
+		{"numbers", []ModifiedRequest{
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"0x1"`)}},
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"0x2"`)}},
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"0x3"`)}},
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"earliest"`)}},
+			{Path: "eth_getBalance", Params: []json.RawMessage{addr, json.RawMessage(`{"blockNumber":"0x1"}`)}},
+		}, 0},
+		{"at limit", []ModifiedRequest{
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"latest"`)}},
+			{Path: "eth_getBalance", Params: []json.RawMessage{addr}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"blockHash":"0x01"}`)}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"0x1"}`)}},
+		}, 0},
+		{"over limit", []ModifiedRequest{
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"pending"`)}},
+			{Path: "eth_getBalance", Params: []json.RawMessage{addr, json.RawMessage(`"latest"`)}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"latest","toBlock":"latest"}`)}},
+		}, http.StatusBadRequest},
+		{"omitted filter bounds", []ModifiedRequest{
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{}`)}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":null,"toBlock":"0x2"}`)}},
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"0x1"`)}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"toBlock":"0x2"}`)}},
+		}, http.StatusBadRequest},
+		{"safe and finalized", []ModifiedRequest{
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"safe"`)}},
+			{Path: "eth_getBlockByNumber", Params: []json.RawMessage{json.RawMessage(`"finalized"`)}},
+			{Path: "eth_getBalance", Params: []json.RawMessage{addr, json.RawMessage(`{"blockNumber":"safe"}`)}},
+			{Path: "eth_getLogs", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"finalized","toBlock":"0x2"}`)}},
+		}, http.StatusBadRequest},
+	} {
+		for i := range test.reqs {
+			test.reqs[i].RemoteAddr = "1.2.3.4"
+		}
+		code, resp := tr.block(context.Background(), test.reqs)
+		if test.exp == 0 && resp != nil {
+			t.Errorf("%s: expected allowed, got: %d %v", test.name, code, resp)
+		} else if test.exp != 0 && code != test.exp {
+			t.Errorf("%s: expected %d, got: %d %v", test.name, test.exp, code, resp)
+		}
+	}
+}
+
+func TestRoundTrip_nonJSONUpstream(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		exp         int
+	}{
+		{"json", "application/json", http.StatusOK, `{"jsonrpc":"2.0","id":7,"result":"0x1"}`, http.StatusOK},
+		{"json without content type", "", http.StatusOK, ` {"jsonrpc":"2.0","id":7,"result":"0x1"}`, http.StatusOK},
+		{"html", "text/html", http.StatusBadGateway, "<html><body>502 Bad Gateway</body></html>", http.StatusBadGateway},
+		{"html with 200", "text/html", http.StatusOK, "<html></html>", http.StatusBadGateway},
+		{"empty", "", http.StatusOK, "", http.StatusBadGateway},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+
+			tr := newTestTransport(t, "eth_chainId")
+			res := testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"2.0","id":7,"method":"eth_chainId"}`)
+			defer res.Body.Close()
+			if res.StatusCode != test.exp {
+				t.Fatalf("expected status %d but got %d", test.exp, res.StatusCode)
+			}
+			var resp ErrResponse
+			if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+				t.Fatalf("expected a JSON response: %v", err)
+			}
+			if string(resp.ID) != "7" {
+				t.Errorf("expected id 7 but got %s", resp.ID)
+			}
+			if test.exp != http.StatusOK && resp.Error.Code != jsonRPCUpstreamDown {
+				t.Errorf("expected error code %d but got %d", jsonRPCUpstreamDown, resp.Error.Code)
+			}
+		})
+	}
+}
+
+func TestBlock_blockRangeLimit(t *testing.T) {
+	tr := newTestTransport(t, "eth_getLogs", "eth_newFilter", "eth_getFilterLogs")
+	tr.blockRangeLimit = 10
+	for _, method := range []string{"eth_getLogs", "eth_newFilter"} {
+		for _, test := range []struct {
+			name   string
+			filter string
+			status int
+		}{
+			{"within limit", `{"fromBlock":"0x1","toBlock":"0xa"}`, 0},
+			{"too wide", `{"fromBlock":"0x1","toBlock":"0x100"}`, http.StatusBadRequest},
+			{"block hash", `{"blockHash":"0x0000000000000000000000000000000000000000000000000000000000000001"}`, 0},
+			{"invalid", `{"fromBlock":"foo"}`, http.StatusBadRequest},
+		} {
+			reqs := []ModifiedRequest{{Path: method, RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(test.filter)}}}
+			status, resp := tr.block(context.Background(), reqs)
+			if status != test.status {
+				t.Errorf("%s %s: expected status %d, got %d %v", method, test.name, test.status, status, resp)
+			}
+			if test.name == "too wide" {
+				exp := blockRangeData{Limit: 10, Requested: 256, FromBlock: 0x1, ToBlock: 0x100}
+				if e, ok := resp.(ErrResponse); !ok || e.Error.Code != jsonRPCBlockRangeWide || e.Error.Data != exp {
+					t.Errorf("%s: expected block range error with the limit and requested range, got %+v", method, resp)
+				}
+			}
+		}
+	}
+	batch := []ModifiedRequest{
+		{Path: "eth_getLogs", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"0x1","toBlock":"0x5"}`)}},
+		{Path: "eth_newFilter", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(`{"fromBlock":"0x20","toBlock":"0x25"}`)}},
+	}
+	if status, resp := tr.block(context.Background(), batch); status != http.StatusBadRequest {
+		t.Errorf("expected the union of a batch's ranges to be limited, got %d %v", status, resp)
+	} else if b, _ := json.Marshal(resp); !strings.Contains(string(b), `"data":{"limit":10,"requested":37,"fromBlock":"0x1","toBlock":"0x25"}`) {
+		t.Errorf("expected the limit and union range in the error data, got %s", b)
+	}
+	filterLogs := []ModifiedRequest{{Path: "eth_getFilterLogs", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(`"0x1"`)}}}
+	if status, resp := tr.block(context.Background(), filterLogs); resp != nil {
+		t.Errorf("expected eth_getFilterLogs to be allowed, got %d %v", status, resp)
+	}
+}
+
+func TestRoundTrip_clientDisconnect(t *testing.T) {
+	received, cancelled := make(chan struct{}), make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body) // The server only notices the client going away once the body is read.
+		close(received)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.upstreamTimeout = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := newTestRequest(upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	req = req.WithContext(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+
+	<-received
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the upstream request to be cancelled with the client's")
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context cancelled error but got %v", err)
+	}
+	if n := tr.latency.summary().Samples; n != 0 {
+		t.Errorf("expected the cancelled request not to be recorded, got %d samples", n)
+	}
+}
+
+func TestRoundTrip_fillParams(t *testing.T) {
+	var got string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = string(b)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId", "eth_getBalance")
+	tr.fillParams = true
+	for _, test := range []struct {
+		name, body, exp string
+	}{
+		{"missing", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+			`{"id":1,"jsonrpc":"2.0","method":"eth_chainId","params":[]}`},
+		{"null", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":null}`,
+			`{"id":1,"jsonrpc":"2.0","method":"eth_chainId","params":[]}`},
+		{"empty", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`,
+			`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`},
+		{"multiple", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}`,
+			`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}`},
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}]`,
+			`[{"id":1,"jsonrpc":"2.0","method":"eth_chainId","params":[]},{"id":2,"jsonrpc":"2.0","method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}]`},
+	} {
+		req := newTestRequest(upstream.URL, test.body)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if got != test.exp {
+			t.Errorf("%s: expected upstream to get %s but got %s", test.name, test.exp, got)
+		}
+	}
+
+	tr.fillParams = false
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	resp := testRoundTrip(t, tr, upstream.URL, body)
+	resp.Body.Close()
+	if got != body {
+		t.Errorf("expected the request to be forwarded unchanged when disabled, got %s", got)
+	}
+}
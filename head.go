@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gochain/gochain/v3/rpc"
+	"github.com/treeder/gotils/v2"
+)
+
+// pollHead updates the latest block every interval, until ctx is done, keeps
+// a cached eth_blockNumber result warm, and calls onNewHead whenever it
+// advances. Failed polls are logged and forgotten, so requests fall back to
+// fetching the latest block on demand.
+func (t *myTransport) pollHead(ctx context.Context, interval time.Duration, onNewHead func(context.Context, uint64)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		next, num, err := t.latestBlock.update()
+		if next != nil {
+			continue // Already being updated.
+		}
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to poll latest block: %v", err)
+			t.latestBlock.expire()
+			continue
+		}
+		t.warmBlockNumber(ctx, num)
+		if num > last {
+			last = num
+			if onNewHead != nil {
+				onNewHead(ctx, num)
+			}
+		}
+	}
+}
+
+// warmBlockNumber caches num as the eth_blockNumber result, if its policy
+// caches it, so requests are served without reaching the upstream.
+func (t *myTransport) warmBlockNumber(ctx context.Context, num uint64) {
+	policy := t.cachePolicies["eth_blockNumber"]
+	if t.cache == nil || !policy.Cache {
+		return
+	}
+	request := ModifiedRequest{Path: "eth_blockNumber"}
+	key, err := cacheKey(request, policy.NormalizeParams)
+	if err != nil {
+		return
+	}
+	result, err := json.Marshal(hexutil.EncodeUint64(num))
+	if err != nil {
+		return
+	}
+	t.cacheSet(ctx, key, request, result, policy)
+}
+
+// refreshOnNewHead refreshes the cached results of methods for head num,
+// unless they were already refreshed for it or a later one, as happens when
+// both the poller and the subscription see the head.
+func (t *myTransport) refreshOnNewHead(ctx context.Context, num uint64, methods []string) {
+	for {
+		last := atomic.LoadUint64(&t.refreshedHead)
+		if num <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&t.refreshedHead, last, num) {
+			break
+		}
+	}
+	t.refreshCached(ctx, methods)
+}
+
+// refreshCached re-fetches the cached results of methods from upstream,
+// so they are fresh as soon as a new head arrives. Entries which fail to
+// refresh are left to expire.
+func (t *myTransport) refreshCached(ctx context.Context, methods []string) {
+	for _, method := range methods {
+		policy := t.cachePolicies[method]
+		upstream := t.url
+		if u := t.route([]ModifiedRequest{{Path: method}}); u != nil {
+			upstream = u.String()
+		}
+		for _, key := range t.cache.keys(method) {
+			request := ModifiedRequest{Path: method}
+			for _, p := range strings.Split(key, "\x00")[1:] {
+				request.Params = append(request.Params, json.RawMessage(p))
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream, nil)
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to refresh %s: %v", method, err)
+				break
+			}
+			req.Header.Set("Content-Type", "application/json")
+			result, err := t.call(req, method, request.Params...)
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to refresh %s: %v", method, err)
+				continue
+			}
+			t.cacheSet(ctx, key, request, result, policy)
+		}
+	}
+}
+
+// defaultNewHeadsRetry is how long to wait before resubscribing to new heads
+// after the subscription failed.
+const defaultNewHeadsRetry = 5 * time.Second
+
+// defaultNewHeadsTimeout bounds subscribing to new heads, which otherwise
+// never returns if the connection drops before the node answers.
+const defaultNewHeadsTimeout = 10 * time.Second
+
+// subscribeNewHeads subscribes to newHeads on the websocket upstream wsURL,
+// taking at most timeout, and calls onNewHead with the number of each new
+// head, until ctx is done. While the upstream is unavailable, it keeps
+// retrying every retry, and cached entries just expire after their TTL.
+func subscribeNewHeads(ctx context.Context, wsURL string, retry, timeout time.Duration, onNewHead func(context.Context, uint64)) {
+	for {
+		err := watchNewHeads(ctx, wsURL, timeout, onNewHead)
+		if ctx.Err() != nil {
+			return
+		}
+		gotils.L(ctx).Error().Printf("New heads subscription failed, retrying in %s: %v", retry, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// watchNewHeads runs a single newHeads subscription, set up within timeout,
+// until it fails or ctx is done.
+func watchNewHeads(ctx context.Context, wsURL string, timeout time.Duration, onNewHead func(context.Context, uint64)) error {
+	subCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client, err := rpc.DialWebsocket(subCtx, wsURL, "")
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	heads := make(chan blockHeader)
+	sub, err := client.EthSubscribe(subCtx, heads, "newHeads")
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	gotils.L(ctx).Info().Print("Subscribed to new heads")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case head := <-heads:
+			onNewHead(ctx, uint64(head.Number))
+		}
+	}
+}
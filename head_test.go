@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRefreshCached(t *testing.T) {
+	var head int32 = 0x10
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		n := atomic.LoadInt32(&head)
+		switch req.Method {
+		case "eth_blockNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x` + strconv.FormatInt(int64(n), 16) + `"}`))
+		case "eth_getBalance":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + string(req.Params[0]) + `}`))
+		}
+	})
+
+	tr := newTestTransport(t)
+	tr.url = upstream.URL
+	tr.cache = newResponseCache(10)
+	tr.cachePolicies = map[string]CachePolicy{
+		"eth_blockNumber": {Cache: true, TTL: time.Minute},
+		"eth_getBalance":  {Cache: true, TTL: time.Minute},
+	}
+	tr.cache.set("eth_blockNumber", json.RawMessage(`"0x10"`), time.Minute)
+	tr.cache.set("eth_getBalance\x00\"0xabc\"", json.RawMessage(`"stale"`), time.Minute)
+
+	atomic.StoreInt32(&head, 0x11)
+	tr.refreshCached(context.Background(), []string{"eth_blockNumber", "eth_getBalance"})
+	if got, ok := tr.cache.get("eth_blockNumber"); !ok || string(got) != `"0x11"` {
+		t.Errorf("expected refreshed block number, got %s %t", got, ok)
+	}
+	if got, ok := tr.cache.get("eth_getBalance\x00\"0xabc\""); !ok || string(got) != `"0xabc"` {
+		t.Errorf("expected refreshed balance, got %s %t", got, ok)
+	}
+}
+
+func TestRefreshOnNewHead(t *testing.T) {
+	var calls int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x11"}`))
+	})
+
+	tr := newTestTransport(t)
+	tr.url = upstream.URL
+	tr.cache = newResponseCache(10)
+	tr.cachePolicies = map[string]CachePolicy{"eth_blockNumber": {Cache: true, TTL: time.Minute}}
+	tr.cache.set("eth_blockNumber", json.RawMessage(`"0x10"`), time.Minute)
+	methods := []string{"eth_blockNumber"}
+	// The poller and the subscription both see each head, in either order.
+	for i, test := range []struct {
+		head  uint64
+		calls int32
+	}{
+		{0x11, 1},
+		{0x11, 1},
+		{0x10, 1},
+		{0x12, 2},
+	} {
+		tr.refreshOnNewHead(context.Background(), test.head, methods)
+		if got := atomic.LoadInt32(&calls); got != test.calls {
+			t.Errorf("%d: head %d: expected %d refreshes, got %d", i, test.head, test.calls, got)
+		}
+	}
+}
+
+func TestPollHead(t *testing.T) {
+	var failing int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	})
+
+	tr := newTestTransport(t)
+	tr.url = upstream.URL
+	tr.cache = newResponseCache(10)
+	tr.cachePolicies = map[string]CachePolicy{"eth_blockNumber": {Cache: true, TTL: time.Minute}}
+	ctx, cancel := context.WithCancel(context.Background())
+	heads := make(chan uint64, 10)
+	done := make(chan struct{})
+	go func() {
+		tr.pollHead(ctx, 10*time.Millisecond, func(_ context.Context, num uint64) { heads <- num })
+		close(done)
+	}()
+	select {
+	case num := <-heads:
+		if num != 0x10 {
+			t.Errorf("expected head 0x10, got %d", num)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no new head")
+	}
+	if got, ok := tr.cache.get("eth_blockNumber"); !ok || string(got) != `"0x10"` {
+		t.Errorf("expected warm block number, got %s %t", got, ok)
+	}
+
+	// A failed poll is forgotten rather than served to requests.
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	tr.latestBlock.mu.RLock()
+	at := tr.latestBlock.at
+	tr.latestBlock.mu.RUnlock()
+	if at != nil {
+		t.Error("expected failed poll to be expired")
+	}
+}
+
+func TestFollowsHead(t *testing.T) {
+	const addr = `"0x0000000000000000000000000000000000000001"`
+	for _, test := range []struct {
+		method string
+		params []string
+		exp    bool
+	}{
+		{"eth_blockNumber", nil, true},
+		{"eth_chainId", nil, false},
+		{"eth_getBalance", []string{addr}, true},
+		{"eth_getBalance", []string{addr, `"latest"`}, true},
+		{"eth_getBalance", []string{addr, `"pending"`}, true},
+		{"eth_getBalance", []string{addr, `"0x10"`}, false},
+		{"eth_getBalance", []string{addr, `"earliest"`}, false},
+		{"eth_getLogs", []string{`{"fromBlock":"0x1","toBlock":"0x2"}`}, false},
+		{"eth_getLogs", []string{`{"fromBlock":"0x1"}`}, true},
+		{"eth_getLogs", []string{`{"fromBlock":"0x1","toBlock":"latest"}`}, true},
+		{"eth_getLogs", []string{`{"blockHash":"0x00"}`}, false},
+	} {
+		r := ModifiedRequest{Path: test.method}
+		for _, p := range test.params {
+			r.Params = append(r.Params, json.RawMessage(p))
+		}
+		if got := followsHead(r); got != test.exp {
+			t.Errorf("%s %v: expected %t, got %t", test.method, test.params, test.exp, got)
+		}
+	}
+}
+
+func TestResponseCacheInvalidateHead(t *testing.T) {
+	tr := newTestTransport(t)
+	tr.cache = newResponseCache(10)
+	ctx := context.Background()
+	policy := CachePolicy{Cache: true, TTL: time.Minute}
+	tr.cacheSet(ctx, "eth_blockNumber", ModifiedRequest{Path: "eth_blockNumber"}, json.RawMessage(`"0x10"`), policy)
+	tr.cacheSet(ctx, "eth_chainId", ModifiedRequest{Path: "eth_chainId"}, json.RawMessage(`"0x1"`), policy)
+	if n := tr.cache.invalidateHead(); n != 1 {
+		t.Errorf("expected 1 entry invalidated, got %d", n)
+	}
+	if _, ok := tr.cache.get("eth_blockNumber"); ok {
+		t.Error("expected eth_blockNumber to be invalidated")
+	}
+	if _, ok := tr.cache.get("eth_chainId"); !ok {
+		t.Error("expected eth_chainId to stay cached")
+	}
+}
+
+func TestSubscribeNewHeads(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var connects int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if atomic.AddInt32(&connects, 1) == 1 {
+			return // Fail the first subscription to exercise the retry.
+		}
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":`+string(req.ID)+`,"result":"0xabc"}`))
+		for _, n := range []string{"0x10", "0x11"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xabc","result":{"number":"`+n+`"}}}`))
+		}
+		conn.ReadMessage() // Until the client goes away.
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heads := make(chan uint64)
+	done := make(chan struct{})
+	go func() {
+		subscribeNewHeads(ctx, "ws"+strings.TrimPrefix(upstream.URL, "http"), 10*time.Millisecond, time.Second, func(_ context.Context, n uint64) {
+			heads <- n
+		})
+		close(done)
+	}()
+	for _, exp := range []uint64{0x10, 0x11} {
+		select {
+		case n := <-heads:
+			if n != exp {
+				t.Errorf("expected head %d, got %d", exp, n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for new head")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber didn't stop")
+	}
+}
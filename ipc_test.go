@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveIPC serves JSON-RPC over a unix socket like a node's IPC endpoint,
+// answering every request on a connection with result.
+func serveIPC(t *testing.T, result string) string {
+	path := filepath.Join(t.TempDir(), "node.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				d := json.NewDecoder(conn)
+				for {
+					var req struct {
+						ID json.RawMessage `json:"id"`
+					}
+					if err := d.Decode(&req); err != nil {
+						return
+					}
+					conn.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":` + result + `}` + "\n"))
+				}
+			}()
+		}
+	}()
+	return path
+}
+
+func TestIPCTransport(t *testing.T) {
+	path := serveIPC(t, `"0x10"`)
+	upstream := http.DefaultTransport.(*http.Transport).Clone()
+	upstream.RegisterProtocol(ipcScheme, ipcTransport{})
+	client := http.Client{Transport: upstream}
+	resp, err := client.Post(ipcScheme+"://"+path, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":7,"method":"eth_blockNumber"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"jsonrpc":"2.0","id":7,"result":"0x10"}` {
+		t.Errorf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestLatestBlock_ipc(t *testing.T) {
+	path := serveIPC(t, `"0x10"`)
+	l := &latestBlock{url: ipcScheme + "://" + path}
+	_, num, err := l.update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 0x10 {
+		t.Errorf("expected latest block 16, got %d", num)
+	}
+}
+
+func TestRPCDialURL(t *testing.T) {
+	for in, exp := range map[string]string{
+		"unix:///var/run/geth.ipc": "/var/run/geth.ipc",
+		"http://localhost:8545":    "http://localhost:8545",
+	} {
+		if got := rpcDialURL(in); got != exp {
+			t.Errorf("%s: expected %s, got %s", in, exp, got)
+		}
+	}
+}
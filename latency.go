@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of upstream responses latencyWindow keeps, so
+// its memory stays fixed however busy the proxy is.
+const latencySamples = 1024
+
+type latencySample struct {
+	d      time.Duration
+	failed bool
+}
+
+// latencyWindow keeps the latency and outcome of the most recent upstream
+// requests in a ring buffer. Older samples are overwritten, so the summary
+// covers the last latencySamples requests, whenever they were made.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]latencySample
+	next    int // Index the next sample is written to.
+	n       int // Samples held, up to latencySamples.
+}
+
+// record adds the latency d of an upstream request, which failed if the
+// upstream errored, timed out or was unavailable.
+func (w *latencyWindow) record(d time.Duration, failed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = latencySample{d: d, failed: failed}
+	w.next = (w.next + 1) % latencySamples
+	if w.n < latencySamples {
+		w.n++
+	}
+}
+
+// latencySummary describes the requests in a latencyWindow. Latencies are in
+// milliseconds.
+type latencySummary struct {
+	Samples   int     `json:"samples"`
+	P50       float64 `json:"p50Ms"`
+	P95       float64 `json:"p95Ms"`
+	P99       float64 `json:"p99Ms"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// summary returns the percentiles and error rate of the recorded samples.
+func (w *latencyWindow) summary() latencySummary {
+	w.mu.Lock()
+	ds := make([]time.Duration, w.n)
+	var failed int
+	for i := 0; i < w.n; i++ {
+		ds[i] = w.samples[i].d
+		if w.samples[i].failed {
+			failed++
+		}
+	}
+	w.mu.Unlock()
+
+	s := latencySummary{Samples: len(ds)}
+	if len(ds) == 0 {
+		return s
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	s.P50 = millis(percentile(ds, 0.50))
+	s.P95 = millis(percentile(ds, 0.95))
+	s.P99 = millis(percentile(ds, 0.99))
+	s.ErrorRate = float64(failed) / float64(len(ds))
+	return s
+}
+
+// percentile returns the nearest-rank p percentile of sorted, which must not
+// be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	var w latencyWindow
+	if s := w.summary(); s != (latencySummary{}) {
+		t.Errorf("expected empty summary, got %+v", s)
+	}
+	for i := 1; i <= 100; i++ {
+		w.record(time.Duration(i)*time.Millisecond, i%10 == 0)
+	}
+	exp := latencySummary{Samples: 100, P50: 50, P95: 95, P99: 99, ErrorRate: 0.1}
+	if s := w.summary(); s != exp {
+		t.Errorf("expected %+v, got %+v", exp, s)
+	}
+
+	// Old samples are overwritten once the window is full.
+	for i := 0; i < latencySamples; i++ {
+		w.record(time.Second, false)
+	}
+	exp = latencySummary{Samples: latencySamples, P50: 1000, P95: 1000, P99: 1000}
+	if s := w.summary(); s != exp {
+		t.Errorf("expected %+v, got %+v", exp, s)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +15,23 @@ type limiters struct {
 	noLimitIPs map[string]struct{} // concurrent read safe after init.
 	visitors   map[string]*rate.Limiter
 	sync.RWMutex
+
+	reloaded *visitorLimit // Set by setRate, nil means the flags. Protected by the mutex.
+
+	key rateLimitKey // nil means the client IP.
+
+	ipv4Prefix, ipv6Prefix int // bits of client IPs that rate limits key on, 0 means all
+
+	shared *redisLimiter // nil means limits are per replica.
+
+	quota *dailyQuota // nil means none
+
+	costs map[string]int // method -> tokens a request takes, unlisted methods take 1
+
+	maxConcurrent int // 0 means none
+
+	inFlightMu sync.Mutex // Protects inFlight.
+	inFlight   map[string]int
 }
 
 func (ls *limiters) tryAddVisitor(ip string) (*rate.Limiter, bool) {
@@ -20,12 +41,82 @@ func (ls *limiters) tryAddVisitor(ip string) (*rate.Limiter, bool) {
 	if exists {
 		return limiter, false
 	}
-	limit := rate.Every(time.Minute / time.Duration(requestsPerMinuteLimit))
-	limiter = rate.NewLimiter(limit, requestsPerMinuteLimit/10)
+	limiter = ls.newVisitorLimiter()
 	ls.visitors[ip] = limiter
 	return limiter, true
 }
 
+// visitorLimit is the rate limit of visitors: limit requests per window, with
+// a burst of burst, 0 meaning derived from limit.
+type visitorLimit struct {
+	limit  int
+	window time.Duration
+	burst  int
+}
+
+// every returns the limit and burst of limiters enforcing l.
+func (l visitorLimit) every() (rate.Limit, int) {
+	return rate.Every(l.window / time.Duration(l.limit)), burstSize(l.burst, l.limit)
+}
+
+// retryAfter returns how long a rate limited visitor has to wait for its next
+// request to be allowed, at most. 0 means unknown.
+func (l visitorLimit) retryAfter() time.Duration {
+	if l.limit <= 0 {
+		return 0
+	}
+	return l.window / time.Duration(l.limit)
+}
+
+// rateLimit returns the current rate limit of visitors.
+func (ls *limiters) rateLimit() visitorLimit {
+	ls.RLock()
+	defer ls.RUnlock()
+	return ls.rateLimitLocked()
+}
+
+// rateLimitLocked is rateLimit for callers holding the mutex. The flags are
+// only set before serving, so they are read without it.
+func (ls *limiters) rateLimitLocked() visitorLimit {
+	if ls.reloaded != nil {
+		return *ls.reloaded
+	}
+	return visitorLimit{limit: requestLimit, window: rateWindow, burst: rateBurst}
+}
+
+// newVisitorLimiter returns a limiter enforcing the current rate limit. The
+// caller must hold the mutex.
+func (ls *limiters) newVisitorLimiter() *rate.Limiter {
+	return rate.NewLimiter(ls.rateLimitLocked().every())
+}
+
+// setRate changes the rate limit to limit requests per window, with a burst of
+// burst. Visitors already seen keep their tokens, but their limiters are
+// updated too, since they would otherwise keep the rate they were created
+// with.
+func (ls *limiters) setRate(limit int, window time.Duration, burst int) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.reloaded = &visitorLimit{limit: limit, window: window, burst: burst}
+	l, b := ls.reloaded.every()
+	for _, limiter := range ls.visitors {
+		limiter.SetLimit(l)
+		limiter.SetBurst(b)
+	}
+}
+
+// burstSize returns burst if set, otherwise a tenth of limit. The result is
+// at least 1, since a limiter with no burst rejects every request.
+func burstSize(burst, limit int) int {
+	if burst <= 0 {
+		burst = limit / 10
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
 func (ls *limiters) getVisitor(ip string) (*rate.Limiter, bool) {
 	ls.RLock()
 	limiter, exists := ls.visitors[ip]
@@ -37,9 +128,217 @@ func (ls *limiters) getVisitor(ip string) (*rate.Limiter, bool) {
 }
 
 func (ls *limiters) AllowVisitor(r ModifiedRequest) (allowed, added bool) {
-	if _, ok := ls.noLimitIPs[r.RemoteAddr]; ok {
+	if ls.exempt(r.RemoteAddr) {
 		return true, false
 	}
-	limiter, added := ls.getVisitor(r.RemoteAddr)
-	return limiter.Allow(), added
+	r.RemoteAddr = ipPrefix(r.RemoteAddr, ls.ipv4Prefix, ls.ipv6Prefix)
+	key := ls.key.build(r)
+	cost := ls.cost(r.Path)
+	if ls.shared != nil {
+		if allowed, err := ls.shared.allow(context.Background(), key, ls.rateLimit(), cost); err == nil {
+			return allowed, false
+		}
+	}
+	limiter, added := ls.getVisitor(key)
+	if b := limiter.Burst(); cost > b {
+		// More than the burst would never be allowed.
+		cost = b
+	}
+	return limiter.AllowN(time.Now(), cost), added
+}
+
+// AllowKey is AllowVisitor for requests with an API key which has its own
+// rate limit, l, shared by everyone using the key and enforced by limiter
+// unless Redis is used.
+func (ls *limiters) AllowKey(r ModifiedRequest, l visitorLimit, limiter *rate.Limiter) bool {
+	cost := ls.cost(r.Path)
+	if ls.shared != nil {
+		if allowed, err := ls.shared.allow(context.Background(), "key:"+r.APIKey, l, cost); err == nil {
+			return allowed
+		}
+	}
+	if b := limiter.Burst(); cost > b {
+		cost = b
+	}
+	return limiter.AllowN(time.Now(), cost)
+}
+
+// cost returns the tokens a request for method takes.
+func (ls *limiters) cost(method string) int {
+	if c, ok := ls.costs[method]; ok {
+		return c
+	}
+	return 1
+}
+
+// defaultMethodCosts are the rate limit tokens taken by requests for heavy
+// methods, which execute a call on the node.
+var defaultMethodCosts = map[string]int{
+	"eth_call":             2,
+	"eth_createAccessList": 2,
+	"eth_estimateGas":      2,
+}
+
+// methodCosts returns the built-in costs overridden by configured ones. A
+// configured cost of 0 removes one, so the method takes a single token.
+func methodCosts(configured map[string]int) (map[string]int, error) {
+	cs := make(map[string]int, len(defaultMethodCosts)+len(configured))
+	for m, c := range defaultMethodCosts {
+		cs[m] = c
+	}
+	for m, c := range configured {
+		if c < 0 {
+			return nil, fmt.Errorf("cost of %s: must not be negative", m)
+		}
+		if c == 0 {
+			delete(cs, m)
+			continue
+		}
+		cs[m] = c
+	}
+	return cs, nil
+}
+
+func (ls *limiters) exempt(ip string) bool {
+	_, ok := ls.noLimitIPs[ip]
+	return ok
+}
+
+// acquire reserves an in-flight request slot for ip, returning false if ip
+// already has maxConcurrent requests in flight. Every successful acquire must
+// be paired with a call to release.
+func (ls *limiters) acquire(ip string) bool {
+	if ls.maxConcurrent <= 0 || ls.exempt(ip) {
+		return true
+	}
+	ls.inFlightMu.Lock()
+	defer ls.inFlightMu.Unlock()
+	if ls.inFlight[ip] >= ls.maxConcurrent {
+		return false
+	}
+	ls.inFlight[ip]++
+	return true
+}
+
+// release frees a slot reserved by acquire.
+func (ls *limiters) release(ip string) {
+	if ls.maxConcurrent <= 0 || ls.exempt(ip) {
+		return
+	}
+	ls.inFlightMu.Lock()
+	defer ls.inFlightMu.Unlock()
+	if n := ls.inFlight[ip]; n > 1 {
+		ls.inFlight[ip] = n - 1
+	} else {
+		delete(ls.inFlight, ip)
+	}
+}
+
+// validPrefixes returns an error unless v4 and v6 are valid IPv4 and IPv6
+// prefix lengths, or 0.
+func validPrefixes(v4, v6 int) error {
+	if v4 < 0 || v4 > 8*net.IPv4len {
+		return fmt.Errorf("invalid rate limit ipv4 prefix: %d", v4)
+	}
+	if v6 < 0 || v6 > 8*net.IPv6len {
+		return fmt.Errorf("invalid rate limit ipv6 prefix: %d", v6)
+	}
+	return nil
+}
+
+// rateLimitKey is a parsed RateLimitKey template. Each part is either a
+// literal or a placeholder naming a request attribute.
+type rateLimitKey []keyPart
+
+type keyPart struct {
+	literal string
+	attr    string // Set for placeholders.
+}
+
+// keyAttrs are the request attributes available to RateLimitKey templates.
+var keyAttrs = map[string]func(ModifiedRequest) string{
+	"client": clientKey,
+	"ip":     func(r ModifiedRequest) string { return r.RemoteAddr },
+	"key":    apiKeyKey,
+	"method": func(r ModifiedRequest) string { return r.Path },
+	"subnet": subnetKey,
+}
+
+// apiKeyKey returns the API key of r, if any, otherwise its client key. Keys
+// are prefixed so they can't collide with client IDs or IPs.
+func apiKeyKey(r ModifiedRequest) string {
+	if r.APIKey != "" {
+		return "key:" + r.APIKey
+	}
+	return clientKey(r)
+}
+
+// clientKey returns the client ID of r set by a trusted proxy, if any,
+// otherwise its IP. IDs are prefixed so they can't collide with IPs.
+func clientKey(r ModifiedRequest) string {
+	if r.ClientID != "" {
+		return "id:" + r.ClientID
+	}
+	return r.RemoteAddr
+}
+
+// subnetKey returns the /24 or /64 of the IP of r, unless RateLimitIPv4Prefix
+// or RateLimitIPv6Prefix already reduced it to a subnet.
+func subnetKey(r ModifiedRequest) string {
+	return ipPrefix(r.RemoteAddr, 24, 64)
+}
+
+// parseRateLimitKey parses a template like "{ip}:{method}". An empty template
+// is equivalent to "{client}".
+func parseRateLimitKey(tmpl string) (rateLimitKey, error) {
+	if tmpl == "" {
+		tmpl = "{client}"
+	}
+	var key rateLimitKey
+	var placeholders int
+	for s := tmpl; s != ""; {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			key = append(key, keyPart{literal: s})
+			break
+		}
+		if s[i] == '}' {
+			return nil, fmt.Errorf("invalid rate limit key %q: unexpected '}'", tmpl)
+		}
+		if i > 0 {
+			key = append(key, keyPart{literal: s[:i]})
+		}
+		s = s[i+1:]
+		j := strings.IndexAny(s, "{}")
+		if j < 0 || s[j] != '}' {
+			return nil, fmt.Errorf("invalid rate limit key %q: unclosed '{'", tmpl)
+		}
+		attr := s[:j]
+		if _, ok := keyAttrs[attr]; !ok {
+			return nil, fmt.Errorf("invalid rate limit key %q: unknown attribute %q", tmpl, attr)
+		}
+		key = append(key, keyPart{attr: attr})
+		placeholders++
+		s = s[j+1:]
+	}
+	if placeholders == 0 {
+		return nil, fmt.Errorf("invalid rate limit key %q: no attributes", tmpl)
+	}
+	return key, nil
+}
+
+// build returns the limiter key for r.
+func (k rateLimitKey) build(r ModifiedRequest) string {
+	if k == nil {
+		return clientKey(r)
+	}
+	var sb strings.Builder
+	for _, p := range k {
+		if p.attr != "" {
+			sb.WriteString(keyAttrs[p.attr](r))
+		} else {
+			sb.WriteString(p.literal)
+		}
+	}
+	return sb.String()
 }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestLimitersConcurrency(t *testing.T) {
+	ls := limiters{
+		noLimitIPs:    map[string]struct{}{"10.0.0.1": {}},
+		maxConcurrent: 2,
+		inFlight:      make(map[string]int),
+	}
+	if !ls.acquire("1.2.3.4") || !ls.acquire("1.2.3.4") {
+		t.Fatal("expected first two requests to be allowed")
+	}
+	if ls.acquire("1.2.3.4") {
+		t.Error("expected third concurrent request to be blocked")
+	}
+	if !ls.acquire("5.6.7.8") {
+		t.Error("expected other IP to be allowed")
+	}
+	ls.release("1.2.3.4")
+	if !ls.acquire("1.2.3.4") {
+		t.Error("expected request to be allowed after release")
+	}
+	for i := 0; i < 5; i++ {
+		if !ls.acquire("10.0.0.1") {
+			t.Fatal("expected exempt IP to be allowed")
+		}
+	}
+	if _, ok := ls.inFlight["10.0.0.1"]; ok {
+		t.Error("expected exempt IP not to be tracked")
+	}
+}
+
+func TestLimitersMethodCosts(t *testing.T) {
+	defer func(limit int, burst int) { requestLimit, rateBurst = limit, burst }(requestLimit, rateBurst)
+	requestLimit, rateBurst = 10, 4
+	costs, err := methodCosts(map[string]int{"eth_estimateGas": 0, "debug_traceCall": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), costs: costs}
+	for _, test := range []struct {
+		ip, method string
+		allowed    int // requests allowed out of a burst of 4
+	}{
+		{"1.1.1.1", "eth_blockNumber", 4},
+		{"2.2.2.2", "eth_call", 2},
+		{"3.3.3.3", "eth_createAccessList", 2},
+		{"4.4.4.4", "eth_estimateGas", 4},
+		{"5.5.5.5", "debug_traceCall", 1}, // At most the burst.
+	} {
+		var allowed int
+		for i := 0; i < 5; i++ {
+			if ok, _ := ls.AllowVisitor(ModifiedRequest{Path: test.method, RemoteAddr: test.ip}); ok {
+				allowed++
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: expected %d requests allowed but got %d", test.method, test.allowed, allowed)
+		}
+	}
+	if _, err := methodCosts(map[string]int{"eth_call": -1}); err == nil {
+		t.Error("expected negative cost to be rejected")
+	}
+}
+
+func TestParseRateLimitKey(t *testing.T) {
+	r := ModifiedRequest{Path: "eth_call", RemoteAddr: "1.2.3.4"}
+	keyed := ModifiedRequest{Path: "eth_call", RemoteAddr: "2001:db8::1", APIKey: "paid"}
+	for _, test := range []struct {
+		tmpl string
+		req  ModifiedRequest
+		want string
+	}{
+		{"", r, "1.2.3.4"},
+		{"{ip}", r, "1.2.3.4"},
+		{"{ip}:{method}", r, "1.2.3.4:eth_call"},
+		{"m-{method}", r, "m-eth_call"},
+		{"{client}", r, "1.2.3.4"},
+		{"{key}", r, "1.2.3.4"},
+		{"{key}:{method}", keyed, "key:paid:eth_call"},
+		{"{subnet}", r, "1.2.3.0/24"},
+		{"{subnet}", keyed, "2001:db8::/64"},
+	} {
+		key, err := parseRateLimitKey(test.tmpl)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.tmpl, err)
+			continue
+		}
+		if got := key.build(test.req); got != test.want {
+			t.Errorf("%q: expected %q but got %q", test.tmpl, test.want, got)
+		}
+	}
+	for _, tmpl := range []string{"ip", "{ip", "ip}", "{ip}{", "{foo}", "{}", "{{ip}}"} {
+		if _, err := parseRateLimitKey(tmpl); err == nil {
+			t.Errorf("%q: expected error", tmpl)
+		}
+	}
+}
+
+func TestLimitersRateLimitKey(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 10 // Burst of 1.
+	key, err := parseRateLimitKey("{ip}:{method}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), key: key}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: "1.2.3.4"}); !allowed {
+		t.Fatal("expected first request to be allowed")
+	}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: "1.2.3.4"}); allowed {
+		t.Error("expected second request for the same method to be rate limited")
+	}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_blockNumber", RemoteAddr: "1.2.3.4"}); !allowed {
+		t.Error("expected request for another method to be allowed")
+	}
+}
+
+func TestLimitersSubnet(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 10 // Burst of 1.
+	ls := limiters{
+		visitors:   make(map[string]*rate.Limiter),
+		noLimitIPs: map[string]struct{}{"1.2.3.9": {}},
+		ipv4Prefix: 24,
+		ipv6Prefix: 64,
+	}
+	for _, test := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"1.2.3.4", true},
+		{"1.2.3.5", false}, // Same /24.
+		{"1.2.3.9", true},  // Exempt, though in the same /24.
+		{"1.2.4.4", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false}, // Same /64.
+		{"2001:db8:0:1::1", true},
+	} {
+		if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: test.ip}); allowed != test.allowed {
+			t.Errorf("%s: expected allowed %t but got %t", test.ip, test.allowed, allowed)
+		}
+	}
+	if err := validPrefixes(33, 64); err == nil {
+		t.Error("expected an ipv4 prefix over 32 to be rejected")
+	}
+	if err := validPrefixes(24, 129); err == nil {
+		t.Error("expected an ipv6 prefix over 128 to be rejected")
+	}
+}
+
+func TestClientID(t *testing.T) {
+	trusted, err := parseIPSet([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &myTransport{clientIDHeader: "X-Consumer-ID", trustedProxies: trusted}
+	for _, test := range []struct {
+		remoteAddr, header string
+		want               string
+	}{
+		{"10.1.2.3:1234", "alice", "alice"},
+		{"10.1.2.3:1234", "", ""},
+		{"1.2.3.4:1234", "alice", ""}, // Untrusted peer.
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			req.Header.Set("X-Consumer-ID", test.header)
+		}
+		if got := tr.clientID(req); got != test.want {
+			t.Errorf("%s %q: expected %q but got %q", test.remoteAddr, test.header, test.want, got)
+		}
+	}
+
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 10 // Burst of 1.
+	ls := limiters{visitors: make(map[string]*rate.Limiter)}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: "10.1.2.3", ClientID: "alice"}); !allowed {
+		t.Fatal("expected first request to be allowed")
+	}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: "10.1.2.3", ClientID: "bob"}); !allowed {
+		t.Error("expected another client behind the same IP to be allowed")
+	}
+	if allowed, _ := ls.AllowVisitor(ModifiedRequest{Path: "eth_call", RemoteAddr: "10.9.9.9", ClientID: "alice"}); allowed {
+		t.Error("expected the same client behind another IP to be rate limited")
+	}
+}
+
+func TestLimitStateRoundTrip(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 600 // 10/s, burst of 60.
+	ls := limiters{visitors: make(map[string]*rate.Limiter), quota: newDailyQuota(5)}
+	ls.quota.take(map[string]int{"1.2.3.4": 3}, time.Now())
+	for i := 0; i < 50; i++ {
+		ls.AllowVisitor(ModifiedRequest{RemoteAddr: "1.2.3.4"})
+	}
+	ls.AllowVisitor(ModifiedRequest{RemoteAddr: "5.6.7.8"})
+	now := time.Now()
+	state := ls.snapshot(now)
+	if len(state.Visitors) != 2 {
+		t.Fatalf("expected 2 visitors but got %d", len(state.Visitors))
+	}
+	if tokens := state.Visitors["1.2.3.4"]; tokens < 10 || tokens > 11 {
+		t.Errorf("expected ~10 tokens but got %v", tokens)
+	}
+	// Snapshotting must not consume tokens.
+	if tokens := tokensAt(ls.visitors["1.2.3.4"], now); tokens < 10 || tokens > 11 {
+		t.Errorf("expected ~10 tokens after snapshot but got %v", tokens)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := saveLimitState(path, state); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadLimitState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := limiters{visitors: make(map[string]*rate.Limiter), quota: newDailyQuota(5)}
+	restored.restore(*loaded)
+	if tokens := tokensAt(restored.visitors["1.2.3.4"], now); tokens < 10 || tokens > 12 {
+		t.Errorf("expected ~10 restored tokens but got %v", tokens)
+	}
+	if restored.quota.available("1.2.3.4", 3, now) || !restored.quota.available("1.2.3.4", 2, now) {
+		t.Errorf("expected 3 of 5 quota requests restored, got %v", restored.quota.today(now))
+	}
+
+	// The state is saved once more when checkpointing stops.
+	path = filepath.Join(t.TempDir(), "final.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go ls.checkpoint(ctx, path, time.Hour, done)
+	cancel()
+	<-done
+	if final, err := loadLimitState(path); err != nil || final == nil || len(final.Visitors) != 2 {
+		t.Errorf("expected the state to be saved on shutdown, got %v, %v", final, err)
+	}
+
+	missing, err := loadLimitState(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || missing != nil {
+		t.Errorf("expected no state for missing file but got %v, %v", missing, err)
+	}
+}
+
+func TestNewVisitorLimiterWindow(t *testing.T) {
+	defer func(limit int, window time.Duration) { requestLimit, rateWindow = limit, window }(requestLimit, rateWindow)
+	requestLimit, rateWindow = 100, time.Second
+	l := (&limiters{}).newVisitorLimiter()
+	if l.Limit() != 100 {
+		t.Errorf("expected 100 per second but got %v", l.Limit())
+	}
+	if l.Burst() != 10 {
+		t.Errorf("expected burst of 10 but got %d", l.Burst())
+	}
+}
+
+func TestBurstSize(t *testing.T) {
+	for _, test := range []struct {
+		burst, limit, want int
+	}{
+		{0, 1000, 100},
+		{0, 5, 1},
+		{0, 0, 1},
+		{25, 1000, 25},
+		{-1, 100, 10},
+	} {
+		if got := burstSize(test.burst, test.limit); got != test.want {
+			t.Errorf("burstSize(%d, %d): expected %d but got %d", test.burst, test.limit, test.want, got)
+		}
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	q := newDailyQuota(2)
+	day := time.Date(2021, 6, 30, 23, 59, 0, 0, time.UTC)
+	if !q.available("1.2.3.4", 2, day) || q.available("1.2.3.4", 3, day) {
+		t.Error("expected 2 requests available")
+	}
+	if q.take(map[string]int{"1.2.3.4": 1, "5.6.7.8": 3}, day) {
+		t.Error("expected batch over quota to be refused")
+	}
+	for i, exp := range []bool{true, true, false} {
+		if got := q.take(map[string]int{"1.2.3.4": 1}, day); got != exp {
+			t.Errorf("request %d: expected %t, got %t", i, exp, got)
+		}
+	}
+	if !q.take(map[string]int{"5.6.7.8": 1}, day) {
+		t.Error("expected quota to be per IP")
+	}
+	next := day.Add(2 * time.Minute)
+	if !q.take(map[string]int{"1.2.3.4": 1}, next) {
+		t.Error("expected quota to reset at midnight UTC")
+	}
+	if n := q.removeExpired(next); n != 2 {
+		t.Errorf("expected 2 expired counts removed, got %d", n)
+	}
+}
+
+func TestBlock_dailyQuota(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	tr.quota = newDailyQuota(1)
+	tr.noLimitIPs["9.9.9.9"] = struct{}{}
+	request := func(ip string) (int, interface{}) {
+		return tr.block(context.Background(), []ModifiedRequest{{Path: "eth_chainId", RemoteAddr: ip}})
+	}
+	// Requests blocked by a later check don't use the quota.
+	if _, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_chainId", RemoteAddr: "1.2.3.4"}, {Path: "eth_sendTransaction", RemoteAddr: "1.2.3.4"}}); resp == nil {
+		t.Fatal("expected batch with a disallowed method to be blocked")
+	}
+	if _, resp := request("1.2.3.4"); resp != nil {
+		t.Fatalf("unexpected block: %v", resp)
+	}
+	code, resp := request("1.2.3.4")
+	if code != http.StatusTooManyRequests || resp.(ErrResponse).Error.Code != jsonRPCQuotaLimit {
+		t.Errorf("expected quota error, got: %d %v", code, resp)
+	}
+	for i := 0; i < 3; i++ {
+		if _, resp := request("9.9.9.9"); resp != nil {
+			t.Fatalf("unexpected block of exempt IP: %v", resp)
+		}
+	}
+}
+
+func TestRoundTrip_retryAfter(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	defer func(limit, burst int) { requestLimit, rateBurst = limit, burst }(requestLimit, rateBurst)
+	requestLimit, rateBurst = 2, 1
+	var resp *http.Response
+	for i := 0; i < 2; i++ {
+		req := newTestRequest(upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+		var err error
+		if resp, err = tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("expected Retry-After 30, got %q", got)
+	}
+	var errResp struct {
+		Error struct {
+			Data retryData `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Data.RetryAfter != 30 {
+		t.Errorf("expected retry hint of 30s, got: %+v %v", errResp, err)
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	now := time.Date(2024, 2, 29, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	if got, exp := quotaReset(now), time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC); !got.Equal(exp) {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+}
+
+func TestLimitersSetRate(t *testing.T) {
+	defer func(limit int, window time.Duration, burst int) {
+		requestLimit, rateWindow, rateBurst = limit, window, burst
+	}(requestLimit, rateWindow, rateBurst)
+	requestLimit, rateWindow, rateBurst = 10, time.Minute, 0 // Burst of 1.
+	ls := &limiters{visitors: make(map[string]*rate.Limiter)}
+	seen, _ := ls.getVisitor("1.2.3.4")
+	if !seen.Allow() || seen.Allow() {
+		t.Fatal("expected a burst of 1 before reload")
+	}
+
+	ls.setRate(100, time.Second, 5)
+	unseen, _ := ls.getVisitor("5.6.7.8")
+	for name, l := range map[string]*rate.Limiter{"seen": seen, "unseen": unseen} {
+		if l.Limit() != 100 {
+			t.Errorf("%s: expected 100 per second but got %v", name, l.Limit())
+		}
+		if l.Burst() != 5 {
+			t.Errorf("%s: expected burst of 5 but got %d", name, l.Burst())
+		}
+	}
+	if got, _ := ls.getVisitor("1.2.3.4"); got != seen {
+		t.Error("expected the seen visitor to keep its limiter")
+	}
+}
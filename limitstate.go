@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+	"golang.org/x/time/rate"
+)
+
+const defaultLimitStateInterval = time.Minute
+
+// limitState is the rate limiter state persisted across restarts.
+type limitState struct {
+	Saved    time.Time          `json:"saved"`
+	Visitors map[string]float64 `json:"visitors"`        // limiter key -> tokens available at Saved
+	Quota    map[string]int     `json:"quota,omitempty"` // IP -> requests counted against the daily quota on Saved's day
+}
+
+// snapshot returns the state of every visitor whose bucket is not full, since
+// a full bucket is the same as no bucket at all.
+func (ls *limiters) snapshot(now time.Time) limitState {
+	ls.RLock()
+	visitors := make(map[string]*rate.Limiter, len(ls.visitors))
+	for k, l := range ls.visitors {
+		visitors[k] = l
+	}
+	ls.RUnlock()
+
+	s := limitState{Saved: now, Visitors: make(map[string]float64)}
+	for k, l := range visitors {
+		if t := tokensAt(l, now); t < float64(l.Burst()) {
+			s.Visitors[k] = t
+		}
+	}
+	if ls.quota != nil {
+		s.Quota = ls.quota.today(now)
+	}
+	return s
+}
+
+// tokensAt returns the tokens available from l at now, without touching the
+// limiter, which requests may be using at the same time.
+func tokensAt(l *rate.Limiter, now time.Time) float64 {
+	if t := l.TokensAt(now); t > 0 {
+		return t
+	}
+	return 0
+}
+
+// restore recreates the visitors in s. Buckets keep refilling from s.Saved,
+// so time spent down counts towards the limit as usual. Quota counts are
+// restored into the day they were saved on, so they are dropped with the
+// rest of that day's.
+func (ls *limiters) restore(s limitState) {
+	if ls.quota != nil {
+		ls.quota.restore(quotaDay(s.Saved), s.Quota)
+	}
+	ls.Lock()
+	defer ls.Unlock()
+	for k, tokens := range s.Visitors {
+		l := ls.newVisitorLimiter()
+		if used := int(float64(l.Burst()) - tokens); used > 0 {
+			l.ReserveN(s.Saved, used)
+		}
+		ls.visitors[k] = l
+	}
+}
+
+// loadLimitState reads the state saved at path, returning nil if there is
+// none.
+func loadLimitState(path string) (*limitState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s limitState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveLimitState writes s to path, replacing any previous state atomically.
+func saveLimitState(path string, s limitState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkpoint saves the limiter state to path every interval, and once more
+// when ctx is done, so usage since the last save isn't lost on shutdown. It
+// runs in its own goroutine, off the request path, and closes done once the
+// last save is finished.
+func (ls *limiters) checkpoint(ctx context.Context, path string, interval time.Duration, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			now = time.Now()
+		case now = <-ticker.C:
+		}
+		if err := saveLimitState(path, ls.snapshot(now)); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to save rate limit state: %v", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
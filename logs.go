@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// splitLogs serves an eth_getLogs request spanning the finality boundary in
+// two parts: the finalized range from the cache (filling it from upstream on
+// a miss) and the unfinalized range from upstream. The boundary is aligned
+// down to a multiple of finalityDepth so the finalized part's cache key stays
+// stable while the chain grows. It returns nil whenever the request can't be
+// split, in which case it should be forwarded as is.
+func (t *myTransport) splitLogs(ctx context.Context, req *http.Request, request ModifiedRequest) *http.Response {
+	if t.cache == nil || !t.splitLogQueries || request.Path != "eth_getLogs" || len(request.Params) != 1 {
+		return nil
+	}
+	policy := t.cachePolicies[request.Path]
+	if !policy.Cache {
+		return nil
+	}
+	r, invalid, err := t.parseRange(ctx, request)
+	if r == nil || invalid != nil || err != nil {
+		return nil
+	}
+	latest, err := t.latestBlock.get(ctx)
+	if err != nil || latest < 2*t.finalityDepth {
+		return nil
+	}
+	boundary := (latest-t.finalityDepth+1)/t.finalityDepth*t.finalityDepth - 1
+	if r.start > boundary || r.end <= boundary {
+		return nil // Entirely finalized or unfinalized.
+	}
+
+	finalized, err := withRange(request.Params[0], r.start, boundary)
+	if err != nil {
+		return nil
+	}
+	unfinalized, err := withRange(request.Params[0], boundary+1, r.end)
+	if err != nil {
+		return nil
+	}
+	finalizedRequest := ModifiedRequest{Path: request.Path, Params: []json.RawMessage{finalized}}
+	key, err := cacheKey(finalizedRequest, true)
+	if err != nil {
+		return nil
+	}
+
+	var logs []json.RawMessage
+	result, ok := t.cache.get(key)
+	if !ok {
+		result, err = t.call(req, request.Path, finalized)
+		if err != nil {
+			return nil
+		}
+		t.cacheSet(ctx, key, finalizedRequest, result, policy)
+	}
+	if err := json.Unmarshal(result, &logs); err != nil {
+		return nil
+	}
+	result, err = t.call(req, request.Path, unfinalized)
+	if err != nil {
+		return nil
+	}
+	var recent []json.RawMessage
+	if err := json.Unmarshal(result, &recent); err != nil {
+		return nil
+	}
+	logs = append(logs, recent...)
+	if t.maxLogResults > 0 && len(logs) > t.maxLogResults {
+		resp, err := jsonRPCResponse(http.StatusOK, jsonRPCLogLimit(request.ID, len(logs), t.maxLogResults))
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+	merged, err := json.Marshal(logs)
+	if err != nil {
+		return nil
+	}
+	body, err := json.Marshal(cachedResponse(request.ID, merged))
+	if err != nil {
+		return nil
+	}
+	if t.maxResponseBytes > 0 && int64(len(body)) > t.maxResponseBytes {
+		gotils.L(ctx).Error().Printf("Merged logs response exceeds limit of %d bytes", t.maxResponseBytes)
+		resp, err := jsonRPCResponse(http.StatusBadGateway, jsonRPCResponseTooLarge(request.ID, t.maxResponseBytes))
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+	resp, err := jsonRPCResponse(http.StatusOK, json.RawMessage(body))
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// withRange returns a copy of the filter query with fromBlock and toBlock set.
+func withRange(filter json.RawMessage, from, to uint64) (json.RawMessage, error) {
+	var fq map[string]json.RawMessage
+	if err := json.Unmarshal(filter, &fq); err != nil {
+		return nil, err
+	}
+	fq["fromBlock"] = json.RawMessage(fmt.Sprintf(`"0x%x"`, from))
+	fq["toBlock"] = json.RawMessage(fmt.Sprintf(`"0x%x"`, to))
+	return json.Marshal(fq)
+}
+
+// call sends a JSON-RPC request for method to the same upstream as req and
+// returns the result, or an error if the call failed or returned an error.
+func (t *myTransport) call(req *http.Request, method string, params ...json.RawMessage) (json.RawMessage, error) {
+	body, err := rpcRequest(method, params)
+	if err != nil {
+		return nil, err
+	}
+	out := req.Clone(req.Context())
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.Header.Del("Accept-Encoding")
+	res, err := t.forward(out, t.timeout([]ModifiedRequest{{Path: method}}))
+	if err != nil {
+		return nil, err
+	}
+	return rpcResult(res, t.maxResponseBytes)
+}
+
+// rpcRequest returns the body of a JSON-RPC request for method.
+func rpcRequest(method string, params []json.RawMessage) ([]byte, error) {
+	return json.Marshal(struct {
+		JSONRPC string            `json:"jsonrpc"`
+		ID      int               `json:"id"`
+		Method  string            `json:"method"`
+		Params  []json.RawMessage `json:"params"`
+	}{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+}
+
+// rpcResult reads the result of a single JSON-RPC call from res, of at most
+// max bytes, returning an error if the call failed or returned an error.
+func rpcResult(res *http.Response, max int64) (json.RawMessage, error) {
+	b, err := readBody(res, max)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	err = json.Unmarshal(b, &resp)
+	if err == nil && resp.Error != nil {
+		// Including the transport's own rejections, e.g. rate limits.
+		return nil, resp.Error
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// rpcError is the error of a JSON-RPC response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// logMethods return arrays of logs, which are capped by maxLogResults.
+var logMethods = map[string]struct{}{
+	"eth_getLogs":       {},
+	"eth_getFilterLogs": {},
+}
+
+// hasLogMethod returns true if any of methods returns logs.
+func hasLogMethod(methods []string) bool {
+	for _, m := range methods {
+		if _, ok := logMethods[m]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// capLogs replaces each response in body to a logMethods request holding more
+// than max logs with an error suggesting a narrower range. The node still does
+// the work of finding every log, but clients are spared from receiving them.
+// It returns false if no response was replaced.
+func capLogs(body []byte, parsedRequests []ModifiedRequest, max int) ([]byte, bool, error) {
+	capResp := func(resp map[string]json.RawMessage, method string) (bool, error) {
+		if _, ok := logMethods[method]; !ok {
+			return false, nil
+		}
+		result, ok := resp["result"]
+		if !ok {
+			return false, nil
+		}
+		var logs []json.RawMessage
+		if err := json.Unmarshal(result, &logs); err != nil {
+			return false, err
+		}
+		if len(logs) <= max {
+			return false, nil
+		}
+		delete(resp, "result")
+		e, err := json.Marshal(jsonRPCLogLimit(resp["id"], len(logs), max).(ErrResponse).Error)
+		if err != nil {
+			return false, err
+		}
+		resp["error"] = e
+		return true, nil
+	}
+	if isBatch(body) {
+		// Batch responses may be in any order, so match them up by id.
+		byID := make(map[string]string, len(parsedRequests))
+		for _, r := range parsedRequests {
+			byID[string(responseID(r.ID))] = r.Path
+		}
+		var resps []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &resps); err != nil {
+			return nil, false, err
+		}
+		var capped bool
+		for _, resp := range resps {
+			c, err := capResp(resp, byID[string(responseID(resp["id"]))])
+			if err != nil {
+				return nil, false, err
+			}
+			capped = capped || c
+		}
+		if !capped {
+			return body, false, nil
+		}
+		b, err := json.Marshal(resps)
+		return b, true, err
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, false, err
+	}
+	if len(parsedRequests) == 0 {
+		return body, false, nil
+	}
+	if c, err := capResp(resp, parsedRequests[0].Path); err != nil || !c {
+		return body, false, err
+	}
+	b, err := json.Marshal(resp)
+	return b, true, err
+}
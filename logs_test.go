@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitLogs(t *testing.T) {
+	var calls int32
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req struct {
+			Params []struct {
+				FromBlock string `json:"fromBlock"`
+				ToBlock   string `json:"toBlock"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		p := req.Params[0]
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":[{"range":"%s-%s"}]}`, p.FromBlock, p.ToBlock)
+	})
+
+	tr := newTestTransport(t, "eth_getLogs")
+	tr.finalityDepth = 10
+	tr.cache = newResponseCache(0)
+	tr.cachePolicies, _ = cachePolicies(nil, nil)
+	tr.splitLogQueries = true
+	now := time.Now()
+	tr.latestBlock.num, tr.latestBlock.at = 105, &now
+
+	const getLogs = `{"jsonrpc":"2.0","id":"a","method":"eth_getLogs","params":[{"fromBlock":"0x1","address":"0x01"}]}`
+	for i, exp := range []int32{2, 1} {
+		atomic.StoreInt32(&calls, 0)
+		resp := testRoundTrip(t, tr, upstream.URL, getLogs)
+		body, _ := ioutil.ReadAll(resp.Body)
+		// Boundary is 89: (105-10+1)/10*10-1.
+		const result = `{"jsonrpc":"2.0","id":"a","result":[{"range":"0x1-0x59"},{"range":"0x5a-0x69"}]}`
+		if string(body) != result {
+			t.Errorf("request %d: expected %s, got %s", i, result, body)
+		}
+		if c := atomic.LoadInt32(&calls); c != exp {
+			t.Errorf("request %d: expected %d upstream calls, got %d", i, exp, c)
+		}
+	}
+
+	// The merged response is held to MaxResponseBytes, though each part fits.
+	tr.maxResponseBytes = 70
+	resp := testRoundTrip(t, tr, upstream.URL, getLogs)
+	var errResp ErrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code != jsonRPCResponseLimit {
+		t.Errorf("expected response limit error, got: %+v %v", errResp, err)
+	}
+}
+
+func TestCapLogs(t *testing.T) {
+	getLogs := ModifiedRequest{ID: json.RawMessage(`1`), Path: "eth_getLogs"}
+	chainID := ModifiedRequest{ID: json.RawMessage(`2`), Path: "eth_chainId"}
+	for _, test := range []struct {
+		name     string
+		requests []ModifiedRequest
+		body     string
+		exp      string // empty if unchanged
+	}{
+		{"within limit", []ModifiedRequest{getLogs}, `{"jsonrpc":"2.0","id":1,"result":[{},{}]}`, ""},
+		{"over limit", []ModifiedRequest{getLogs}, `{"jsonrpc":"2.0","id":1,"result":[{},{},{}]}`,
+			`{"error":{"code":-32015,"message":"Query returned 3 logs, more than limit (2), try a narrower block range."},"id":1,"jsonrpc":"2.0"}`},
+		{"upstream error", []ModifiedRequest{getLogs}, `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"boom"}}`, ""},
+		{"other method", []ModifiedRequest{chainID}, `{"jsonrpc":"2.0","id":2,"result":"0x1"}`, ""},
+		{"batch", []ModifiedRequest{getLogs, chainID}, `[{"jsonrpc":"2.0","id":2,"result":"0x1"},{"jsonrpc":"2.0","id":1,"result":[{},{},{}]}]`,
+			`[{"id":2,"jsonrpc":"2.0","result":"0x1"},{"error":{"code":-32015,"message":"Query returned 3 logs, more than limit (2), try a narrower block range."},"id":1,"jsonrpc":"2.0"}]`},
+	} {
+		got, capped, err := capLogs([]byte(test.body), test.requests, 2)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.exp == "" {
+			if capped || string(got) != test.body {
+				t.Errorf("%s: expected body to be unchanged, got %s", test.name, got)
+			}
+			continue
+		}
+		if !capped || string(got) != test.exp {
+			t.Errorf("%s: expected %s but got %s", test.name, test.exp, got)
+		}
+	}
+}
@@ -4,30 +4,146 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	toml "github.com/pelletier/go-toml"
 	"github.com/rs/cors"
 	"github.com/treeder/gcputils"
 	"github.com/treeder/gotils/v2"
 	"github.com/urfave/cli/v2"
 )
 
-var requestsPerMinuteLimit int
+var (
+	requestLimit int // requests per rateWindow
+	rateWindow   = time.Minute
+	rateBurst    int // 0 means derived from requestLimit
+)
 
 type ConfigData struct {
 	Port            string   `toml:",omitempty"`
+	ListenAddr      string   `toml:",omitempty"` // host or IP the server binds to with Port, "" means all interfaces
 	URL             string   `toml:",omitempty"`
 	WSURL           string   `toml:",omitempty"`
 	Allow           []string `toml:",omitempty"`
+	Deny            []string `toml:",omitempty"` // methods rejected even if allowed, deny wins
 	RPM             int      `toml:",omitempty"`
 	NoLimit         []string `toml:",omitempty"`
+	AllowedIPs      []string `toml:",omitempty"` // IPs and CIDRs allowed to connect at all, others get 403, empty means all
 	BlockRangeLimit uint64   `toml:",omitempty"`
+
+	RateLimit            int               `toml:",omitempty"` // requests per RateWindow, RPM is shorthand for a 1m window
+	RateWindow           time.Duration     `toml:",omitempty"` // window RateLimit applies to, defaults to 1m
+	Burst                int               `toml:",omitempty"` // requests allowed at once, defaults to a tenth of the limit, at least 1
+	MaxConcurrentPerIP   int               `toml:",omitempty"` // in-flight requests per IP, 0 means none
+	DailyQuota           int               `toml:",omitempty"` // requests per IP per UTC day, on top of the rate limit, 0 means none
+	Keys                 []APIKey          `toml:",omitempty"` // API keys presented in X-API-Key, each with its own allowed methods and rate limit
+	RateLimitKey         string            `toml:",omitempty"` // template of {client}, {ip}, {method}, {key} and {subnet} the rate limiter keys on, defaults to {client}
+	RateLimitIPv4Prefix  int               `toml:",omitempty"` // prefix length IPv4 clients are rate limited by, e.g. 24 to share a limit per /24, defaults to 32
+	RateLimitIPv6Prefix  int               `toml:",omitempty"` // prefix length IPv6 clients are rate limited by, e.g. 64 to share a limit per /64, defaults to 128
+	ClientIDHeader       string            `toml:",omitempty"` // header identifying clients for {client}, trusted only from TrustedProxies, e.g. X-Consumer-ID
+	TrustedProxies       []string          `toml:",omitempty"` // IPs and CIDRs of the proxies allowed to set ClientIDHeader
+	LimitStateStore      string            `toml:",omitempty"` // file rate limiter state is saved to and restored from, "" means in-memory only
+	LimitStateInterval   time.Duration     `toml:",omitempty"` // how often rate limiter state is saved, defaults to 1m
+	RedisURL             string            `toml:",omitempty"` // Redis shared by replicas for rate limiting, e.g. redis://host:6379/0, "" means per replica
+	MaxTopicAlternatives int               `toml:",omitempty"` // OR-alternatives per eth_getLogs and logs subscription topic position, 0 means none
+	MaxLogAddresses      int               `toml:",omitempty"` // addresses per eth_getLogs and logs subscription filter, 0 means none
+	MaxLogResults        int               `toml:",omitempty"` // logs per eth_getLogs or eth_getFilterLogs result, larger results are replaced by an error, 0 means none
+	AllowSubscriptions   []string          `toml:",omitempty"` // eth_subscribe types clients may request, empty means all
+	DenySubscriptions    []string          `toml:",omitempty"` // eth_subscribe types rejected, wins over AllowSubscriptions
+	MaxCallGas           uint64            `toml:",omitempty"` // gas of eth_call, eth_estimateGas and eth_createAccessList, 0 means none
+	MaxCallDataBytes     int               `toml:",omitempty"` // bytes of the data of eth_call, eth_estimateGas and eth_createAccessList, 0 means none
+	AllowSendTransaction bool              `toml:",omitempty"` // forward eth_sendTransaction instead of rejecting it
+	ReadOnly             bool              `toml:",omitempty"` // start in read-only mode, rejecting transactions, toggled at runtime with PUT /admin/readonly
+	BlockedSenders       []string          `toml:",omitempty"` // addresses whose eth_sendRawTransaction calls are rejected
+	MinGasPrice          uint64            `toml:",omitempty"` // eth_sendRawTransaction gas price floor in wei, 0 means none
+	MaxBatchSize         int               `toml:",omitempty"` // requests per batch, 0 means none
+	MaxBlockTags         int               `toml:",omitempty"` // "latest", "pending", "safe" or "finalized" block tags (or omitted block params) per request or batch, 0 means none
+	MinParams            map[string]int    `toml:",omitempty"` // method -> minimum params, overriding the built-in ones, 0 removes one
+	MethodCosts          map[string]int    `toml:",omitempty"` // method -> rate limit tokens a request takes, overriding the built-in ones, 0 removes one, unlisted methods take 1
+	Deprecations         map[string]string `toml:",omitempty"` // method -> sunset date (YYYY-MM-DD), forwarded with a warning until then and rejected after
+
+	WSFailoverURLs        []string      `toml:",omitempty"` // backup websocket urls, tried in order
+	MaxWSConnections      int64         `toml:",omitempty"` // live websocket connections, 0 means none
+	MaxWSConnectionsPerIP int           `toml:",omitempty"` // live websocket connections per IP, 0 means none
+	WSMessagesPerMinute   int           `toml:",omitempty"` // messages per minute on a single websocket connection, 0 means none
+	WSMaxViolations       int           `toml:",omitempty"` // rate limited messages before closing a websocket connection, 0 means never
+	WSLogDropped          bool          `toml:",omitempty"` // log each dropped websocket message with its reason
+	WSViolationCloseCode  int           `toml:",omitempty"` // close code sent after WSMaxViolations, e.g. 4429, defaults to 1008 (policy violation)
+	WSPingInterval        time.Duration `toml:",omitempty"` // how often websocket clients are pinged, 0 means never
+	WSPongTimeout         time.Duration `toml:",omitempty"` // how long to wait for a pong before disconnecting, defaults to WSPingInterval
+	WSIdleTimeout         time.Duration `toml:",omitempty"` // close websocket connections without messages for this long, 0 means never
+	WSReconnectTimeout    time.Duration `toml:",omitempty"` // keep client websocket connections open while reconnecting to the backend for up to this long, 0 means never reconnect
+	WSBridgeInterval      time.Duration `toml:",omitempty"` // without WSURL, emulate newHeads and logs subscriptions by polling URL this often, 0 means off
+
+	Routes                 map[string]string          `toml:",omitempty"` // method -> upstream url, others go to URL
+	ArchiveURL             string                     `toml:",omitempty"` // upstream for requests for blocks older than ArchiveDepth
+	ArchiveDepth           uint64                     `toml:",omitempty"` // blocks behind head served by ArchiveURL, defaults to 128
+	ShadowURL              string                     `toml:",omitempty"` // upstream a sample of idempotent requests is mirrored to, responses are only compared and logged
+	ShadowSampleRate       float64                    `toml:",omitempty"` // fraction of idempotent requests mirrored to ShadowURL, 0 means none
+	StripResponseHeaders   []string                   `toml:",omitempty"` // upstream response headers removed before responding
+	AllowResponseHeaders   []string                   `toml:",omitempty"` // if set, only these upstream response headers are passed through
+	ForwardHeaders         []string                   `toml:",omitempty"` // client headers forwarded upstream besides Content-Type, Accept and the like, never credentials
+	UpstreamHeaders        map[string]string          `toml:",omitempty"` // headers added to every upstream request, e.g. credentials
+	WaitForUpstream        bool                       `toml:",omitempty"` // answer RPC requests and websocket handshakes with 503 until the upstream first responds, e.g. while the node starts
+	UpstreamTimeout        time.Duration              `toml:",omitempty"` // timeout for forwarded requests, defaults to 30s
+	MethodTimeouts         map[string]time.Duration   `toml:",omitempty"` // method -> timeout, overriding UpstreamTimeout
+	MaxIdleConns           int                        `toml:",omitempty"` // idle upstream connections kept for reuse, across hosts, 0 means 100
+	MaxIdleConnsPerHost    int                        `toml:",omitempty"` // idle connections kept per upstream host, 0 means 2, raise it for busy upstreams
+	MaxConnsPerHost        int                        `toml:",omitempty"` // connections per upstream host, including active ones, 0 means none
+	IdleConnTimeout        time.Duration              `toml:",omitempty"` // how long idle upstream connections are kept, 0 means 90s
+	FlushInterval          time.Duration              `toml:",omitempty"` // flush responses to clients this often while copying them, 0 means once done, negative means after every write
+	PreserveRequestPath    *bool                      `toml:",omitempty"` // append the request path to the url path, defaults to true
+	MaxResponseBytes       int64                      `toml:",omitempty"` // max upstream response size, 0 means none
+	MaxBatchResponseBytes  int64                      `toml:",omitempty"` // max combined upstream response size of a batch, 0 means none
+	StreamResponses        bool                       `toml:",omitempty"` // relay responses limited only by MaxResponseBytes as they arrive, cutting off any found too large midway
+	GzipMinBytes           int                        `toml:",omitempty"` // gzip responses at least this large for clients accepting it, 0 means never
+	RequireJSONContentType bool                       `toml:",omitempty"` // reject RPC POSTs without Content-Type: application/json with 415
+	AllowRPCGet            bool                       `toml:",omitempty"` // accept GET as well as POST on the RPC path, others get 405
+	RPCGetQuery            bool                       `toml:",omitempty"` // with AllowRPCGet, turn GETs with method, params and id in the query into JSON-RPC calls
+	IDType                 string                     `toml:",omitempty"` // "number" or "string" rewrites request ids to that type for the upstream, restoring them in responses, "" passes them through
+	FillEmptyParams        bool                       `toml:",omitempty"` // send "params": [] for requests which omit params or set them to null, for nodes which reject those
+	MaxURLBytes            int                        `toml:",omitempty"` // longer request urls, including the query, get 414, defaults to 8192
+	MaxRetries             int                        `toml:",omitempty"` // retries of idempotent requests on transient upstream failures
+	RetryBackoff           time.Duration              `toml:",omitempty"` // delay before the first retry, doubled after each, defaults to 100ms
+	DedupRequests          bool                       `toml:",omitempty"` // share one upstream request between identical concurrent read-only requests
+	Transforms             map[string]TransformConfig `toml:",omitempty"` // method -> request and response transforms
+
+	BreakerErrorRatio  float64       `toml:",omitempty"` // upstream failure ratio which opens the circuit breaker, 0 means disabled
+	BreakerMinRequests int           `toml:",omitempty"` // requests before the failure ratio is evaluated, defaults to 20
+	BreakerCooldown    time.Duration `toml:",omitempty"` // time the breaker stays open before probing, defaults to 30s
+	RetryAfter         time.Duration `toml:",omitempty"` // base Retry-After when the upstream is unavailable, defaults to 5s
+
+	EnableCache          bool                     `toml:",omitempty"` // cache responses according to Cache and the built-in policies
+	CacheSize            int                      `toml:",omitempty"` // max cached responses, defaults to 10000
+	FinalityDepth        uint64                   `toml:",omitempty"` // blocks behind head considered final, defaults to 64
+	Cache                map[string]CachePolicy   `toml:",omitempty"` // per-method cache policies, overriding the built-in ones
+	CacheTTL             map[string]time.Duration `toml:",omitempty"` // method -> TTL, if set only these methods are cached, 0 means never
+	FinalizedCacheMaxAge time.Duration            `toml:",omitempty"` // max age of cached finalized responses, regardless of TTL, 0 means none
+	ErrorCacheTTL        time.Duration            `toml:",omitempty"` // how long upstream errors of read-only requests are served from cache, 0 means never
+
+	SplitLogQueriesAtFinality bool `toml:",omitempty"` // serve the finalized part of eth_getLogs from cache
+	InvalidateCacheOnReorg    bool `toml:",omitempty"` // drop cached responses for blocks replaced by a reorg
+
+	HeadPollInterval  time.Duration `toml:",omitempty"` // how often to poll upstream for a new head, 0 means on demand only
+	RefreshOnNewHead  []string      `toml:",omitempty"` // cached methods re-fetched on each new head, requires HeadPollInterval or SubscribeNewHeads
+	SubscribeNewHeads bool          `toml:",omitempty"` // drop cached responses which follow the head on each newHeads notification from WSURL
+	SyncingInterval   time.Duration `toml:",omitempty"` // how often to probe upstream eth_syncing, reads are rejected while it is syncing, 0 disables
+
+	AdminToken  string `toml:",omitempty"` // bearer token for the /admin endpoints, "" disables them
+	EnablePprof bool   `toml:",omitempty"` // serve net/http/pprof profiles under /debug/pprof to admin requests, requires AdminToken
+
+	InstanceName          string `toml:",omitempty"` // value of the X-rpc-proxy response header, defaults to rpc-proxy
+	DisableInstanceHeader bool   `toml:",omitempty"` // omit the X-rpc-proxy response header
+
+	OTLPEndpoint string `toml:",omitempty"` // OTLP/HTTP collector spans are exported to, e.g. http://collector:4318, "" disables tracing
 }
 
 func main() {
@@ -40,8 +156,11 @@ func main() {
 	var redirecturl string
 	var redirectWSUrl string
 	var allowedPaths string
+	var deniedPaths string
 	var noLimitIPs string
 	var blockRangeLimit uint64
+	var rpm int
+	var printConfig bool
 
 	app := cli.NewApp()
 	app.Name = "rpc-proxy"
@@ -51,7 +170,7 @@ func main() {
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
 			Name:        "config, c",
-			Usage:       "path to toml config file",
+			Usage:       "path or http(s) url of a toml or yaml config file",
 			Destination: &configPath,
 		},
 		&cli.StringFlag{
@@ -77,11 +196,16 @@ func main() {
 			Usage:       "comma separated list of allowed paths",
 			Destination: &allowedPaths,
 		},
+		&cli.StringFlag{
+			Name:        "deny",
+			Usage:       "comma separated list of denied paths, overriding allow",
+			Destination: &deniedPaths,
+		},
 		&cli.IntFlag{
 			Name:        "rpm",
 			Value:       1000,
 			Usage:       "limit for number of requests per minute from single IP",
-			Destination: &requestsPerMinuteLimit,
+			Destination: &rpm,
 		},
 		&cli.StringFlag{
 			Name:        "nolimit, n",
@@ -93,93 +217,197 @@ func main() {
 			Usage:       "block range query limit",
 			Destination: &blockRangeLimit,
 		},
+		&cli.BoolFlag{
+			Name:        "print-config",
+			Usage:       "print the merged config as toml, with secrets redacted, and exit",
+			Destination: &printConfig,
+		},
 	}
 
-	app.Action = func(c *cli.Context) error {
+	mergeConfig := func(c *cli.Context) (ConfigData, error) {
 		var cfg ConfigData
 		if configPath != "" {
-			t, err := toml.LoadFile(configPath)
-			if err != nil {
-				return err
-			}
-			if err := t.Unmarshal(&cfg); err != nil {
-				return err
+			if err := loadConfig(ctx, configPath, &cfg); err != nil {
+				return cfg, err
 			}
 		}
 
-		if port != "" {
+		if c.IsSet("port") {
 			if cfg.Port != "" {
-				return errors.New("port set in two places")
+				return cfg, errors.New("port set in two places")
 			}
 			cfg.Port = port
 		}
-		if redirecturl != "" {
+		if c.IsSet("url") {
 			if cfg.URL != "" {
-				return errors.New("url set in two places")
+				return cfg, errors.New("url set in two places")
 			}
 			cfg.URL = redirecturl
 		}
-		if redirectWSUrl != "" {
+		if c.IsSet("wsurl") {
 			if cfg.WSURL != "" {
-				return errors.New("ws url set in two places")
+				return cfg, errors.New("ws url set in two places")
 			}
 			cfg.WSURL = redirectWSUrl
 		}
-		if requestsPerMinuteLimit != 0 {
+		if c.IsSet("rpm") {
 			if cfg.RPM != 0 {
-				return errors.New("rpm set in two places")
+				return cfg, errors.New("rpm set in two places")
 			}
-			cfg.RPM = requestsPerMinuteLimit
+			cfg.RPM = rpm
 		}
 		if allowedPaths != "" {
 			if len(cfg.Allow) > 0 {
-				return errors.New("allow set in two places")
+				return cfg, errors.New("allow set in two places")
 			}
 			cfg.Allow = strings.Split(allowedPaths, ",")
 		}
+		if deniedPaths != "" {
+			if len(cfg.Deny) > 0 {
+				return cfg, errors.New("deny set in two places")
+			}
+			cfg.Deny = strings.Split(deniedPaths, ",")
+		}
 		if noLimitIPs != "" {
 			if len(cfg.NoLimit) > 0 {
-				return errors.New("nolimit set in two places")
+				return cfg, errors.New("nolimit set in two places")
 			}
 			cfg.NoLimit = strings.Split(noLimitIPs, ",")
 		}
 		if blockRangeLimit > 0 {
 			if cfg.BlockRangeLimit > 0 {
-				return errors.New("block range limit set in two places")
+				return cfg, errors.New("block range limit set in two places")
 			}
 			cfg.BlockRangeLimit = blockRangeLimit
 		}
 
-		return cfg.run(ctx)
+		// Environment variables have the lowest precedence, and only fill
+		// values which were not set by the config file or flags.
+		if err := cfg.loadEnv(os.LookupEnv); err != nil {
+			return cfg, err
+		}
+
+		// Fall back to flag defaults.
+		if cfg.Port == "" {
+			cfg.Port = port
+		}
+		if cfg.URL == "" {
+			cfg.URL = redirecturl
+		}
+		if cfg.WSURL == "" && cfg.WSBridgeInterval <= 0 {
+			cfg.WSURL = redirectWSUrl
+		}
+		if cfg.RateLimit == 0 {
+			if cfg.RateWindow != 0 {
+				return cfg, errors.New("rate window set without rate limit")
+			}
+			if cfg.RPM == 0 {
+				cfg.RPM = rpm
+			}
+			cfg.RateLimit, cfg.RateWindow = cfg.RPM, time.Minute
+		} else if cfg.RPM != 0 {
+			return cfg, errors.New("rpm and rate limit both set")
+		}
+		if cfg.RateWindow == 0 {
+			cfg.RateWindow = time.Minute
+		}
+		if cfg.UpstreamTimeout == 0 {
+			cfg.UpstreamTimeout = 30 * time.Second
+		}
+
+		return cfg, nil
+	}
+
+	var serving bool
+	app.Action = func(c *cli.Context) error {
+		cfg, err := mergeConfig(c)
+		if err != nil {
+			return err
+		}
+		if printConfig {
+			return cfg.print(os.Stdout)
+		}
+		serving = true
+		return cfg.run(ctx, func() (ConfigData, error) { return mergeConfig(c) })
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:  "validate",
+			Usage: "check the config and report every problem found, without starting the server",
+			Action: func(c *cli.Context) error {
+				cfg, err := mergeConfig(c)
+				if err != nil {
+					return cli.Exit(fmt.Sprintf("Invalid config: %v", err), 1)
+				}
+				errs := cfg.validate()
+				if len(errs) == 0 {
+					fmt.Println("Config is valid")
+					return nil
+				}
+				fmt.Printf("Config has %d problem(s):\n", len(errs))
+				for _, err := range errs {
+					fmt.Printf("  - %v\n", err)
+				}
+				return cli.Exit("", 1)
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		gotils.L(ctx).Error().Printf("Fatal error: %v", err)
 		return
 	}
-	gotils.L(ctx).Info().Print("Shutting down")
+	if serving {
+		gotils.L(ctx).Info().Print("Shutting down")
+	}
 }
 
-func (cfg *ConfigData) run(ctx context.Context) error {
+// run serves cfg until the server fails. On SIGHUP, the config is merged again
+// with reload and the new rate limit applied.
+func (cfg *ConfigData) run(ctx context.Context, reload func() (ConfigData, error)) error {
+	requestLimit, rateWindow, rateBurst = cfg.RateLimit, cfg.RateWindow, cfg.Burst
 	sort.Strings(cfg.Allow)
 	sort.Strings(cfg.NoLimit)
+	addr, err := listenAddress(cfg.ListenAddr, cfg.Port)
+	if err != nil {
+		return err
+	}
 
-	gotils.L(ctx).Info().Println("Server starting, port:", cfg.Port, "redirectURL:", cfg.URL, "redirectWSURL:", cfg.WSURL,
-		"rpmLimit:", cfg.RPM, "exempt:", cfg.NoLimit, "allowed:", cfg.Allow)
+	gotils.L(ctx).Info().Println("Server starting, addr:", addr, "redirectURL:", cfg.URL, "redirectWSURL:", cfg.WSURL,
+		"rateLimit:", cfg.RateLimit, "rateWindow:", cfg.RateWindow, "exempt:", cfg.NoLimit, "allowed:", cfg.Allow)
+
+	if cfg.OTLPEndpoint != "" {
+		shutdown, err := initTracing(ctx, cfg.OTLPEndpoint)
+		if err != nil {
+			return fmt.Errorf("failed to initialize tracing: %s", err)
+		}
+		defer shutdown(context.Background())
+	}
 
 	// Create proxy server.
 	server, err := cfg.NewServer()
 	if err != nil {
 		return fmt.Errorf("failed to start server: %s", err)
 	}
+	defer server.Close()
+	go server.reloadOnHangup(ctx, reload)
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Recoverer)
-	// Use default options
+	maxURLBytes := cfg.MaxURLBytes
+	if maxURLBytes <= 0 {
+		maxURLBytes = defaultMaxURLBytes
+	}
+	r.Use(limitURLLength(maxURLBytes))
+	if len(server.allowedIPs) > 0 {
+		r.Use(allowIPs(server.allowedIPs, server.trustedProxies))
+	}
+	// Only advertise the methods the RPC path accepts.
 	r.Use(cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedMethods:   append([]string{http.MethodOptions}, server.rpcMethods...),
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: false,
 		MaxAge:           3600,
@@ -189,6 +417,15 @@ func (cfg *ConfigData) run(ctx context.Context) error {
 	r.Head("/", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	r.Get("/admin/config", server.AdminConfig)
+	r.Get("/admin/status", server.AdminStatus)
+	r.Get("/admin/metrics", server.AdminMetrics)
+	r.Put("/admin/readonly", server.AdminReadOnly)
+	r.Put("/admin/cache/{method}", server.AdminCacheMethod)
+	r.Delete("/admin/cache", server.AdminFlushCache)
+	if cfg.EnablePprof {
+		r.Mount("/debug", server.pprofHandler())
+	}
 	r.Get("/x/{method}", server.Example)
 	r.Get("/x/{method}/{arg}", server.Example)
 	r.Get("/x/{method}/{arg}/{arg2}", server.Example)
@@ -204,5 +441,39 @@ func (cfg *ConfigData) run(ctx context.Context) error {
 	})
 	r.HandleFunc("/*", server.RPCProxy)
 	r.HandleFunc("/ws", server.WSProxy)
-	return http.ListenAndServe(":"+cfg.Port, r)
+	return serve(ctx, &http.Server{Addr: addr, Handler: r})
+}
+
+// shutdownTimeout is how long requests in flight get to finish on SIGINT or
+// SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+// serve serves srv until it fails, or until the process gets SIGINT or SIGTERM,
+// when it shuts down gracefully so that deferred cleanup, such as saving the
+// rate limiter state, runs.
+func serve(ctx context.Context, srv *http.Server) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		gotils.L(ctx).Info().Println("Received", s, "shutting down")
+	}
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// listenAddress returns the address to listen on, on all interfaces when host
+// is empty, or an error if it isn't a valid TCP address.
+func listenAddress(host, port string) (string, error) {
+	addr := net.JoinHostPort(host, port)
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	return addr, nil
 }
@@ -2,30 +2,70 @@ package main
 
 import (
 	"regexp"
+	"strings"
 )
 
-type matcher []*regexp.Regexp
+// matcher matches methods against the allow and deny rules. Deny wins.
+type matcher struct {
+	allow, deny []*regexp.Regexp
+}
 
 func (m matcher) MatchAnyRule(method string) bool {
 	if method == "" {
 		return false
 	}
-	for _, matcher := range m {
-		if matcher.MatchString(method) {
+	if matchAny(m.deny, method) {
+		return false
+	}
+	return matchAny(m.allow, method)
+}
+
+func matchAny(rules []*regexp.Regexp, method string) bool {
+	for _, rule := range rules {
+		if rule.MatchString(method) {
 			return true
 		}
 	}
 	return false
 }
 
-func newMatcher(rules []string) (matcher, error) {
+// newMatcher compiles the allow and deny rules, which are regular
+// expressions, except for namespace wildcards like "eth_*" which match every
+// method with the prefix before the "*".
+func newMatcher(allow []string, deny ...string) (matcher, error) {
 	var m matcher
+	var err error
+	if m.allow, err = compileRules(allow); err != nil {
+		return matcher{}, err
+	}
+	if m.deny, err = compileRules(deny); err != nil {
+		return matcher{}, err
+	}
+	return m, nil
+}
+
+func compileRules(rules []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
 	for _, p := range rules {
-		compiled, err := regexp.Compile(p)
+		if prefix, ok := wildcardPrefix(p); ok {
+			compiled = append(compiled, regexp.MustCompile("^"+regexp.QuoteMeta(prefix)))
+			continue
+		}
+		c, err := regexp.Compile(p)
 		if err != nil {
 			return nil, err
 		}
-		m = append(m, compiled)
+		compiled = append(compiled, c)
 	}
-	return m, nil
+	return compiled, nil
+}
+
+// wildcardPrefix returns the prefix of a rule which is a plain method prefix
+// followed by a single trailing "*".
+func wildcardPrefix(rule string) (string, bool) {
+	prefix := strings.TrimSuffix(rule, "*")
+	if prefix == rule || prefix == "" || strings.ContainsAny(prefix, `\.+*?()|[]{}^$`) {
+		return "", false
+	}
+	return prefix, true
 }
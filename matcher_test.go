@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	m, err := newMatcher([]string{"eth_*", "net_version", "web3_clientVersion", "debug_trace.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method string
+		exp    bool
+	}{
+		{"eth_call", true},
+		{"eth_getLogs", true},
+		{"eth_", true},
+		{"net_version", true},
+		{"net_listening", false},
+		{"web3_clientVersion", true},
+		{"debug_traceTransaction", true},
+		{"debug_getBadBlocks", false},
+		{"ETH_call", false},
+		{"myeth_call", false},
+		{"personal_sign", false},
+		{"", false},
+	} {
+		if got := m.MatchAnyRule(test.method); got != test.exp {
+			t.Errorf("%q: expected %t but got %t", test.method, test.exp, got)
+		}
+	}
+}
+
+func TestWildcardPrefix(t *testing.T) {
+	for _, test := range []struct {
+		rule, prefix string
+		ok           bool
+	}{
+		{"eth_*", "eth_", true},
+		{"net*", "net", true},
+		{"eth_call", "", false},
+		{"*", "", false},
+		{"eth_.*", "", false},
+		{"eth_**", "", false},
+	} {
+		prefix, ok := wildcardPrefix(test.rule)
+		if prefix != test.prefix || ok != test.ok {
+			t.Errorf("%q: expected %q %t but got %q %t", test.rule, test.prefix, test.ok, prefix, ok)
+		}
+	}
+}
+
+func TestMatcher_deny(t *testing.T) {
+	m, err := newMatcher([]string{"eth_*", "net_version"}, "eth_sendTransaction", "eth_sign*", "net_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method string
+		exp    bool
+	}{
+		{"eth_call", true},
+		{"eth_sendRawTransaction", true},
+		{"eth_sendTransaction", false},
+		{"eth_sign", false},
+		{"eth_signTypedData_v4", false},
+		{"net_version", false},
+	} {
+		if got := m.MatchAnyRule(test.method); got != test.exp {
+			t.Errorf("%q: expected %t but got %t", test.method, test.exp, got)
+		}
+	}
+	if _, err := newMatcher(nil, "("); err == nil {
+		t.Error("expected error for invalid deny rule")
+	}
+}
+
+func TestMatcher_overlap(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		allow, deny []string
+		method      string
+		exp         bool
+	}{
+		{"wildcard allow, exact deny", []string{"eth_*"}, []string{"eth_call"}, "eth_call", false},
+		{"wildcard allow, exact deny, other method", []string{"eth_*"}, []string{"eth_call"}, "eth_getBalance", true},
+		{"exact allow, wildcard deny", []string{"eth_call"}, []string{"eth_*"}, "eth_call", false},
+		{"exact allow, wildcard deny, other namespace", []string{"eth_call", "net_version"}, []string{"eth_*"}, "net_version", true},
+	} {
+		m, err := newMatcher(test.allow, test.deny...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.MatchAnyRule(test.method); got != test.exp {
+			t.Errorf("%s: %q: expected %t but got %t", test.name, test.method, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// AdminMetrics serves metrics in the Prometheus text format to requests
+// bearing the admin token.
+func (p *Server) AdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if p.cache == nil {
+		return
+	}
+	if err := writeCacheMetrics(w, p.cache.statsSnapshot()); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve metrics: %v", err)
+	}
+}
+
+// writeCacheMetrics writes a counter per method for each of cache hits,
+// misses and evictions.
+func writeCacheMetrics(w io.Writer, stats map[string]cacheStats) error {
+	methods := make([]string, 0, len(stats))
+	for m := range stats {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, metric := range []struct {
+		name, help string
+		value      func(cacheStats) uint64
+	}{
+		{"rpc_proxy_cache_hits_total", "Responses served from the cache.", func(s cacheStats) uint64 { return s.Hits }},
+		{"rpc_proxy_cache_misses_total", "Cacheable responses not found in the cache.", func(s cacheStats) uint64 { return s.Misses }},
+		{"rpc_proxy_cache_evictions_total", "Cached responses evicted to make room.", func(s cacheStats) uint64 { return s.Evictions }},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name); err != nil {
+			return err
+		}
+		for _, m := range methods {
+			if _, err := fmt.Fprintf(w, "%s{method=%q} %d\n", metric.name, m, metric.value(stats[m])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
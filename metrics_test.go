@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteCacheMetrics(t *testing.T) {
+	var sb strings.Builder
+	err := writeCacheMetrics(&sb, map[string]cacheStats{
+		"eth_getLogs": {Hits: 1, Misses: 2},
+		"eth_call":    {Hits: 3, Evictions: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `# HELP rpc_proxy_cache_hits_total Responses served from the cache.
+# TYPE rpc_proxy_cache_hits_total counter
+rpc_proxy_cache_hits_total{method="eth_call"} 3
+rpc_proxy_cache_hits_total{method="eth_getLogs"} 1
+# HELP rpc_proxy_cache_misses_total Cacheable responses not found in the cache.
+# TYPE rpc_proxy_cache_misses_total counter
+rpc_proxy_cache_misses_total{method="eth_call"} 0
+rpc_proxy_cache_misses_total{method="eth_getLogs"} 2
+# HELP rpc_proxy_cache_evictions_total Cached responses evicted to make room.
+# TYPE rpc_proxy_cache_evictions_total counter
+rpc_proxy_cache_evictions_total{method="eth_call"} 4
+rpc_proxy_cache_evictions_total{method="eth_getLogs"} 0
+`
+	if got := sb.String(); got != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
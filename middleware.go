@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// defaultMaxURLBytes is the default cap on request URL length.
+const defaultMaxURLBytes = 8 << 10
+
+// limitURLLength rejects requests whose URL, including the query string, is
+// longer than max bytes with 414 before they are routed.
+func limitURLLength(max int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.RequestURI) > max {
+				http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipSet is a list of IP networks. Single IPs are stored as /32 or /128
+// networks.
+type ipSet []*net.IPNet
+
+// parseIPSet parses entries which are each an IP or a CIDR.
+func parseIPSet(entries []string) (ipSet, error) {
+	var set ipSet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, n)
+			continue
+		}
+		ip := net.ParseIP(normalizeIP(e))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %q", e)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return set, nil
+}
+
+// contains returns true if ip, as returned by getIP, is in one of the
+// networks.
+func (s ipSet) contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range s {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP of the client which sent r. Forwarding headers are
+// only believed when the request arrived from one of trusted, since anyone
+// else can set them.
+func peerIP(r *http.Request, trusted ipSet) string {
+	if remote := normalizeIP(r.RemoteAddr); !trusted.contains(remote) {
+		return remote
+	}
+	return getIP(r)
+}
+
+// allowIPs rejects requests from clients outside allowed with 403 before
+// they are routed. Forwarding headers are only honoured from trusted proxies.
+func allowIPs(allowed, trusted ipSet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := peerIP(r, trusted); !allowed.contains(ip) {
+				gotils.L(r.Context()).Info().Printf("Request blocked: IP not allowed: %s", ip)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
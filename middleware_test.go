@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitURLLength(t *testing.T) {
+	h := limitURLLength(32)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		url string
+		exp int
+	}{
+		{"/", http.StatusOK},
+		{"/?q=" + strings.Repeat("a", 28), http.StatusOK},
+		{"/?q=" + strings.Repeat("a", 29), http.StatusRequestURITooLong},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.url, nil))
+		if rec.Code != test.exp {
+			t.Errorf("%d byte url: expected status %d but got %d", len(test.url), test.exp, rec.Code)
+		}
+	}
+}
+
+func TestAllowIPs(t *testing.T) {
+	allowed, err := parseIPSet([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parseIPSet([]string{"172.16.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := allowIPs(allowed, trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  string // X-Forwarded-For
+		exp        int
+	}{
+		{"10.1.2.3:1234", "", http.StatusOK},
+		{"192.168.1.1:1234", "", http.StatusOK},
+		{"[::1]:1234", "", http.StatusOK},
+		{"[::ffff:10.0.0.1]:1234", "", http.StatusOK},
+		{"192.168.1.2:1234", "", http.StatusForbidden},
+		{"11.0.0.1:1234", "", http.StatusForbidden},
+		// Spoofed headers from untrusted clients are ignored.
+		{"11.0.0.1:1234", "10.0.0.1", http.StatusForbidden},
+		{"10.1.2.3:1234", "11.0.0.1", http.StatusOK},
+		// A trusted proxy's headers are believed.
+		{"172.16.0.1:1234", "10.0.0.1", http.StatusOK},
+		{"172.16.0.1:1234", "11.0.0.1, 10.0.0.1", http.StatusForbidden},
+		{"172.16.0.1:1234", "", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.exp {
+			t.Errorf("%s forwarded for %q: expected status %d but got %d", test.remoteAddr, test.forwarded, test.exp, rec.Code)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseIPSet([]string{invalid}); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
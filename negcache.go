@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// errorKeyPrefix keeps cached errors apart from cached results.
+const errorKeyPrefix = "\x01error\x00"
+
+// uncachedErrorCodes are upstream error codes which depend on the client or
+// the upstream's load rather than the request, so are never cached. Some
+// providers use HTTP status codes for auth and rate limit errors.
+var uncachedErrorCodes = map[int]struct{}{
+	-32002: {}, // Resource unavailable.
+	-32005: {}, // Limit exceeded.
+	401:    {}, // Unauthorized.
+	403:    {}, // Forbidden.
+	429:    {}, // Too many requests.
+}
+
+// uncachedErrorMessages are substrings of auth and rate limit error messages
+// sent with generic codes, such as -32000, which are never cached either.
+var uncachedErrorMessages = []string{"unauthorized", "forbidden", "rate limit", "too many requests"}
+
+// errorCacheable returns the key the upstream error for parsedRequests is
+// cached under, if errors may be cached for it. Only single requests for
+// idempotent methods are.
+func (t *myTransport) errorCacheable(parsedRequests []ModifiedRequest) (string, bool) {
+	if t.cache == nil || t.errorCacheTTL <= 0 || len(parsedRequests) != 1 {
+		return "", false
+	}
+	request := parsedRequests[0]
+	if _, ok := idempotentMethods[request.Path]; !ok || !t.cache.enabled(request.Path) {
+		return "", false
+	}
+	key, err := cacheKey(request, t.cachePolicies[request.Path].NormalizeParams)
+	if err != nil {
+		return "", false
+	}
+	return errorKeyPrefix + key, true
+}
+
+// cacheError returns the error of a JSON-RPC response body, or nil if it
+// has none or it should not be cached.
+func cacheError(body []byte) json.RawMessage {
+	var r struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil || len(r.Error) == 0 || string(r.Error) == "null" {
+		return nil
+	}
+	var e struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(r.Error, &e); err != nil {
+		return nil
+	}
+	if _, ok := uncachedErrorCodes[e.Code]; ok {
+		return nil
+	}
+	msg := strings.ToLower(e.Message)
+	for _, s := range uncachedErrorMessages {
+		if strings.Contains(msg, s) {
+			return nil
+		}
+	}
+	return r.Error
+}
+
+// cachedErrorResponse returns a JSON-RPC response for id with a cached error.
+func cachedErrorResponse(id json.RawMessage, e json.RawMessage) interface{} {
+	return struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Error   json.RawMessage `json:"error"`
+	}{Version: "2.0", ID: responseID(id), Error: e}
+}
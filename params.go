@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+)
+
+// defaultMinParams are the minimum numbers of params of common methods. Calls
+// with fewer are rejected rather than forwarded.
+var defaultMinParams = map[string]int{
+	"eth_call":                                1,
+	"eth_createAccessList":                    1,
+	"eth_estimateGas":                         1,
+	"eth_getBalance":                          1,
+	"eth_getBlockByHash":                      2,
+	"eth_getBlockByNumber":                    2,
+	"eth_getBlockTransactionCountByHash":      1,
+	"eth_getBlockTransactionCountByNumber":    1,
+	"eth_getCode":                             1,
+	"eth_getLogs":                             1,
+	"eth_getStorageAt":                        2,
+	"eth_getTransactionByBlockHashAndIndex":   2,
+	"eth_getTransactionByBlockNumberAndIndex": 2,
+	"eth_getTransactionByHash":                1,
+	"eth_getTransactionCount":                 1,
+	"eth_getTransactionReceipt":               1,
+	"eth_sendRawTransaction":                  1,
+}
+
+// minParams returns the built-in minimums overridden by configured ones. A
+// configured minimum of 0 removes the requirement.
+func minParams(configured map[string]int) (map[string]int, error) {
+	ms := make(map[string]int, len(defaultMinParams)+len(configured))
+	for m, n := range defaultMinParams {
+		ms[m] = n
+	}
+	for m, n := range configured {
+		if n < 0 {
+			return nil, fmt.Errorf("min params for %s: must not be negative", m)
+		}
+		if n == 0 {
+			delete(ms, m)
+			continue
+		}
+		ms[m] = n
+	}
+	return ms, nil
+}
+
+func jsonRPCMissingParams(id json.RawMessage, method string, min int) interface{} {
+	return jsonRPCError(id, jsonRPCInvalidParams, fmt.Sprintf("Missing params: %s requires at least %d", method, min))
+}
+
+// fillParams sets params to an empty array in the requests in the body of req
+// which omit them or set them to null, since some nodes reject those even for
+// methods without params. Methods requiring params were already rejected with
+// a missing params error.
+func fillParams(req *http.Request) error {
+	return rewriteRequests(req, func(reqs []map[string]json.RawMessage) (bool, error) {
+		var filled bool
+		for _, r := range reqs {
+			if p, ok := r["params"]; !ok || bytes.Equal(bytes.TrimSpace(p), []byte("null")) {
+				r["params"] = json.RawMessage("[]")
+				filled = true
+			}
+		}
+		return filled, nil
+	})
+}
+
+// paramValidator returns an error if params are invalid for its method.
+type paramValidator func(params []json.RawMessage) error
+
+// defaultParamValidators are the validators registered for every transport.
+var defaultParamValidators = map[string]paramValidator{
+	"eth_call":                callParams,
+	"eth_createAccessList":    callParams,
+	"eth_estimateGas":         callParams,
+	"eth_getBalance":          blockParams(hexAddr, hexNumOrLatest),
+	"eth_getCode":             blockParams(hexAddr, hexNumOrLatest),
+	"eth_getTransactionCount": blockParams(hexAddr, hexNumOrLatest),
+	"eth_getStorageAt":        blockParams(hexAddr, hexNumOrZero, hexNumOrLatest),
+}
+
+// newParamValidators returns a registry holding the default validators.
+func newParamValidators() map[string]paramValidator {
+	vs := make(map[string]paramValidator, len(defaultParamValidators))
+	for m, v := range defaultParamValidators {
+		vs[m] = v
+	}
+	return vs
+}
+
+// registerValidator adds v to the validators of method. Every registered
+// validator must accept the params for the request to be forwarded.
+func (t *myTransport) registerValidator(method string, v paramValidator) {
+	if t.validators == nil {
+		t.validators = make(map[string]paramValidator)
+	}
+	prev, ok := t.validators[method]
+	if !ok {
+		t.validators[method] = v
+		return
+	}
+	t.validators[method] = func(params []json.RawMessage) error {
+		if err := prev(params); err != nil {
+			return err
+		}
+		return v(params)
+	}
+}
+
+// validateParams returns an error describing why the params of request are
+// invalid, if they are.
+func (t *myTransport) validateParams(request ModifiedRequest) error {
+	v, ok := t.validators[request.Path]
+	if !ok {
+		return nil
+	}
+	return v(request.Params)
+}
+
+// positionalParams returns a validator which checks string params with the
+// same helpers the example page uses. Params beyond the listed helpers, or
+// with a nil helper, aren't checked.
+func positionalParams(helpers ...func(string) (interface{}, error)) paramValidator {
+	return func(params []json.RawMessage) error {
+		for i, p := range params {
+			if i >= len(helpers) {
+				break
+			}
+			if helpers[i] == nil {
+				continue
+			}
+			var s string
+			if err := json.Unmarshal(p, &s); err != nil {
+				return fmt.Errorf("invalid param %d: not a string", i)
+			}
+			if s == "" {
+				return fmt.Errorf("invalid param %d: empty", i)
+			}
+			if _, err := helpers[i](s); err != nil {
+				return fmt.Errorf("invalid param %d: %v", i, err)
+			}
+		}
+		return nil
+	}
+}
+
+// blockParams returns a validator like positionalParams, whose last helper
+// checks the block param. That may also be an EIP-1898 object naming the block
+// by number or by hash.
+func blockParams(helpers ...func(string) (interface{}, error)) paramValidator {
+	last := len(helpers) - 1
+	others := positionalParams(helpers[:last]...)
+	return func(params []json.RawMessage) error {
+		if err := others(params); err != nil {
+			return err
+		}
+		if len(params) <= last {
+			return nil
+		}
+		if err := checkBlockParam(params[last], helpers[last]); err != nil {
+			return fmt.Errorf("invalid param %d: %v", last, err)
+		}
+		return nil
+	}
+}
+
+// checkBlockParam returns an error unless p is a block accepted by helper, or
+// an EIP-1898 object with either such a blockNumber or a blockHash.
+func checkBlockParam(p json.RawMessage, helper func(string) (interface{}, error)) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err == nil {
+		if s == "" {
+			return errors.New("empty")
+		}
+		_, err := helper(s)
+		return err
+	}
+	var block struct {
+		BlockNumber      *string `json:"blockNumber"`
+		BlockHash        *string `json:"blockHash"`
+		RequireCanonical *bool   `json:"requireCanonical"`
+	}
+	if err := json.Unmarshal(p, &block); err != nil {
+		return errors.New("not a block number, tag or object")
+	}
+	switch {
+	case block.BlockNumber != nil && block.BlockHash == nil:
+		_, err := helper(*block.BlockNumber)
+		return err
+	case block.BlockHash != nil && block.BlockNumber == nil:
+		_, err := hexHash(*block.BlockHash)
+		return err
+	}
+	return errors.New("block object must have either blockNumber or blockHash")
+}
+
+// callMethods take a transaction call object as their first param.
+var callMethods = []string{"eth_call", "eth_createAccessList", "eth_estimateGas"}
+
+// callParams validates the params of methods which take a transaction call
+// object and a block, and are as expensive as executing the call.
+func callParams(params []json.RawMessage) error {
+	if len(params) > 0 {
+		if err := checkCallObject(params[0]); err != nil {
+			return err
+		}
+	}
+	return blockParams(nil, hexNumOrLatest)(params)
+}
+
+// checkCallObject returns an error if the addresses or data of the transaction
+// call object p are malformed.
+func checkCallObject(p json.RawMessage) error {
+	var call map[string]json.RawMessage
+	if err := json.Unmarshal(p, &call); err != nil || call == nil {
+		return fmt.Errorf("invalid param 0: not a transaction object")
+	}
+	for _, field := range []string{"from", "to", "data", "input"} {
+		v, ok := call[field]
+		if !ok || string(v) == "null" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("invalid %s: not a string", field)
+		}
+		switch field {
+		case "from", "to":
+			if _, err := hexAddr(s); err != nil {
+				return fmt.Errorf("invalid %s: %v", field, err)
+			}
+		default:
+			if !hasHexPrefix(s) || !isHex(s[2:]) {
+				return fmt.Errorf("invalid %s: not hex data", field)
+			}
+		}
+	}
+	return nil
+}
+
+// maxCallData returns a validator rejecting call objects whose data or input
+// is longer than limit bytes.
+func maxCallData(limit int) paramValidator {
+	return func(params []json.RawMessage) error {
+		if len(params) == 0 {
+			return nil
+		}
+		var call struct {
+			Data  *string `json:"data"`
+			Input *string `json:"input"`
+		}
+		if err := json.Unmarshal(params[0], &call); err != nil {
+			return fmt.Errorf("invalid data: %v", err)
+		}
+		for field, v := range map[string]*string{"data": call.Data, "input": call.Input} {
+			if v == nil {
+				continue
+			}
+			if n := (len(*v) - 2) / 2; n > limit {
+				return fmt.Errorf("%s of %d bytes exceeds limit of %d", field, n, limit)
+			}
+		}
+		return nil
+	}
+}
+
+// maxCallGas returns a validator rejecting call objects with a gas field above
+// limit. Calls without gas are left to the node's default.
+func maxCallGas(limit uint64) paramValidator {
+	return func(params []json.RawMessage) error {
+		if len(params) == 0 {
+			return nil
+		}
+		var call struct {
+			Gas *hexutil.Uint64 `json:"gas"`
+		}
+		if err := json.Unmarshal(params[0], &call); err != nil {
+			return fmt.Errorf("invalid gas: %v", err)
+		}
+		if call.Gas != nil && uint64(*call.Gas) > limit {
+			return fmt.Errorf("gas %d exceeds limit of %d", uint64(*call.Gas), limit)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// pprofHandler serves the net/http/pprof profiles under /pprof, and expvar
+// under /vars, to requests bearing the admin token. It is meant to be mounted
+// at /debug.
+func (p *Server) pprofHandler() http.Handler {
+	profiler := middleware.Profiler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.adminAuthorized(w, r) {
+			return
+		}
+		profiler.ServeHTTP(w, r)
+	})
+}
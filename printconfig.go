@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// redactedSecret replaces secrets in printed configs.
+const redactedSecret = "REDACTED"
+
+// print writes cfg to w as TOML, with secrets redacted.
+func (cfg ConfigData) print(w io.Writer) error {
+	return toml.NewEncoder(w).ArraysWithOneElementPerLine(true).Encode(cfg.redacted())
+}
+
+// redacted returns a copy of cfg with the admin token, API keys, upstream
+// header values and any secrets in upstream or Redis URLs redacted.
+func (cfg ConfigData) redacted() ConfigData {
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = redactedSecret
+	}
+	if cfg.UpstreamHeaders != nil {
+		headers := make(map[string]string, len(cfg.UpstreamHeaders))
+		for h := range cfg.UpstreamHeaders {
+			headers[h] = redactedSecret
+		}
+		cfg.UpstreamHeaders = headers
+	}
+	if cfg.Keys != nil {
+		keys := make([]APIKey, len(cfg.Keys))
+		for i, k := range cfg.Keys {
+			keys[i] = k
+			keys[i].Key = redactedSecret
+		}
+		cfg.Keys = keys
+	}
+	cfg.URL = redactURL(cfg.URL)
+	cfg.WSURL = redactURL(cfg.WSURL)
+	cfg.RedisURL = redactURL(cfg.RedisURL)
+	cfg.ArchiveURL = redactURL(cfg.ArchiveURL)
+	cfg.ShadowURL = redactURL(cfg.ShadowURL)
+	if cfg.WSFailoverURLs != nil {
+		urls := make([]string, len(cfg.WSFailoverURLs))
+		for i, u := range cfg.WSFailoverURLs {
+			urls[i] = redactURL(u)
+		}
+		cfg.WSFailoverURLs = urls
+	}
+	if cfg.Routes != nil {
+		routes := make(map[string]string, len(cfg.Routes))
+		for method, u := range cfg.Routes {
+			routes[method] = redactURL(u)
+		}
+		cfg.Routes = routes
+	}
+	return cfg
+}
+
+// redactURL returns s with the password of its userinfo, its path segments
+// and its query values redacted, as providers embed keys in any of them, e.g.
+// https://mainnet.infura.io/v3/<key>. Only the scheme, host, username and
+// query names are kept. Anything without a host, such as an IPC path, is
+// returned as is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedSecret)
+		}
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		if seg != "" {
+			segments[i] = redactedSecret
+		}
+	}
+	u.Path, u.RawPath = strings.Join(segments, "/"), ""
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			query[name] = []string{redactedSecret}
+		}
+		u.RawQuery = query.Encode()
+	}
+	if u.Fragment != "" {
+		u.Fragment, u.RawFragment = redactedSecret, ""
+	}
+	return u.String()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -13,10 +15,15 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gochain/gochain/v3/common"
 	"github.com/treeder/gotils/v2"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
 )
 
@@ -25,11 +32,31 @@ type Server struct {
 	proxy   *httputil.ReverseProxy
 	wsProxy *WebsocketProxy
 	myTransport
-	homepage []byte
+	started time.Time
+
+	infoMu      sync.RWMutex // Protects homepage and adminConfig, whose rate limit changes on reload.
+	homepage    homePageData
+	adminConfig adminConfig
+
+	gzipMinBytes int // 0 means responses are never compressed
+
+	instanceName string // X-rpc-proxy response header value, "" means the header is omitted
+
+	rpcMethods []string // HTTP methods accepted on the RPC path
+	ready      int32    // 1 once the upstream has responded, or if not waiting for it, accessed atomically
+	allowedIPs ipSet    // clients allowed to connect, empty means all
+
+	stop         context.CancelFunc // stops background work, such as the head poller
+	checkpointed chan struct{}      // closed once the limiter state is saved after stop, nil if it isn't saved
+
+	adminToken string // "" means the admin endpoints are disabled
 }
 
 func (cfg *ConfigData) NewServer() (*Server, error) {
-	url, err := url.Parse(cfg.URL)
+	if errs := cfg.problems(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	target, err := url.Parse(cfg.URL)
 	if err != nil {
 		return nil, err
 	}
@@ -37,169 +64,734 @@ func (cfg *ConfigData) NewServer() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{target: url, proxy: httputil.NewSingleHostReverseProxy(url), wsProxy: NewProxy(wsurl)}
+	var wsFailover []*url.URL
+	for _, u := range cfg.WSFailoverURLs {
+		f, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		wsFailover = append(wsFailover, f)
+	}
+	// The path of an IPC upstream is its socket, so request paths can't be
+	// appended to it.
+	preservePath := (cfg.PreserveRequestPath == nil || *cfg.PreserveRequestPath) && target.Scheme != ipcScheme
+	s := &Server{target: target, proxy: newReverseProxy(target, preservePath), wsProxy: NewProxy(wsurl, wsFailover...)}
 	s.myTransport.blockRangeLimit = cfg.BlockRangeLimit
+	s.myTransport.maxTopicAlternatives = cfg.MaxTopicAlternatives
+	s.myTransport.maxLogAddresses = cfg.MaxLogAddresses
+	s.myTransport.maxLogResults = cfg.MaxLogResults
+	s.myTransport.subscriptions, err = newSubscriptionFilter(cfg.AllowSubscriptions, cfg.DenySubscriptions)
+	if err != nil {
+		return nil, err
+	}
+	s.myTransport.allowSendTransaction = cfg.AllowSendTransaction
+	s.myTransport.setReadOnly(context.Background(), cfg.ReadOnly)
+	s.myTransport.requireJSON = cfg.RequireJSONContentType
+	s.myTransport.queryRequests = cfg.AllowRPCGet && cfg.RPCGetQuery
+	s.myTransport.idType, err = parseIDType(cfg.IDType)
+	if err != nil {
+		return nil, err
+	}
+	s.myTransport.fillParams = cfg.FillEmptyParams
+	s.myTransport.blockedSenders, err = parseBlockedSenders(cfg.BlockedSenders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocked senders: %v", err)
+	}
+	if cfg.MinGasPrice > 0 {
+		s.myTransport.minGasPrice = new(big.Int).SetUint64(cfg.MinGasPrice)
+	}
+	s.myTransport.maxBatchSize = cfg.MaxBatchSize
+	s.myTransport.maxTagResolutions = cfg.MaxBlockTags
+	s.myTransport.validators = newParamValidators()
+	if cfg.MaxCallGas > 0 {
+		for _, m := range callMethods {
+			s.myTransport.registerValidator(m, maxCallGas(cfg.MaxCallGas))
+		}
+	}
+	if cfg.MaxCallDataBytes > 0 {
+		for _, m := range callMethods {
+			s.myTransport.registerValidator(m, maxCallData(cfg.MaxCallDataBytes))
+		}
+	}
+	s.myTransport.minParams, err = minParams(cfg.MinParams)
+	if err != nil {
+		return nil, err
+	}
+	s.myTransport.costs, err = methodCosts(cfg.MethodCosts)
+	if err != nil {
+		return nil, err
+	}
+	s.myTransport.deprecations, err = parseDeprecations(cfg.Deprecations)
+	if err != nil {
+		return nil, err
+	}
 	s.myTransport.url = cfg.URL
-	s.matcher, err = newMatcher(cfg.Allow)
+	s.myTransport.finalityDepth = cfg.FinalityDepth
+	if s.myTransport.finalityDepth == 0 {
+		s.myTransport.finalityDepth = defaultFinalityDepth
+	}
+	if cfg.EnableCache {
+		s.myTransport.cachePolicies, err = cachePolicies(cfg.Cache, cfg.CacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		s.myTransport.cache = newResponseCache(cfg.CacheSize)
+		s.myTransport.finalizedMaxAge = cfg.FinalizedCacheMaxAge
+		s.myTransport.errorCacheTTL = cfg.ErrorCacheTTL
+		s.myTransport.splitLogQueries = cfg.SplitLogQueriesAtFinality
+		if cfg.InvalidateCacheOnReorg {
+			cache := s.myTransport.cache
+			s.myTransport.reorgs = newReorgDetector(s.myTransport.finalityDepth)
+			s.myTransport.onReorg = func(from uint64) {
+				n := cache.invalidate(from)
+				gotils.L(context.Background()).Info().Printf("Invalidated %d cached responses from block %d", n, from)
+			}
+		}
+	}
+	s.matcher, err = newMatcher(cfg.Allow, cfg.Deny...)
 	if err != nil {
 		return nil, err
 	}
+	s.apiKeys, err = parseAPIKeys(cfg.Keys, cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keys: %v", err)
+	}
 	s.visitors = make(map[string]*rate.Limiter)
 	s.noLimitIPs = make(map[string]struct{})
 	for _, ip := range cfg.NoLimit {
-		s.noLimitIPs[ip] = struct{}{}
+		s.noLimitIPs[normalizeIP(ip)] = struct{}{}
+	}
+	s.key, err = parseRateLimitKey(cfg.RateLimitKey)
+	if err != nil {
+		return nil, err
+	}
+	s.ipv4Prefix, s.ipv6Prefix = cfg.RateLimitIPv4Prefix, cfg.RateLimitIPv6Prefix
+	s.trustedProxies, err = parseIPSet(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	s.allowedIPs, err = parseIPSet(cfg.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed ips: %v", err)
+	}
+	s.clientIDHeader = cfg.ClientIDHeader
+	if cfg.DailyQuota > 0 {
+		s.quota = newDailyQuota(cfg.DailyQuota)
+	}
+	if cfg.LimitStateStore != "" {
+		state, err := loadLimitState(cfg.LimitStateStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rate limit state: %v", err)
+		}
+		if state != nil {
+			s.restore(*state)
+		}
+	}
+	if cfg.RedisURL != "" {
+		s.shared, err = newRedisLimiter(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url: %v", err)
+		}
+	}
+	s.gzipMinBytes = cfg.GzipMinBytes
+	s.maxConcurrent = cfg.MaxConcurrentPerIP
+	s.inFlight = make(map[string]int)
+	s.proxy.ModifyResponse = filterResponseHeaders(cfg.StripResponseHeaders, cfg.AllowResponseHeaders)
+	s.proxy.FlushInterval = cfg.FlushInterval
+	upstream := http.DefaultTransport.(*http.Transport).Clone()
+	upstream.ResponseHeaderTimeout = cfg.UpstreamTimeout
+	for _, d := range cfg.MethodTimeouts {
+		if upstream.ResponseHeaderTimeout > 0 && d > upstream.ResponseHeaderTimeout {
+			upstream.ResponseHeaderTimeout = d
+		}
+	}
+	if err := tunePool(upstream, cfg); err != nil {
+		return nil, err
+	}
+	upstream.RegisterProtocol(ipcScheme, ipcTransport{})
+	s.myTransport.forwardHeaders = make(map[string]struct{}, len(cfg.ForwardHeaders))
+	for _, h := range cfg.ForwardHeaders {
+		s.myTransport.forwardHeaders[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	s.myTransport.upstreamHeaders = cfg.UpstreamHeaders
+	s.myTransport.latestBlock.headers = cfg.UpstreamHeaders
+	s.myTransport.upstream = upstream
+	s.myTransport.upstreamTimeout = cfg.UpstreamTimeout
+	s.myTransport.methodTimeouts = cfg.MethodTimeouts
+	upstreams := map[string]string{cfg.URL: target.Host} // url -> name for logging
+	if len(cfg.Routes) > 0 {
+		s.myTransport.routes = make(map[string]*url.URL, len(cfg.Routes))
+		parsed := make(map[string]*url.URL) // Share URLs so batches can be matched by pointer.
+		for method, u := range cfg.Routes {
+			ru, ok := parsed[u]
+			if !ok {
+				ru, err = url.Parse(u)
+				if err != nil {
+					return nil, fmt.Errorf("invalid route for %s: %v", method, err)
+				}
+				parsed[u] = ru
+				upstreams[ru.String()] = ru.Host
+			}
+			s.myTransport.routes[method] = ru
+		}
+	}
+	if cfg.ArchiveURL != "" {
+		s.myTransport.archive, err = url.Parse(cfg.ArchiveURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive url: %v", err)
+		}
+		s.myTransport.archiveDepth = cfg.ArchiveDepth
+		if s.myTransport.archiveDepth == 0 {
+			s.myTransport.archiveDepth = 128
+		}
+		upstreams[s.myTransport.archive.String()] = s.myTransport.archive.Host
+	}
+	if cfg.ShadowURL != "" {
+		s.myTransport.shadowURL, err = parseShadowURL(cfg.ShadowURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shadow url: %v", err)
+		}
+		s.myTransport.shadowSampleRate = cfg.ShadowSampleRate
+	}
+	if cfg.BreakerErrorRatio > 0 {
+		s.myTransport.breakers = make(map[string]*circuitBreaker)
+		for u, name := range upstreams {
+			s.myTransport.breakers[u] = newCircuitBreaker(name, cfg.BreakerErrorRatio, cfg.BreakerMinRequests, cfg.BreakerCooldown)
+		}
+	}
+	s.myTransport.maxResponseBytes = cfg.MaxResponseBytes
+	s.myTransport.maxBatchResponseBytes = cfg.MaxBatchResponseBytes
+	s.myTransport.streamResponses = cfg.StreamResponses
+	s.myTransport.retryAfter = cfg.RetryAfter
+	if s.myTransport.retryAfter == 0 {
+		s.myTransport.retryAfter = 5 * time.Second
+	}
+	s.myTransport.maxRetries = cfg.MaxRetries
+	s.myTransport.retryBackoff = cfg.RetryBackoff
+	if s.myTransport.retryBackoff == 0 {
+		s.myTransport.retryBackoff = 100 * time.Millisecond
+	}
+	s.myTransport.pipelines, err = newPipelines(cfg.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DedupRequests {
+		s.myTransport.inflight = new(singleflight.Group)
+	}
+	if len(cfg.RefreshOnNewHead) > 0 && cfg.HeadPollInterval <= 0 && !cfg.SubscribeNewHeads {
+		gotils.L(context.Background()).Info().Print("RefreshOnNewHead requires HeadPollInterval or SubscribeNewHeads, falling back to cache TTLs")
 	}
 	s.proxy.Transport = &s.myTransport
 	s.wsProxy.Transport = &s.myTransport
+	s.wsProxy.Director = s.myTransport.wsHeaders
+	s.wsProxy.MaxConnections = cfg.MaxWSConnections
+	s.wsProxy.MaxConnectionsPerIP = cfg.MaxWSConnectionsPerIP
+	s.wsProxy.MessagesPerMinute = cfg.WSMessagesPerMinute
+	s.wsProxy.MaxViolations = cfg.WSMaxViolations
+	s.wsProxy.LogDropped = cfg.WSLogDropped
+	s.wsProxy.ViolationCloseCode = cfg.WSViolationCloseCode
+	s.wsProxy.PingInterval = cfg.WSPingInterval
+	s.wsProxy.PongTimeout = cfg.WSPongTimeout
+	s.wsProxy.IdleTimeout = cfg.WSIdleTimeout
+	s.wsProxy.ReconnectTimeout = cfg.WSReconnectTimeout
+	s.wsProxy.Bridge = cfg.WSBridgeInterval
 
-	// Generate static home page.
-	id := json.RawMessage([]byte(`"ID"`))
-	responseRateLimit, err := json.MarshalIndent(jsonRPCLimit(id), "", "  ")
-	if err != nil {
-		return nil, err
+	s.rpcMethods = []string{http.MethodPost}
+	if cfg.AllowRPCGet {
+		s.rpcMethods = append(s.rpcMethods, http.MethodGet)
+	}
+
+	if !cfg.DisableInstanceHeader {
+		s.instanceName = cfg.InstanceName
+		if s.instanceName == "" {
+			s.instanceName = "rpc-proxy"
+		}
 	}
+
+	s.adminToken = cfg.AdminToken
+	s.adminConfig = adminConfig{
+		Allow:           sortedCopy(cfg.Allow),
+		Deny:            sortedCopy(cfg.Deny),
+		NoLimit:         sortedCopy(cfg.NoLimit),
+		BlockRangeLimit: cfg.BlockRangeLimit,
+		MinGasPrice:     cfg.MinGasPrice,
+	}
+
+	// Generate home page data.
+	id := json.RawMessage([]byte(`"ID"`))
 	responseUnauthorized, err := json.MarshalIndent(jsonRPCUnauthorized(id, "method_name"), "", "  ")
 	if err != nil {
 		return nil, err
 	}
 
-	data := &homePageData{
-		Limit:                requestsPerMinuteLimit,
+	s.homepage = homePageData{
+		Version:              Version,
+		Upstream:             target.Host,
 		Methods:              cfg.Allow,
-		ResponseRateLimit:    string(responseRateLimit),
 		ResponseUnauthorized: string(responseUnauthorized),
 	}
-	sort.Strings(data.Methods)
-
-	var buf bytes.Buffer
-	if err := homePageTmpl.Execute(&buf, &data); err != nil {
+	sort.Strings(s.homepage.Methods)
+	if err := s.setInfoRate(s.rateLimit()); err != nil {
 		return nil, err
 	}
-	s.homepage = buf.Bytes()
+
+	// Background work is started last, so that none is left running when
+	// any of the above fails.
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	if s.myTransport.cache != nil {
+		go s.myTransport.cache.cleanup(ctx, defaultCleanupInterval)
+	}
+	if s.quota != nil {
+		go s.quota.cleanup(ctx, defaultQuotaCleanupInterval)
+	}
+	if cfg.LimitStateStore != "" {
+		interval := cfg.LimitStateInterval
+		if interval <= 0 {
+			interval = defaultLimitStateInterval
+		}
+		s.checkpointed = make(chan struct{})
+		go s.checkpoint(ctx, cfg.LimitStateStore, interval, s.checkpointed)
+	}
+	if cfg.SubscribeNewHeads {
+		methods := cfg.RefreshOnNewHead
+		go subscribeNewHeads(ctx, cfg.WSURL, defaultNewHeadsRetry, defaultNewHeadsTimeout, func(ctx context.Context, num uint64) {
+			n := s.myTransport.cache.invalidateHead()
+			gotils.L(ctx).Debug().Printf("New head %d, invalidated %d cached responses", num, n)
+			if len(methods) > 0 {
+				s.myTransport.refreshOnNewHead(ctx, num, methods)
+			}
+		})
+	}
+	if cfg.HeadPollInterval > 0 {
+		var onNewHead func(context.Context, uint64)
+		if len(cfg.RefreshOnNewHead) > 0 {
+			methods := cfg.RefreshOnNewHead
+			onNewHead = func(ctx context.Context, num uint64) { s.myTransport.refreshOnNewHead(ctx, num, methods) }
+		}
+		go s.myTransport.pollHead(ctx, cfg.HeadPollInterval, onNewHead)
+	}
+	if cfg.SyncingInterval > 0 {
+		go s.myTransport.pollSyncing(ctx, cfg.SyncingInterval)
+	}
+	if cfg.WaitForUpstream {
+		go s.waitReady(ctx, defaultReadyProbeInterval)
+	} else {
+		s.ready = 1
+	}
+	s.started = time.Now()
 
 	return s, nil
 }
 
+// Close stops the server's background work, and waits for the rate limiter
+// state to be saved.
+func (s *Server) Close() {
+	s.stop()
+	if s.checkpointed != nil {
+		<-s.checkpointed
+	}
+}
+
+// tunePool applies the connection pool settings of cfg which are set to
+// upstream, leaving the others at their defaults.
+func tunePool(upstream *http.Transport, cfg *ConfigData) error {
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 || cfg.MaxConnsPerHost < 0 || cfg.IdleConnTimeout < 0 {
+		return fmt.Errorf("invalid connection pool: limits must not be negative")
+	}
+	if cfg.MaxIdleConns > 0 {
+		upstream.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		upstream.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		upstream.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		upstream.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	return nil
+}
+
+// newReverseProxy returns a reverse proxy to target. When preservePath is set
+// the client's request path is appended to the target path, otherwise every
+// request is sent to the target path as is.
+func newReverseProxy(target *url.URL, preservePath bool) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if !preservePath {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.URL.Path, req.URL.RawPath = target.Path, target.RawPath
+		}
+	}
+	return proxy
+}
+
+// filterResponseHeaders returns a ModifyResponse func which removes the strip
+// headers from responses and, if allow is not empty, every header not listed
+// in allow. Server is always overwritten, since upstreams reveal their version
+// in it.
+func filterResponseHeaders(strip, allow []string) func(*http.Response) error {
+	allowed := make(map[string]struct{}, len(allow))
+	for _, h := range allow {
+		allowed[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	return func(res *http.Response) error {
+		for _, h := range strip {
+			res.Header.Del(h)
+		}
+		if len(allowed) > 0 {
+			for h := range res.Header {
+				if _, ok := allowed[h]; !ok {
+					delete(res.Header, h)
+				}
+			}
+		}
+		res.Header.Set("Server", "rpc-proxy")
+		return nil
+	}
+}
+
+// HomePage serves the home page, or just the status as JSON if the client
+// accepts JSON.
 func (p *Server) HomePage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	if _, err := io.Copy(w, bytes.NewReader(p.homepage)); err != nil {
+	p.infoMu.RLock()
+	data := p.homepage
+	p.infoMu.RUnlock()
+	data.Uptime = time.Since(p.started).Round(time.Second).String()
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(homePageStatus{
+			Version:  data.Version,
+			Upstream: data.Upstream,
+			Methods:  len(data.Methods),
+			Uptime:   data.Uptime,
+		}); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to serve status: %v", err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := homePageTmpl.Execute(&buf, &data); err != nil {
+		gotils.L(ctx).Error().Printf("Failed to render homepage: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(w, &buf); err != nil {
 		gotils.L(ctx).Error().Printf("Failed to serve homepage: %v", err)
 		return
 	}
 }
 
+// adminConfig is the effective configuration served by AdminConfig. It must
+// not include secrets.
+type adminConfig struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	NoLimit         []string `json:"noLimit"`
+	RateLimit       int      `json:"rateLimit"`
+	RateWindow      string   `json:"rateWindow"`
+	BlockRangeLimit uint64   `json:"blockRangeLimit"`
+	MinGasPrice     uint64   `json:"minGasPrice"`
+}
+
+// AdminConfig serves the effective allow list and limits as JSON to requests
+// bearing the admin token.
+func (p *Server) AdminConfig(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	p.infoMu.RLock()
+	config := p.adminConfig
+	p.infoMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve admin config: %v", err)
+	}
+}
+
+// adminStatus is the runtime status served by AdminStatus.
+type adminStatus struct {
+	Uptime   string                `json:"uptime"`
+	ReadOnly bool                  `json:"readOnly"`
+	Syncing  bool                  `json:"syncing"`            // as last reported by the upstream, if probed
+	Upstream latencySummary        `json:"upstream"`           // over the most recent upstream requests
+	Cache    map[string]cacheStats `json:"cache,omitempty"`    // per method, if caching is enabled
+	CacheOff []string              `json:"cacheOff,omitempty"` // methods caching was turned off for at runtime
+}
+
+// AdminStatus serves upstream latency percentiles and error rate, and cache
+// stats, as JSON to requests bearing the admin token.
+func (p *Server) AdminStatus(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	status := adminStatus{
+		Uptime:   time.Since(p.started).Round(time.Second).String(),
+		ReadOnly: p.isReadOnly(),
+		Syncing:  p.isSyncing(),
+		Upstream: p.latency.summary(),
+	}
+	if p.cache != nil {
+		status.Cache = p.cache.statsSnapshot()
+		status.CacheOff = p.cache.disabled()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve admin status: %v", err)
+	}
+}
+
+type adminReadOnly struct {
+	ReadOnly *bool `json:"readOnly"`
+}
+
+// AdminReadOnly turns read-only mode on or off for requests bearing the admin
+// token, with a body like {"readOnly": true}, and responds with the new state.
+func (p *Server) AdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	var req adminReadOnly
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReadOnly == nil {
+		http.Error(w, `expected a body like {"readOnly": true}`, http.StatusBadRequest)
+		return
+	}
+	p.setReadOnly(r.Context(), *req.ReadOnly)
+	readOnly := p.isReadOnly()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(adminReadOnly{ReadOnly: &readOnly}); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve read-only mode: %v", err)
+	}
+}
+
+type adminCacheMethod struct {
+	Method  string `json:"method"`
+	Enabled *bool  `json:"enabled"`
+}
+
+// AdminCacheMethod turns caching of the method in the path on or off for
+// requests bearing the admin token, with a body like {"enabled": false}, and
+// responds with the new state. Turning it off drops its cached responses.
+func (p *Server) AdminCacheMethod(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	if p.cache == nil {
+		http.Error(w, "caching is not enabled", http.StatusNotFound)
+		return
+	}
+	method := chi.URLParam(r, "method")
+	var req adminCacheMethod
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, `expected a body like {"enabled": false}`, http.StatusBadRequest)
+		return
+	}
+	p.cache.setEnabled(method, *req.Enabled)
+	if *req.Enabled {
+		gotils.L(r.Context()).Info().Printf("Caching of %s turned on", method)
+	} else {
+		gotils.L(r.Context()).Info().Printf("Caching of %s turned off, cached responses dropped", method)
+	}
+	enabled := p.cache.enabled(method)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(adminCacheMethod{Method: method, Enabled: &enabled}); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve cache state: %v", err)
+	}
+}
+
+// AdminFlushCache drops every cached response for requests bearing the admin
+// token, and responds with the number dropped.
+func (p *Server) AdminFlushCache(w http.ResponseWriter, r *http.Request) {
+	if !p.adminAuthorized(w, r) {
+		return
+	}
+	if p.cache == nil {
+		http.Error(w, "caching is not enabled", http.StatusNotFound)
+		return
+	}
+	n := p.cache.flush()
+	gotils.L(r.Context()).Info().Printf("Flushed %d cached responses", n)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Flushed int `json:"flushed"`
+	}{n}); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to serve cache flush: %v", err)
+	}
+}
+
+// adminAuthorized returns true if r bears the admin token, otherwise it
+// responds with 404 if the admin endpoints are disabled, or 401.
+func (p *Server) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if p.adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
+
+// setInstanceHeader identifies this proxy instance in the X-rpc-proxy
+// response header, unless it is disabled.
+func (p *Server) setInstanceHeader(w http.ResponseWriter) {
+	if p.instanceName != "" {
+		w.Header().Set("X-rpc-proxy", p.instanceName)
+	}
+}
+
 func (p *Server) RPCProxy(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("X-rpc-proxy", "rpc-proxy")
+	p.setInstanceHeader(w)
+	if !p.rpcMethodAllowed(r.Method) {
+		w.Header().Set("Allow", strings.Join(p.rpcMethods, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.isReady() {
+		gotils.L(r.Context()).Info().Print("Request blocked: Upstream not reachable yet")
+		notReady(w, r, defaultReadyProbeInterval)
+		return
+	}
+	if p.gzipMinBytes > 0 && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w, p.gzipMinBytes)
+		defer func() {
+			if err := gw.Close(); err != nil {
+				gotils.L(r.Context()).Error().Printf("Failed to write compressed response: %v", err)
+			}
+		}()
+		w = gw
+	}
 	p.proxy.ServeHTTP(w, r)
 }
 
+// rpcMethodAllowed returns true if the RPC path accepts the HTTP method. CORS
+// preflight requests are answered before reaching it.
+func (p *Server) rpcMethodAllowed(method string) bool {
+	for _, m := range p.rpcMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Server) WSProxy(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("X-rpc-proxy", "rpc-proxy")
-	p.wsProxy.ServeHTTP(w, r)
+	p.setInstanceHeader(w)
+	if !p.isReady() {
+		gotils.L(r.Context()).Info().Print("Connection rejected: Upstream not reachable yet")
+		notReady(w, r, defaultReadyProbeInterval)
+		return
+	}
+	ctx, span := tracer.Start(r.Context(), "websocket", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	p.wsProxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
 func (p *Server) Example(w http.ResponseWriter, r *http.Request) {
 	method := chi.URLParam(r, "method")
-	args := []string{
+	formats, ok := paramFormats[method]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	params, err := formatParams(formats, []string{
 		chi.URLParam(r, "arg"),
 		chi.URLParam(r, "arg2"),
 		chi.URLParam(r, "arg3"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	do := func(params ...func(string) (interface{}, error)) {
-		var fmtd []interface{}
-		for i, p := range params {
-			if i > len(args) {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-			if p == nil {
-				fmtd = append(fmtd, args[i])
-				continue
-			}
-			arg, err := p(args[i])
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			fmtd = append(fmtd, arg)
+	data, err := p.example(method, params...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// paramFormats holds the methods which may be called with plain string
+// arguments, from example URLs or GET query strings, and how to format each of
+// their params. A nil format passes the argument through unchanged.
+var paramFormats = map[string][]func(string) (interface{}, error){
+	"clique_getSigners":                    {hexNumOrLatest},
+	"clique_getSignersAtHash":              {hexHash},
+	"clique_getSnapshot":                   {hexNumOrLatest},
+	"clique_getSnapshotAtHash":             {hexHash},
+	"clique_getVoters":                     {hexNumOrLatest},
+	"clique_getVotersAtHash":               {hexHash},
+	"eth_blockNumber":                      {},
+	"eth_chainId":                          {},
+	"eth_gasPrice":                         {},
+	"eth_genesisAlloc":                     {},
+	"eth_getBalance":                       {hexAddr, hexNumOrLatest},
+	"eth_getBlockByHash":                   {hexHash, boolOrFalse},
+	"eth_getBlockByNumber":                 {hexNumOrLatest, boolOrFalse},
+	"eth_getBlockTransactionCountByHash":   {hexHash},
+	"eth_getBlockTransactionCountByNumber": {hexNumOrLatest},
+	"eth_getCode":                          {hexAddr, hexNumOrLatest},
+	"eth_getFilterChanges":                 {nil},
+	"eth_getLogs": {func(arg string) (interface{}, error) {
+		if hasHexPrefix(arg) {
+			arg = arg[2:]
 		}
-		data, err := p.example(method, fmtd...)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if !isHex(arg) {
+			return nil, fmt.Errorf("non-hex argument: %s", arg)
 		}
+		return map[string]interface{}{"blockhash": "0x" + arg}, nil
+	}},
+	"eth_getStorageAt":                        {hexAddr, hexNumOrZero, hexNumOrLatest},
+	"eth_getTransactionByBlockHashAndIndex":   {nil, hexNumOrZero},
+	"eth_getTransactionByBlockNumberAndIndex": {hexNumOrLatest, hexNumOrZero},
+	"eth_getTransactionCount":                 {hexAddr, hexNumOrLatest},
+	"eth_getTransactionByHash":                {hexHash},
+	"eth_getTransactionReceipt":               {hexHash},
+	"eth_totalSupply":                         {hexNumOrLatest},
+	"net_listening":                           {},
+	"net_version":                             {},
+	"rpc_modules":                             {},
+	"web3_clientVersion":                      {},
+}
 
-		w.Write(data)
-	}
-	switch method {
-	case "clique_getSigners":
-		do(hexNumOrLatest)
-	case "clique_getSignersAtHash":
-		do(hexHash)
-	case "clique_getSnapshot":
-		do(hexNumOrLatest)
-	case "clique_getSnapshotAtHash":
-		do(hexHash)
-	case "clique_getVoters":
-		do(hexNumOrLatest)
-	case "clique_getVotersAtHash":
-		do(hexHash)
-	case "eth_blockNumber":
-		do(hexNumOrLatest)
-	case "eth_chainId":
-		do()
-	case "eth_gasPrice":
-		do()
-	case "eth_genesisAlloc":
-		do()
-	case "eth_getBalance":
-		do(hexAddr, hexNumOrLatest)
-	case "eth_getBlockByHash":
-		do(hexHash, boolOrFalse)
-	case "eth_getBlockByNumber":
-		do(hexNumOrLatest, boolOrFalse)
-	case "eth_getBlockTransactionCountByHash":
-		do(hexHash)
-	case "eth_getBlockTransactionCountByNumber":
-		do(hexNumOrLatest)
-	case "eth_getCode":
-		do(hexAddr, hexNumOrLatest)
-	case "eth_getFilterChanges":
-		do(nil)
-	case "eth_getLogs":
-		do(func(arg string) (interface{}, error) {
-			if hasHexPrefix(arg) {
-				arg = arg[2:]
-			}
-			if !isHex(arg) {
-				return nil, fmt.Errorf("non-hex argument: %s", arg)
+// formatParams formats args with formats, treating missing args as empty.
+func formatParams(formats []func(string) (interface{}, error), args []string) ([]interface{}, error) {
+	if len(args) > len(formats) {
+		for _, arg := range args[len(formats):] {
+			if arg != "" {
+				return nil, fmt.Errorf("too many params: %d", len(args))
 			}
-			return map[string]interface{}{"blockhash": "0x" + arg}, nil
-		})
-	case "eth_getStorageAt":
-		do(hexAddr, hexNumOrZero, hexNumOrLatest)
-	case "eth_getTransactionByBlockHashAndIndex":
-		do(nil, hexNumOrZero)
-	case "eth_getTransactionByBlockNumberAndIndex":
-		do(hexNumOrLatest, hexNumOrZero)
-	case "eth_getTransactionCount":
-		do(hexAddr, hexNumOrLatest)
-	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
-		do(hexHash)
-	case "eth_totalSupply":
-		do(hexNumOrLatest)
-	case "net_listening":
-		do()
-	case "net_version":
-		do()
-	case "rpc_modules":
-		do()
-	case "web3_clientVersion":
-		do()
-
-	default:
-		http.NotFound(w, r)
+		}
+	}
+	params := make([]interface{}, 0, len(formats))
+	for i, format := range formats {
+		var arg string
+		if i < len(args) {
+			arg = args[i]
+		}
+		if format == nil {
+			params = append(params, arg)
+			continue
+		}
+		param, err := format(arg)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, param)
 	}
+	return params, nil
 }
 
 func hexAddr(arg string) (interface{}, error) {
@@ -235,7 +827,7 @@ func boolOrFalse(arg string) (interface{}, error) {
 }
 
 func hexNumOrLatest(arg string) (interface{}, error) {
-	return hexNumOr(arg, "latest", "pending", "earliest")
+	return hexNumOr(arg, "latest", "latest", "pending", "earliest", "safe", "finalized")
 }
 
 func hexNumOrZero(arg string) (interface{}, error) {
@@ -306,7 +898,8 @@ func (p *Server) example(method string, params ...interface{}) ([]byte, error) {
 	const contentType = "application/json"
 	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Accept", contentType)
-	resp, err := http.DefaultClient.Do(req)
+	client := http.Client{Transport: p.myTransport.upstream} // Also reaches IPC upstreams.
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -336,12 +929,52 @@ func indent(b []byte) string {
 }
 
 type homePageData struct {
+	Version              string
+	Upstream             string // Host only.
+	Uptime               string
 	Limit                int
+	Window               string
 	Methods              []string
 	ResponseRateLimit    string
 	ResponseUnauthorized string
 }
 
+// setInfoRate shows the rate limit l on the home page and in the admin config.
+func (p *Server) setInfoRate(l visitorLimit) error {
+	id := json.RawMessage([]byte(`"ID"`))
+	responseRateLimit, err := json.MarshalIndent(jsonRPCLimit(id, l.retryAfter()), "", "  ")
+	if err != nil {
+		return err
+	}
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+	p.homepage.Limit, p.homepage.Window = l.limit, windowName(l.window)
+	p.homepage.ResponseRateLimit = string(responseRateLimit)
+	p.adminConfig.RateLimit, p.adminConfig.RateWindow = l.limit, l.window.String()
+	return nil
+}
+
+// windowName returns a readable name for a rate limit window.
+func windowName(d time.Duration) string {
+	switch d {
+	case time.Second:
+		return "second"
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	}
+	return d.String()
+}
+
+// homePageStatus is the JSON version of the home page.
+type homePageStatus struct {
+	Version  string `json:"version"`
+	Upstream string `json:"upstream"`
+	Methods  int    `json:"methods"`
+	Uptime   string `json:"uptime"`
+}
+
 var homePageTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 <html lang="en">
 	<head>
@@ -364,9 +997,18 @@ var homePageTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 
 		<p>This is an RPC endpoint for <a href="https://gochain.io" rel="nofollow">GoChain</a>. It provides access to a limited subset of services. Rate limits apply.</p>
 
+		<h2>Status</h2>
+
+		<ul>
+			<li>Version: <code>{{.Version}}</code></li>
+			<li>Upstream: <code>{{.Upstream}}</code></li>
+			<li>Allowed methods: <code>{{len .Methods}}</code></li>
+			<li>Uptime: <code>{{.Uptime}}</code></li>
+		</ul>
+
 		<h2>Rate Limit</h2>
 
-		<p>The rate limit is <code>{{.Limit}}</code> requests per minute. If you exceed this limit, you will receive a 429 response:</p>
+		<p>The rate limit is <code>{{.Limit}}</code> requests per {{.Window}}. If you exceed this limit, you will receive a 429 response:</p>
 
 		<pre class="json">{{.ResponseRateLimit}}</pre>
 
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+const defaultQuotaCleanupInterval = time.Hour
+
+// dailyQuota counts requests per client per UTC day, rejecting requests once
+// a client has made limit requests that day. Clients are identified by
+// quotaClient.
+type dailyQuota struct {
+	limit int
+
+	mu     sync.Mutex // Protects counts.
+	counts map[quotaKey]int
+}
+
+type quotaKey struct {
+	client string
+	day    string // UTC date, e.g. 2021-06-30.
+}
+
+// quotaDay returns the UTC date of t.
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaReset returns when the quotas of now's day reset, at the next
+// midnight UTC.
+func quotaReset(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func newDailyQuota(limit int) *dailyQuota {
+	return &dailyQuota{limit: limit, counts: make(map[quotaKey]int)}
+}
+
+// available reports whether client has n more requests left in its quota
+// for now's day, without counting them.
+func (q *dailyQuota) available(client string, n int, now time.Time) bool {
+	k := quotaKey{client: client, day: quotaDay(now)}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.counts[k]+n <= q.limit
+}
+
+// take counts the requests in used, client -> requests, at now, unless any
+// client would exceed its quota for the day, in which case none are counted
+// and it returns false.
+func (q *dailyQuota) take(used map[string]int, now time.Time) bool {
+	day := quotaDay(now)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for client, n := range used {
+		if q.counts[quotaKey{client: client, day: day}]+n > q.limit {
+			return false
+		}
+	}
+	for client, n := range used {
+		q.counts[quotaKey{client: client, day: day}] += n
+	}
+	return true
+}
+
+// today returns the counts of now's day, client -> requests.
+func (q *dailyQuota) today(now time.Time) map[string]int {
+	day := quotaDay(now)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := make(map[string]int)
+	for k, n := range q.counts {
+		if k.day == day {
+			counts[k.client] = n
+		}
+	}
+	return counts
+}
+
+// restore sets the counts of day, client -> requests.
+func (q *dailyQuota) restore(day string, counts map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for client, n := range counts {
+		q.counts[quotaKey{client: client, day: day}] = n
+	}
+}
+
+// removeExpired removes the counts of days before now's, returning the number
+// removed.
+func (q *dailyQuota) removeExpired(now time.Time) int {
+	today := quotaDay(now)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n int
+	for k := range q.counts {
+		if k.day != today {
+			delete(q.counts, k)
+			n++
+		}
+	}
+	return n
+}
+
+// cleanup removes past days' counts every interval, until ctx is done.
+func (q *dailyQuota) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := q.removeExpired(now); n > 0 {
+				gotils.L(ctx).Debug().Printf("Removed %d expired daily quota counts", n)
+			}
+		}
+	}
+}
+
+// quotaClient returns who r counts against the daily quota: its API key, if
+// it has one, otherwise its IP. Keys are prefixed so they can't collide with
+// IPs. "" means r is exempt.
+func (ls *limiters) quotaClient(r ModifiedRequest) string {
+	if r.APIKey != "" {
+		return "key:" + r.APIKey
+	}
+	if ls.exempt(r.RemoteAddr) {
+		return ""
+	}
+	return r.RemoteAddr
+}
+
+func jsonRPCQuotaExceeded(id json.RawMessage, limit int, retryAfter time.Duration) interface{} {
+	return withRetryAfter(jsonRPCError(id, jsonRPCQuotaLimit, fmt.Sprintf("You used your daily quota of %d requests, it resets at midnight UTC", limit)), retryAfter)
+}
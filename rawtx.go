@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gochain/gochain/v3/core/types"
+	"github.com/gochain/gochain/v3/rlp"
+)
+
+// blockedSenders is a set of addresses whose transactions are rejected.
+type blockedSenders map[common.Address]struct{}
+
+// parseBlockedSenders returns the set of addrs, or nil if there are none.
+// Addresses are matched by value, so their case doesn't matter.
+func parseBlockedSenders(addrs []string) (blockedSenders, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	b := make(blockedSenders, len(addrs))
+	for _, a := range addrs {
+		if !common.IsHexAddress(a) {
+			return nil, fmt.Errorf("invalid address: %q", a)
+		}
+		b[common.HexToAddress(a)] = struct{}{}
+	}
+	return b, nil
+}
+
+func (b blockedSenders) contains(addr common.Address) bool {
+	_, ok := b[addr]
+	return ok
+}
+
+// decodeRawTx decodes a raw transaction, as passed to eth_sendRawTransaction.
+func decodeRawTx(param json.RawMessage) (*types.Transaction, error) {
+	var raw hexutil.Bytes
+	if err := json.Unmarshal(param, &raw); err != nil {
+		return nil, fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	var tx types.Transaction
+	if err := rlp.DecodeBytes(raw, &tx); err != nil {
+		return nil, fmt.Errorf("invalid raw transaction: %v", err)
+	}
+	return &tx, nil
+}
+
+// txSender decodes a raw transaction, as passed to eth_sendRawTransaction,
+// and recovers its sender from the signature.
+func txSender(param json.RawMessage) (common.Address, error) {
+	tx, err := decodeRawTx(param)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return recoverSender(tx)
+}
+
+// recoverSender recovers the sender of tx from its signature.
+func recoverSender(tx *types.Transaction) (common.Address, error) {
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.NewEIP155Signer(tx.ChainId())
+	}
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid transaction signature: %v", err)
+	}
+	return from, nil
+}
+
+func jsonRPCSenderBlocked(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCMethodNotAllowed, "Transactions from this sender are not accepted")
+}
+
+func jsonRPCGasPriceLimit(id json.RawMessage, price, min *big.Int) interface{} {
+	return jsonRPCError(id, jsonRPCGasPriceTooLow, fmt.Sprintf("Gas price (%s wei) is lower than minimum (%s wei).", price, min))
+}
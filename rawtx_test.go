@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gochain/gochain/v3/core/types"
+	"github.com/gochain/gochain/v3/crypto"
+	"github.com/gochain/gochain/v3/rlp"
+)
+
+// eip155Tx is the signed example transaction from EIP-155, sent by eip155Sender.
+const (
+	eip155Tx     = `"0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"`
+	eip155Sender = "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"
+)
+
+// homesteadTx returns eip155Tx's transaction signed without replay protection.
+func homesteadTx(t *testing.T) json.RawMessage {
+	t.Helper()
+	key, err := crypto.HexToECDSA(strings.Repeat("46", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := types.NewTransaction(9, common.HexToAddress("0x3535353535353535353535353535353535353535"), big.NewInt(1e18), 21000, big.NewInt(20e9), nil)
+	tx, err = types.SignTx(tx, types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(hexutil.Bytes(raw))
+	return b
+}
+
+func TestTxSender(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		tx   json.RawMessage
+	}{
+		{"eip155", json.RawMessage(eip155Tx)},
+		{"homestead", homesteadTx(t)},
+	} {
+		from, err := txSender(test.tx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if from != common.HexToAddress(eip155Sender) {
+			t.Errorf("%s: expected sender %s, got %s", test.name, eip155Sender, from.Hex())
+		}
+	}
+	for _, tx := range []string{`"0x"`, `"0x1234"`, `"not hex"`, `1`} {
+		if _, err := txSender(json.RawMessage(tx)); err == nil {
+			t.Errorf("%s: expected error", tx)
+		}
+	}
+}
+
+func TestBlock_blockedSenders(t *testing.T) {
+	tr := newTestTransport(t, "eth_sendRawTransaction")
+	var err error
+	tr.blockedSenders, err = parseBlockedSenders([]string{strings.ToLower(eip155Sender)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		tx   json.RawMessage
+		code int
+	}{
+		{"eip155", json.RawMessage(eip155Tx), http.StatusForbidden},
+		{"homestead", homesteadTx(t), http.StatusForbidden},
+		{"invalid", json.RawMessage(`"0x1234"`), http.StatusBadRequest},
+	} {
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_sendRawTransaction", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{test.tx}}})
+		if code != test.code || resp == nil {
+			t.Errorf("%s: expected status %d, got %d %v", test.name, test.code, code, resp)
+		}
+	}
+
+	tr.blockedSenders, _ = parseBlockedSenders([]string{"0x0000000000000000000000000000000000000001"})
+	if code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_sendRawTransaction", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(eip155Tx)}}}); resp != nil {
+		t.Errorf("unexpected block: %d %v", code, resp)
+	}
+
+	if _, err := parseBlockedSenders([]string{"0x1234"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestBlock_minGasPrice(t *testing.T) {
+	tr := newTestTransport(t, "eth_sendRawTransaction")
+	tr.minGasPrice = big.NewInt(30e9) // The EIP-155 example pays 20 gwei.
+	code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_sendRawTransaction", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(eip155Tx)}}})
+	if code != http.StatusBadRequest || resp.(ErrResponse).Error.Code != jsonRPCGasPriceTooLow {
+		t.Errorf("expected gas price to be rejected, got %d %v", code, resp)
+	}
+
+	tr.minGasPrice = big.NewInt(20e9)
+	if code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_sendRawTransaction", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(eip155Tx)}}}); resp != nil {
+		t.Errorf("unexpected block: %d %v", code, resp)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// writeMethods change chain state, so are rejected in read-only mode.
+var writeMethods = map[string]struct{}{
+	"eth_sendRawTransaction": {},
+	"eth_sendTransaction":    {},
+}
+
+// isReadOnly returns true if write methods are being rejected, e.g. while the
+// node is upgraded.
+func (t *myTransport) isReadOnly() bool {
+	return atomic.LoadInt32(&t.readOnly) == 1
+}
+
+// setReadOnly turns read-only mode on or off, logging any change. It is safe to
+// call while requests are being served.
+func (t *myTransport) setReadOnly(ctx context.Context, on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.readOnly, v) == v {
+		return
+	}
+	if on {
+		gotils.L(ctx).Info().Print("Read-only mode enabled, rejecting transactions")
+	} else {
+		gotils.L(ctx).Info().Print("Read-only mode disabled, accepting transactions")
+	}
+}
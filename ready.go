@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// defaultReadyProbeInterval is how often the upstream is probed until it
+// first responds.
+const defaultReadyProbeInterval = time.Second
+
+// isReady returns true once RPC requests may be forwarded.
+func (p *Server) isReady() bool {
+	return atomic.LoadInt32(&p.ready) == 1
+}
+
+// waitReady fetches the latest block from the upstream every interval until
+// it succeeds, or ctx is done, and then marks p ready.
+func (p *Server) waitReady(ctx context.Context, interval time.Duration) {
+	for {
+		_, err := p.latestBlock.get(ctx)
+		if err == nil {
+			atomic.StoreInt32(&p.ready, 1)
+			gotils.L(ctx).Info().Print("Upstream is reachable, serving requests")
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		gotils.L(ctx).Info().Printf("Upstream is not reachable yet, retrying in %s: %v", interval, err)
+		p.latestBlock.expire() // Don't wait for the failure to expire.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// notReady responds with 503 and a JSON-RPC error asking the client to retry.
+func notReady(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second)/time.Second)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := json.NewEncoder(w).Encode(jsonRPCUpstreamUnavailable(nil)); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to write a response: %v", err)
+	}
+}
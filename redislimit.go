@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/treeder/gotils/v2"
+)
+
+// redisTimeout bounds each rate limit check against Redis, after which the
+// in-memory limiter decides instead.
+const redisTimeout = 250 * time.Millisecond
+
+// redisProbeInterval is how often Redis is tried again while it is
+// unavailable. Requests in between skip it.
+const redisProbeInterval = 5 * time.Second
+
+// errRedisDegraded is returned instead of consulting Redis while it is
+// unavailable.
+var errRedisDegraded = errors.New("redis rate limiter degraded")
+
+// redisKeyPrefix namespaces rate limit keys in a shared Redis.
+const redisKeyPrefix = "rpc-proxy:rate:"
+
+// tokenBucketScript atomically refills the bucket in KEYS[1] at ARGV[1]
+// tokens per second up to a burst of ARGV[2], as of ARGV[3] milliseconds,
+// and takes ARGV[4] tokens, at most the burst, if they are available. It
+// returns 1 if they were taken.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = math.min(burst, tonumber(ARGV[4]))
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return allowed
+`)
+
+// redisLimiter is a token bucket rate limiter shared between replicas through
+// Redis. It applies the same limit and burst as the in-memory limiters.
+type redisLimiter struct {
+	client *redis.Client
+
+	degraded  int32 // Set while Redis is unreachable, accessed atomically.
+	nextProbe int64 // Unix nanoseconds before which a degraded Redis isn't tried, accessed atomically.
+}
+
+func newRedisLimiter(redisURL string) (*redisLimiter, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisLimiter{client: redis.NewClient(opts)}, nil
+}
+
+// allow takes cost tokens from the bucket for key, which refills at limit,
+// returning an error if Redis couldn't be consulted. While Redis is
+// unavailable, only a request every redisProbeInterval tries it.
+func (rl *redisLimiter) allow(ctx context.Context, key string, limit visitorLimit, cost int) (bool, error) {
+	if !rl.probe(time.Now()) {
+		return false, errRedisDegraded
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	perSecond := float64(limit.limit) / limit.window.Seconds()
+	burst := burstSize(limit.burst, limit.limit)
+	allowed, err := tokenBucketScript.Run(ctx, rl.client, []string{redisKeyPrefix + key}, perSecond, burst, time.Now().UnixNano()/int64(time.Millisecond), cost).Int()
+	rl.setDegraded(ctx, err)
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
+
+// probe reports whether Redis should be tried at now: always, unless it is
+// degraded, and then once every redisProbeInterval.
+func (rl *redisLimiter) probe(now time.Time) bool {
+	if atomic.LoadInt32(&rl.degraded) == 0 {
+		return true
+	}
+	next := atomic.LoadInt64(&rl.nextProbe)
+	if now.UnixNano() < next {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&rl.nextProbe, next, now.Add(redisProbeInterval).UnixNano())
+}
+
+// setDegraded logs transitions into and out of degraded mode, in which the
+// in-memory limiter is used instead.
+func (rl *redisLimiter) setDegraded(ctx context.Context, err error) {
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&rl.degraded, 0, 1) {
+			atomic.StoreInt64(&rl.nextProbe, time.Now().Add(redisProbeInterval).UnixNano())
+			gotils.L(ctx).Error().Printf("Redis rate limiter unavailable, falling back to in-memory limits: %v", err)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&rl.degraded, 1, 0) {
+		gotils.L(ctx).Info().Print("Redis rate limiter available again")
+	}
+}
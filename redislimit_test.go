@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// fakeRedis serves just enough RESP to run the token bucket script: it allows
+// the first allow calls per key, and records the keys used. While down, it
+// fails every call instead.
+type fakeRedis struct {
+	allow int
+	down  int32 // accessed atomically
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f.calls = make(map[string]int)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return "redis://" + l.Addr().String()
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "EVALSHA":
+			fmt.Fprint(conn, "-NOSCRIPT No matching script.\r\n")
+		case "EVAL":
+			key := args[3]
+			f.mu.Lock()
+			f.calls[key]++
+			if atomic.LoadInt32(&f.down) == 1 {
+				f.mu.Unlock()
+				fmt.Fprint(conn, "-ERR down\r\n")
+				continue
+			}
+			allowed := f.calls[key] <= f.allow
+			f.mu.Unlock()
+			if allowed {
+				fmt.Fprint(conn, ":1\r\n")
+			} else {
+				fmt.Fprint(conn, ":0\r\n")
+			}
+		default:
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+	}
+}
+
+// readCommand reads a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2) // Including the trailing CRLF.
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestAllowVisitor_redis(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 1000
+	f := &fakeRedis{allow: 2}
+	shared, err := newRedisLimiter(f.serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), shared: shared}
+	r := ModifiedRequest{Path: "eth_chainId", RemoteAddr: "1.2.3.4"}
+	for i, exp := range []bool{true, true, false} {
+		if allowed, _ := ls.AllowVisitor(r); allowed != exp {
+			t.Errorf("request %d: expected allowed %t, got %t", i, exp, allowed)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n := f.calls[redisKeyPrefix+"1.2.3.4"]; n != 3 {
+		t.Errorf("expected 3 checks of the shared bucket, got %d", n)
+	}
+	if len(ls.visitors) != 0 {
+		t.Errorf("expected no in-memory limiters, got %d", len(ls.visitors))
+	}
+}
+
+func TestAllowKey_redis(t *testing.T) {
+	f := &fakeRedis{allow: 1}
+	shared, err := newRedisLimiter(f.serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), shared: shared}
+	l := visitorLimit{limit: 600, window: time.Minute}
+	limiter := rate.NewLimiter(l.every())
+	for i, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+		r := ModifiedRequest{Path: "eth_chainId", RemoteAddr: ip, APIKey: "paid"}
+		if allowed, exp := ls.AllowKey(r, l, limiter), i == 0; allowed != exp {
+			t.Errorf("request %d: expected allowed %t, got %t", i, exp, allowed)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n := f.calls[redisKeyPrefix+"key:paid"]; n != 2 {
+		t.Errorf("expected 2 checks of the key's shared bucket, got %d", n)
+	}
+}
+
+func TestAllowVisitor_redisUnavailable(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 1000
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	shared, err := newRedisLimiter("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), shared: shared}
+	allowed, added := ls.AllowVisitor(ModifiedRequest{Path: "eth_chainId", RemoteAddr: "1.2.3.4"})
+	if !allowed || !added {
+		t.Errorf("expected fallback to a new in-memory limiter, got allowed %t, added %t", allowed, added)
+	}
+	if shared.degraded != 1 {
+		t.Error("expected degraded mode")
+	}
+}
+
+func TestAllowVisitor_redisDegraded(t *testing.T) {
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 1000
+	f := &fakeRedis{allow: 100, down: 1}
+	shared, err := newRedisLimiter(f.serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := limiters{visitors: make(map[string]*rate.Limiter), shared: shared}
+	r := ModifiedRequest{Path: "eth_chainId", RemoteAddr: "1.2.3.4"}
+	checks := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.calls[redisKeyPrefix+"1.2.3.4"]
+	}
+	for i, test := range []struct {
+		probe  bool // Whether the probe interval has passed.
+		down   int32
+		checks int
+	}{
+		{false, 1, 1}, // Degrades.
+		{false, 1, 1}, // Skipped.
+		{true, 1, 2},  // Probed, still down.
+		{false, 0, 2}, // Skipped, though back.
+		{true, 0, 3},  // Probed, back.
+		{false, 0, 4},
+	} {
+		if test.probe {
+			atomic.StoreInt64(&shared.nextProbe, 0)
+		}
+		atomic.StoreInt32(&f.down, test.down)
+		if allowed, _ := ls.AllowVisitor(r); !allowed {
+			t.Errorf("%d: expected request to be allowed", i)
+		}
+		if got := checks(); got != test.checks {
+			t.Errorf("%d: expected %d checks of Redis, got %d", i, test.checks, got)
+		}
+	}
+	if atomic.LoadInt32(&shared.degraded) != 0 {
+		t.Error("expected Redis to be available again")
+	}
+}
+
+func TestNewRedisLimiter_invalidURL(t *testing.T) {
+	if _, err := newRedisLimiter("http://localhost"); err == nil {
+		t.Error("expected error for non-redis url")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// reloadOnHangup merges the config again with reload each time the process
+// gets SIGHUP, and applies its rate limit until ctx is done. Other settings
+// need a restart to change, including the rate limits of API keys, which are
+// separate.
+func (s *Server) reloadOnHangup(ctx context.Context, reload func() (ConfigData, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := reload()
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to reload config, keeping the current one: %v", err)
+			continue
+		}
+		if err := s.setRate(cfg.RateLimit, cfg.RateWindow, cfg.Burst); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to apply the reloaded rate limit: %v", err)
+			continue
+		}
+		gotils.L(ctx).Info().Println("Config reloaded, rateLimit:", cfg.RateLimit, "rateWindow:", cfg.RateWindow, "burst:", cfg.Burst)
+	}
+}
+
+// setRate changes the rate limit of visitors, and where it is shown.
+func (s *Server) setRate(limit int, window time.Duration, burst int) error {
+	s.myTransport.setRate(limit, window, burst)
+	return s.setInfoRate(s.rateLimit())
+}
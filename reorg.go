@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+)
+
+// blockHeader is the subset of a block header needed to detect reorgs.
+type blockHeader struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+}
+
+// reorgDetector tracks the hashes of recently observed blocks in order to
+// detect reorgs. It is not safe for concurrent use.
+type reorgDetector struct {
+	depth  uint64                 // heights tracked below head
+	hashes map[uint64]common.Hash // height -> observed hash
+}
+
+func newReorgDetector(depth uint64) *reorgDetector {
+	return &reorgDetector{depth: depth, hashes: make(map[uint64]common.Hash)}
+}
+
+// observe records a new head, and returns the lowest height which may have
+// been reorged if a reorg is detected. headerAt is used to look up the
+// current header at previously observed heights. Reorgs deeper than depth
+// are only reported back to the oldest tracked height.
+func (d *reorgDetector) observe(head blockHeader, headerAt func(uint64) (blockHeader, error)) (uint64, bool, error) {
+	n := uint64(head.Number)
+	heights := make([]uint64, 0, len(d.hashes))
+	for h := range d.hashes {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	from, reorged := n+1, false
+	for _, h := range heights {
+		if h > n {
+			reorged = true // Head went backwards.
+			continue
+		}
+		var hash common.Hash
+		switch {
+		case h == n:
+			hash = head.Hash
+		case h+1 == n:
+			hash = head.ParentHash
+		default:
+			hdr, err := headerAt(h)
+			if err != nil {
+				return 0, false, err
+			}
+			hash = hdr.Hash
+		}
+		if hash == d.hashes[h] {
+			// Common ancestor. Unobserved heights above it may have been reorged too.
+			from = h + 1
+			break
+		}
+		from, reorged = h, true
+	}
+	if !reorged {
+		// Only the highest tracked height at or below the head was checked.
+		d.record(head)
+		return 0, false, nil
+	}
+	for h := range d.hashes {
+		if h >= from {
+			delete(d.hashes, h)
+		}
+	}
+	d.record(head)
+	return from, true, nil
+}
+
+// record tracks head and its parent, and forgets heights more than depth
+// below it.
+func (d *reorgDetector) record(head blockHeader) {
+	n := uint64(head.Number)
+	d.hashes[n] = head.Hash
+	if n > 0 {
+		d.hashes[n-1] = head.ParentHash
+	}
+	for h := range d.hashes {
+		if h+d.depth < n {
+			delete(d.hashes, h)
+		}
+	}
+}
+
+// header fetches the header of block, a number or tag, from upstream.
+func (l *latestBlock) header(ctx context.Context, block string) (blockHeader, error) {
+	var h *blockHeader
+	if err := l.rpcClient.CallContext(ctx, &h, "eth_getBlockByNumber", block, false); err != nil {
+		return blockHeader{}, err
+	}
+	if h == nil {
+		return blockHeader{}, errors.New("block not found: " + block)
+	}
+	return *h, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+)
+
+func TestReorgDetector(t *testing.T) {
+	// chain maps height to hash for the current canonical chain.
+	chain := map[uint64]common.Hash{}
+	header := func(n uint64) blockHeader {
+		h := blockHeader{Number: hexutil.Uint64(n), Hash: chain[n]}
+		if n > 0 {
+			h.ParentHash = chain[n-1]
+		}
+		return h
+	}
+	headerAt := func(n uint64) (blockHeader, error) { return header(n), nil }
+	for n := uint64(0); n <= 20; n++ {
+		chain[n] = common.HexToHash(hexutil.EncodeUint64(n))
+	}
+
+	d := newReorgDetector(8)
+	for _, n := range []uint64{10, 11, 14, 20} {
+		if from, reorged, err := d.observe(header(n), headerAt); err != nil || reorged {
+			t.Fatalf("head %d: unexpected reorg from %d: %v", n, from, err)
+		}
+	}
+
+	// Replace blocks 18 and above.
+	for n := uint64(18); n <= 21; n++ {
+		chain[n] = common.HexToHash(hexutil.EncodeUint64(1000 + n))
+	}
+	from, reorged, err := d.observe(header(21), headerAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reorged || from != 15 {
+		t.Errorf("expected reorg from 15 (after the last matching height 14) but got %d %t", from, reorged)
+	}
+
+	// Head goes backwards, to a height which wasn't observed.
+	from, reorged, err = d.observe(header(19), headerAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reorged || from != 15 {
+		t.Errorf("expected reorg from 15 but got %d %t", from, reorged)
+	}
+
+	// Head goes backwards, to an observed height.
+	if _, _, err := d.observe(header(21), headerAt); err != nil {
+		t.Fatal(err)
+	}
+	from, reorged, err = d.observe(header(20), headerAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reorged || from != 21 {
+		t.Errorf("expected reorg from 21 but got %d %t", from, reorged)
+	}
+
+	// Same head again.
+	if from, reorged, err := d.observe(header(20), headerAt); err != nil || reorged {
+		t.Errorf("unexpected reorg from %d: %v", from, err)
+	}
+}
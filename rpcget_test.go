@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryRequest(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		exp     string // expected body, empty if unchanged
+		wantErr bool
+	}{
+		{query: ""},
+		{query: "foo=bar"},
+		{query: "method=eth_chainId", exp: `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`},
+		{query: "method=eth_getBlockByNumber&params=100&params=true&id=7", exp: `{"jsonrpc":"2.0","id":7,"method":"eth_getBlockByNumber","params":["0x64",true]}`},
+		{query: "method=eth_getBlockByNumber&id=abc", exp: `{"jsonrpc":"2.0","id":"abc","method":"eth_getBlockByNumber","params":["latest",false]}`},
+		{query: "method=eth_getBlockByNumber&params=foo", wantErr: true},
+		{query: "method=eth_chainId&params=1", wantErr: true},
+		{query: "method=eth_blockNumber", exp: `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`},
+		{query: "method=eth_blockNumber&params=latest", wantErr: true},
+		{query: "method=eth_sendRawTransaction&params=0x00", wantErr: true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+test.query, nil)
+		err := queryRequest(req)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: expected error %t, got: %v", test.query, test.wantErr, err)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if test.exp == "" {
+			if req.Method != http.MethodGet {
+				t.Errorf("%q: expected request to be unchanged, got %s", test.query, req.Method)
+			}
+			continue
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Method != http.MethodPost || req.URL.RawQuery != "" {
+			t.Errorf("%q: expected POST without query, got %s %s", test.query, req.Method, req.URL)
+		}
+		if string(body) != test.exp {
+			t.Errorf("%q: expected body %s but got %s", test.query, test.exp, body)
+		}
+	}
+}
+
+func TestRoundTrip_queryRequests(t *testing.T) {
+	var method, body string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, body = r.Method, string(b)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	})
+
+	tr := newTestTransport(t, "eth_getBlockByNumber")
+	tr.queryRequests = true
+	for _, test := range []struct {
+		query string
+		exp   int
+	}{
+		{"method=eth_getBlockByNumber&params=100", http.StatusOK},
+		{"method=eth_getBalance&params=0x0000000000000000000000000000000000000000", http.StatusMethodNotAllowed},
+		{"method=eth_getBlockByNumber&params=foo", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"?"+test.query, nil)
+		req.RequestURI = ""
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.exp {
+			t.Errorf("%q: expected status %d but got %d", test.query, test.exp, res.StatusCode)
+		}
+	}
+	if method != http.MethodPost {
+		t.Errorf("expected upstream to receive a POST, got %s", method)
+	}
+	if exp := `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x64",false]}`; body != exp {
+		t.Errorf("expected upstream body %s but got %s", exp, body)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// shadowTimeout bounds each mirrored request, so a slow shadow upstream can't
+// pile up goroutines.
+const shadowTimeout = 10 * time.Second
+
+// shadowSampled returns true if parsedRequests should be mirrored to the
+// shadow upstream. Only idempotent requests are mirrored, which rules out
+// eth_sendRawTransaction and anything else with side effects.
+func (t *myTransport) shadowSampled(parsedRequests []ModifiedRequest) bool {
+	if t.shadowURL == nil || t.shadowSampleRate <= 0 || !idempotent(parsedRequests) {
+		return false
+	}
+	return rand.Float64() < t.shadowSampleRate
+}
+
+// mirror sends a copy of req to the shadow upstream and logs if its response
+// differs from the primary one. It is meant to be run in its own goroutine;
+// the shadow response is never returned to the client.
+func (t *myTransport) mirror(ctx context.Context, req *http.Request, primary []byte) {
+	body, err := requestBody(req)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to copy request for shadow upstream: %v", err)
+		return
+	}
+	shadowCtx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	out, err := http.NewRequestWithContext(shadowCtx, http.MethodPost, t.shadowURL.String(), bytes.NewReader(body))
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to create shadow request: %v", err)
+		return
+	}
+	out.Header.Set("Content-Type", "application/json")
+	upstream := t.upstream
+	if upstream == nil {
+		upstream = http.DefaultTransport
+	}
+	res, err := upstream.RoundTrip(out)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Shadow request failed: %v", err)
+		return
+	}
+	shadow, err := readBody(res, t.maxResponseBytes)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to read shadow response: %v", err)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		gotils.L(ctx).Info().Printf("Shadow response differs, status: %s", res.Status)
+		return
+	}
+	if !sameJSON(primary, shadow) {
+		gotils.L(ctx).Info().Print("Shadow response differs")
+		gotils.L(ctx).Debug().Printf("Shadow response differs, primary: %q shadow: %q", sniff(primary), sniff(shadow))
+	}
+}
+
+// sniff returns the start of a body, at most sniffBytes, for logging.
+func sniff(b []byte) []byte {
+	b = bytes.TrimSpace(b)
+	if len(b) > sniffBytes {
+		return b[:sniffBytes]
+	}
+	return b
+}
+
+// sameJSON returns true if a and b hold the same JSON value, ignoring key
+// order and whitespace.
+func sameJSON(a, b []byte) bool {
+	na, err := normalizeJSON(a)
+	if err != nil {
+		return bytes.Equal(a, b)
+	}
+	nb, err := normalizeJSON(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(na, nb)
+}
+
+// parseShadowURL parses the shadow upstream URL, which must be http(s).
+func parseShadowURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported shadow URL scheme: %q", u.Scheme)
+	}
+	return u, nil
+}
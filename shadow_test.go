@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip_shadow(t *testing.T) {
+	primary := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+	mirrored := make(chan string, 10)
+	shadow := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(b)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x2"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId", "eth_sendRawTransaction")
+	tr.shadowURL, _ = url.Parse(shadow.URL)
+	tr.shadowSampleRate = 1
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x01"]}`,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`,
+	} {
+		resp := testRoundTrip(t, tr, primary.URL, body)
+		b, _ := ioutil.ReadAll(resp.Body)
+		if !strings.Contains(string(b), `"0x1"`) {
+			t.Errorf("expected primary response, got %s", b)
+		}
+	}
+
+	select {
+	case got := <-mirrored:
+		if !strings.Contains(got, "eth_chainId") {
+			t.Errorf("expected only eth_chainId to be mirrored, got %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+	select {
+	case got := <-mirrored:
+		t.Errorf("unexpected mirrored request: %s", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSameJSON(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		exp  bool
+	}{
+		{`{"id":1,"result":"0x1"}`, `{"result":"0x1", "id":1}`, true},
+		{`{"id":1,"result":"0x1"}`, `{"id":1,"result":"0x2"}`, false},
+		{`[1,2]`, `[2,1]`, false},
+		{`not json`, `not json`, true},
+	} {
+		if got := sameJSON([]byte(test.a), []byte(test.b)); got != test.exp {
+			t.Errorf("sameJSON(%s, %s) = %t, expected %t", test.a, test.b, got, test.exp)
+		}
+	}
+}
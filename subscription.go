@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// subscriptionKinds are the subscription types clients may request with
+// eth_subscribe.
+var subscriptionKinds = map[string]struct{}{
+	"newHeads":               {},
+	"logs":                   {},
+	"newPendingTransactions": {},
+	"syncing":                {},
+}
+
+// subscriptionFilter restricts the subscription types clients may request.
+// The zero value allows every type.
+type subscriptionFilter struct {
+	allow map[string]struct{} // nil means all
+	deny  map[string]struct{}
+}
+
+func newSubscriptionFilter(allow, deny []string) (subscriptionFilter, error) {
+	var f subscriptionFilter
+	var err error
+	if f.allow, err = subscriptionSet(allow); err != nil {
+		return f, err
+	}
+	if f.deny, err = subscriptionSet(deny); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// subscriptionSet returns the set of kinds, or nil if there are none.
+func subscriptionSet(kinds []string) (map[string]struct{}, error) {
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]struct{}, len(kinds))
+	for _, k := range kinds {
+		if _, ok := subscriptionKinds[k]; !ok {
+			return nil, fmt.Errorf("unknown subscription type: %q", k)
+		}
+		set[k] = struct{}{}
+	}
+	return set, nil
+}
+
+// allowed returns true if clients may subscribe to kind.
+func (f subscriptionFilter) allowed(kind string) bool {
+	if _, ok := f.deny[kind]; ok {
+		return false
+	}
+	if f.allow == nil {
+		return true
+	}
+	_, ok := f.allow[kind]
+	return ok
+}
+
+// checkAddresses returns an error if the filter query has more than
+// maxAddresses addresses. A maxAddresses of 0 means none.
+func checkAddresses(filter json.RawMessage, maxAddresses int) error {
+	if maxAddresses <= 0 {
+		return nil
+	}
+	var fq struct {
+		Address json.RawMessage `json:"address"`
+	}
+	if err := json.Unmarshal(filter, &fq); err != nil {
+		return err
+	}
+	if len(fq.Address) == 0 || fq.Address[0] != '[' {
+		return nil // Single address or none.
+	}
+	var addrs []json.RawMessage
+	if err := json.Unmarshal(fq.Address, &addrs); err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	if len(addrs) > maxAddresses {
+		return fmt.Errorf("too many addresses (%d), limit is %d", len(addrs), maxAddresses)
+	}
+	return nil
+}
+
+func jsonRPCSubscriptionNotAllowed(id json.RawMessage, kind string) interface{} {
+	return jsonRPCError(id, jsonRPCMethodNotAllowed, "You are not authorized to subscribe to: "+kind)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBlock_subscriptions(t *testing.T) {
+	tr := newTestTransport(t, "eth_subscribe")
+	var err error
+	tr.subscriptions, err = newSubscriptionFilter(nil, []string{"newPendingTransactions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.maxTopicAlternatives = 2
+	tr.maxLogAddresses = 2
+	for _, test := range []struct {
+		params string
+		code   int
+	}{
+		{`["newHeads"]`, 0},
+		{`["newPendingTransactions"]`, http.StatusMethodNotAllowed},
+		{`["logs",{"address":"0x0000000000000000000000000000000000000001"}]`, 0},
+		{`["logs",{"address":["0x01","0x02"],"topics":[["0x01","0x02"]]}]`, 0},
+		{`["logs",{"address":["0x01","0x02","0x03"]}]`, http.StatusBadRequest},
+		{`["logs",{"topics":[["0x01","0x02","0x03"]]}]`, http.StatusBadRequest},
+		{`[1]`, http.StatusBadRequest},
+	} {
+		var params []json.RawMessage
+		if err := json.Unmarshal([]byte(test.params), &params); err != nil {
+			t.Fatal(err)
+		}
+		code, resp := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_subscribe", RemoteAddr: "1.2.3.4", Params: params}})
+		if code != test.code {
+			t.Errorf("%s: expected status %d, got %d %v", test.params, test.code, code, resp)
+		}
+	}
+
+	tr.subscriptions, _ = newSubscriptionFilter([]string{"newHeads"}, nil)
+	if code, _ := tr.block(context.Background(), []ModifiedRequest{{Path: "eth_subscribe", RemoteAddr: "1.2.3.4", Params: []json.RawMessage{json.RawMessage(`"syncing"`)}}}); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected subscription outside allow list to be blocked, got %d", code)
+	}
+
+	if _, err := newSubscriptionFilter([]string{"newBlocks"}, nil); err == nil {
+		t.Error("expected error for unknown subscription type")
+	}
+}
+
+func TestWebsocketProxy_subscriptionNotAllowed(t *testing.T) {
+	tr := newTestTransport(t, "eth_subscribe")
+	tr.subscriptions, _ = newSubscriptionFilter(nil, []string{"logs"})
+	u := newTestWSProxy(t, &WebsocketProxy{Transport: tr})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["logs",{}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ErrResponse
+	if err := json.Unmarshal(got, &resp); err != nil || resp.Error.Code != jsonRPCMethodNotAllowed || string(resp.ID) != "3" {
+		t.Fatalf("expected subscription not allowed error, got: %s %v", got, err)
+	}
+}
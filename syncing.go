@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// isSyncing returns true if the upstream last reported that it is syncing, so
+// its reads may be stale.
+func (t *myTransport) isSyncing() bool {
+	return atomic.LoadInt32(&t.syncing) == 1
+}
+
+// setSyncing records whether the upstream is syncing, logging any change.
+func (t *myTransport) setSyncing(ctx context.Context, on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.syncing, v) == v {
+		return
+	}
+	if on {
+		gotils.L(ctx).Info().Print("Upstream is syncing, rejecting reads")
+	} else {
+		gotils.L(ctx).Info().Print("Upstream is synced, serving reads")
+	}
+}
+
+// pollSyncing asks the upstream for eth_syncing now and then every interval,
+// until ctx is done. Failed probes are logged, and the last known state kept.
+func (t *myTransport) pollSyncing(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		syncing, err := t.probeSyncing(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			gotils.L(ctx).Error().Printf("Failed to probe syncing status: %v", err)
+		} else {
+			t.setSyncing(ctx, syncing)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeSyncing returns true unless the upstream answers eth_syncing with
+// false. Syncing nodes answer with their progress instead.
+func (t *myTransport) probeSyncing(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	result, err := t.call(req, "eth_syncing")
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(bytes.TrimSpace(result), []byte("false")), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollSyncing(t *testing.T) {
+	var syncing int32 = 1
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&syncing) == 1 {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"startingBlock":"0x0","currentBlock":"0x10","highestBlock":"0x100"}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":false}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId", "eth_syncing", "eth_sendRawTransaction")
+	tr.url = upstream.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.pollSyncing(ctx, 10*time.Millisecond)
+
+	waitFor := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for tr.isSyncing() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected syncing to be %t", want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	request := func(method string, params ...json.RawMessage) []ModifiedRequest {
+		return []ModifiedRequest{{Path: method, RemoteAddr: "1.2.3.4", Params: params}}
+	}
+
+	waitFor(true)
+	if code, resp := tr.block(ctx, request("eth_chainId")); code != http.StatusServiceUnavailable {
+		t.Errorf("expected reads to be rejected while syncing, got: %d %v", code, resp)
+	} else if e, ok := resp.(ErrResponse); !ok || e.Error.Code != jsonRPCSyncing {
+		t.Errorf("expected syncing error, got: %v", resp)
+	}
+	if code, resp := tr.block(ctx, request("eth_syncing")); resp != nil {
+		t.Errorf("expected eth_syncing to be allowed, got: %d %v", code, resp)
+	}
+	if code, resp := tr.block(ctx, request("eth_sendRawTransaction", json.RawMessage(`"0x00"`))); resp != nil {
+		t.Errorf("expected transactions to be allowed, got: %d %v", code, resp)
+	}
+
+	atomic.StoreInt32(&syncing, 0)
+	waitFor(false)
+	if code, resp := tr.block(ctx, request("eth_chainId")); resp != nil {
+		t.Errorf("expected reads to be allowed once synced, got: %d %v", code, resp)
+	}
+}
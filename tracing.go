@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the proxy's spans. It is a no-op until initTracing installs
+// a tracer provider.
+var tracer = otel.Tracer("github.com/gochain-io/rpc-proxy")
+
+// cacheAttr records whether a span's response was served from cache.
+const cacheAttr = attribute.Key("rpc.cache")
+
+// initTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://collector:4318, and propagates trace context to upstreams. It returns
+// a func which flushes and stops the export.
+func initTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid otlp endpoint %q: scheme must be http or https", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("rpc-proxy"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a span for the JSON-RPC request req.
+func startSpan(req *http.Request) (context.Context, trace.Span) {
+	return tracer.Start(req.Context(), "jsonrpc", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.RPCSystemKey.String("jsonrpc")))
+}
+
+// endSpan records the outcome of a request on span and ends it.
+func endSpan(span trace.Span, res *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if res != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+		if res.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+		}
+	}
+	span.End()
+}
+
+// setMethods records the JSON-RPC methods of a request on span.
+func setMethods(span trace.Span, methods []string) {
+	if len(methods) == 1 {
+		span.SetAttributes(semconv.RPCMethodKey.String(methods[0]))
+		return
+	}
+	span.SetAttributes(attribute.StringSlice("rpc.methods", methods))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRoundTrip_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func(orig propagation.TextMapPropagator) { otel.SetTextMapPropagator(orig) }(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func(orig trace.Tracer) { tracer = orig }(tracer)
+	tracer = tp.Tracer("test")
+
+	var traceparent string
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	tr.cache = newResponseCache(10)
+	tr.cachePolicies = map[string]CachePolicy{"eth_chainId": {Cache: true, TTL: time.Minute}}
+	for i := 0; i < 2; i++ {
+		req := newTestRequest(upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if !strings.Contains(traceparent, spans[0].SpanContext().TraceID().String()) {
+		t.Errorf("expected trace context to be propagated, got traceparent %q", traceparent)
+	}
+	for i, exp := range []map[attribute.Key]string{
+		{semconv.RPCMethodKey: "eth_chainId", cacheAttr: "miss", semconv.HTTPStatusCodeKey: "200"},
+		{semconv.RPCMethodKey: "eth_chainId", cacheAttr: "hit", semconv.HTTPStatusCodeKey: "200"},
+	} {
+		attrs := make(map[attribute.Key]string)
+		for _, kv := range spans[i].Attributes() {
+			attrs[kv.Key] = kv.Value.Emit()
+		}
+		for k, v := range exp {
+			if attrs[k] != v {
+				t.Errorf("span %d: expected %s=%s, got %q", i, k, v, attrs[k])
+			}
+		}
+	}
+}
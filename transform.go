@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+)
+
+// TransformConfig lists the transforms applied to a method's requests before
+// they are forwarded, and to its results before they are returned, in order.
+// Each entry is a transform name, optionally followed by a colon and an
+// argument, e.g. "rewrite_method:eth_chainId".
+type TransformConfig struct {
+	Request  []string `toml:",omitempty"`
+	Response []string `toml:",omitempty"`
+}
+
+// responseTransform returns a rewritten copy of a method's result.
+type responseTransform func(result json.RawMessage) (json.RawMessage, error)
+
+// transform is a single step of a pipeline. Exactly one of request and
+// response is set.
+type transform struct {
+	name     string
+	request  func(r *ModifiedRequest) error
+	response responseTransform
+}
+
+// transforms are the built-in transforms by name. Each constructor is passed
+// the configured argument, which is empty if there was none. validate checks
+// the params against the built-in validators of the request's method as it
+// is at that point of the pipeline, e.g. after rewrite_method.
+var transforms = map[string]func(arg string) (transform, error){
+	"validate": func(arg string) (transform, error) {
+		return transform{request: func(r *ModifiedRequest) error {
+			if min := defaultMinParams[r.Path]; len(r.Params) < min {
+				return fmt.Errorf("missing params: %s requires at least %d", r.Path, min)
+			}
+			if v, ok := defaultParamValidators[r.Path]; ok {
+				return v(r.Params)
+			}
+			return nil
+		}}, nil
+	},
+	"normalize_params": func(arg string) (transform, error) {
+		return transform{request: func(r *ModifiedRequest) error {
+			for i, p := range r.Params {
+				n, err := normalizeJSON(p)
+				if err != nil {
+					return err
+				}
+				r.Params[i] = n
+			}
+			return nil
+		}}, nil
+	},
+	"rewrite_method": func(arg string) (transform, error) {
+		if arg == "" {
+			return transform{}, errors.New("missing method")
+		}
+		return transform{request: func(r *ModifiedRequest) error {
+			r.Path = arg
+			return nil
+		}}, nil
+	},
+	"floor_gas_price": func(arg string) (transform, error) {
+		floor, ok := new(big.Int).SetString(arg, 0)
+		if !ok || floor.Sign() < 0 {
+			return transform{}, fmt.Errorf("invalid gas price: %q", arg)
+		}
+		return transform{response: func(result json.RawMessage) (json.RawMessage, error) {
+			var price hexutil.Big
+			if err := json.Unmarshal(result, &price); err != nil {
+				return nil, err
+			}
+			if price.ToInt().Cmp(floor) >= 0 {
+				return result, nil
+			}
+			return json.Marshal((*hexutil.Big)(floor))
+		}}, nil
+	},
+	"strip_fields": func(arg string) (transform, error) {
+		if arg == "" {
+			return transform{}, errors.New("missing fields")
+		}
+		fields := strings.Split(arg, ",")
+		return transform{response: func(result json.RawMessage) (json.RawMessage, error) {
+			return stripFields(result, fields)
+		}}, nil
+	},
+}
+
+// pipeline is the sequence of transforms for a method.
+type pipeline struct {
+	request, response []transform
+}
+
+// newPipelines builds the per-method pipelines from configured, returning
+// an error for unknown or misplaced transforms.
+func newPipelines(configured map[string]TransformConfig) (map[string]*pipeline, error) {
+	if len(configured) == 0 {
+		return nil, nil
+	}
+	ps := make(map[string]*pipeline, len(configured))
+	for method, c := range configured {
+		p := &pipeline{}
+		for _, spec := range c.Request {
+			tr, err := newTransform(spec)
+			if err != nil {
+				return nil, fmt.Errorf("transforms for %s: %v", method, err)
+			}
+			if tr.request == nil {
+				return nil, fmt.Errorf("transforms for %s: %s is not a request transform", method, tr.name)
+			}
+			p.request = append(p.request, tr)
+		}
+		for _, spec := range c.Response {
+			tr, err := newTransform(spec)
+			if err != nil {
+				return nil, fmt.Errorf("transforms for %s: %v", method, err)
+			}
+			if tr.response == nil {
+				return nil, fmt.Errorf("transforms for %s: %s is not a response transform", method, tr.name)
+			}
+			p.response = append(p.response, tr)
+		}
+		ps[method] = p
+	}
+	return ps, nil
+}
+
+func newTransform(spec string) (transform, error) {
+	name, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	newFn, ok := transforms[name]
+	if !ok {
+		return transform{}, fmt.Errorf("unknown transform: %q", name)
+	}
+	tr, err := newFn(arg)
+	if err != nil {
+		return transform{}, fmt.Errorf("%s: %v", name, err)
+	}
+	tr.name = name
+	return tr, nil
+}
+
+// registerResponseTransform adds fn, named name in errors, to the end of the
+// response pipeline of method, after any configured transforms. Results of
+// methods with no transforms are returned as is. It must only be called before
+// serving, as requests read the pipelines without a lock.
+func (t *myTransport) registerResponseTransform(method, name string, fn responseTransform) {
+	if t.pipelines == nil {
+		t.pipelines = make(map[string]*pipeline)
+	}
+	p := t.pipelines[method]
+	if p == nil {
+		p = &pipeline{}
+		t.pipelines[method] = p
+	}
+	p.response = append(p.response, transform{name: name, response: fn})
+}
+
+// transformRequests applies the request pipelines to parsedRequests in place,
+// and rewrites the body of req if any were changed.
+func (t *myTransport) transformRequests(req *http.Request, parsedRequests []ModifiedRequest) error {
+	var changed bool
+	for i := range parsedRequests {
+		p := t.pipelines[parsedRequests[i].Path]
+		if p == nil || len(p.request) == 0 {
+			continue
+		}
+		for _, tr := range p.request {
+			if err := tr.request(&parsedRequests[i]); err != nil {
+				return fmt.Errorf("%s: %v", tr.name, err)
+			}
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return rewriteRequests(req, func(reqs []map[string]json.RawMessage) (bool, error) {
+		if len(reqs) != len(parsedRequests) {
+			return false, fmt.Errorf("body has %d requests, parsed %d", len(reqs), len(parsedRequests))
+		}
+		for i, r := range parsedRequests {
+			method, err := json.Marshal(r.Path)
+			if err != nil {
+				return false, err
+			}
+			reqs[i]["method"] = method
+			if r.Params != nil {
+				params, err := json.Marshal(r.Params)
+				if err != nil {
+					return false, err
+				}
+				reqs[i]["params"] = params
+			}
+		}
+		return true, nil
+	})
+}
+
+// requestBody returns a copy of the body of req, which parseRequests made
+// readable again.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, errors.New("request body can't be read again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// rewriteRequests decodes the body of req, a single request or a batch,
+// passes its requests to rewrite, and replaces the body with them if rewrite
+// reports a change. Members rewrite doesn't touch are kept as they were.
+func rewriteRequests(req *http.Request, rewrite func(reqs []map[string]json.RawMessage) (bool, error)) error {
+	b, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+	batch := isBatch(b)
+	var reqs []map[string]json.RawMessage
+	if batch {
+		err = json.Unmarshal(b, &reqs)
+	} else {
+		reqs = make([]map[string]json.RawMessage, 1)
+		err = json.Unmarshal(b, &reqs[0])
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range reqs {
+		if r == nil {
+			return errors.New("request is not an object")
+		}
+	}
+	changed, err := rewrite(reqs)
+	if err != nil || !changed {
+		return err
+	}
+	var body []byte
+	if batch {
+		body, err = json.Marshal(reqs)
+	} else {
+		body, err = json.Marshal(reqs[0])
+	}
+	if err != nil {
+		return err
+	}
+	setRequestBody(req, body)
+	return nil
+}
+
+// setRequestBody replaces the body of req, which may be read again.
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// hasResponseTransforms returns true if any of methods has response
+// transforms.
+func (t *myTransport) hasResponseTransforms(methods []string) bool {
+	for _, m := range methods {
+		if p := t.pipelines[m]; p != nil && len(p.response) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// transformResponses applies the response pipelines of methods, the
+// originally requested methods in the same order as parsedRequests, to the
+// results in body.
+func (t *myTransport) transformResponses(body []byte, methods []string, parsedRequests []ModifiedRequest) ([]byte, error) {
+	apply := func(resp map[string]json.RawMessage, method string) error {
+		result, ok := resp["result"]
+		if !ok {
+			return nil
+		}
+		p := t.pipelines[method]
+		if p == nil {
+			return nil
+		}
+		for _, tr := range p.response {
+			var err error
+			result, err = tr.response(result)
+			if err != nil {
+				return fmt.Errorf("%s: %v", tr.name, err)
+			}
+		}
+		resp["result"] = result
+		return nil
+	}
+	if isBatch(body) {
+		// Batch responses may be in any order, so match them up by id.
+		byID := make(map[string]string, len(parsedRequests))
+		for i, r := range parsedRequests {
+			if i < len(methods) {
+				byID[string(responseID(r.ID))] = methods[i]
+			}
+		}
+		var resps []map[string]json.RawMessage
+		if err := json.Unmarshal(body, &resps); err != nil {
+			return nil, err
+		}
+		for _, resp := range resps {
+			if err := apply(resp, byID[string(responseID(resp["id"]))]); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(resps)
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if len(methods) == 0 {
+		return body, nil
+	}
+	if err := apply(resp, methods[0]); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+// stripFields removes fields from an object result, or from each object in
+// an array result.
+func stripFields(result json.RawMessage, fields []string) (json.RawMessage, error) {
+	strip := func(obj json.RawMessage) (json.RawMessage, error) {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(obj, &m); err != nil || m == nil {
+			return obj, nil // Not an object.
+		}
+		for _, f := range fields {
+			delete(m, f)
+		}
+		return json.Marshal(m)
+	}
+	var arr []json.RawMessage
+	if err := json.Unmarshal(result, &arr); err != nil {
+		return strip(result)
+	}
+	for i, el := range arr {
+		s, err := strip(el)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = s
+	}
+	return json.Marshal(arr)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestNewPipelines(t *testing.T) {
+	data := `[Transforms.eth_gasPrice]
+Response = ["floor_gas_price:1000"]
+[Transforms.eth_call]
+Request = ["normalize_params", "rewrite_method:eth_call2"]
+`
+	var cfg ConfigData
+	if err := toml.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	ps, err := newPipelines(cfg.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ps["eth_call"]; p == nil || len(p.request) != 2 || len(p.response) != 0 {
+		t.Errorf("unexpected eth_call pipeline: %+v", p)
+	}
+
+	for _, invalid := range []TransformConfig{
+		{Request: []string{"unknown"}},
+		{Request: []string{"floor_gas_price:1"}},
+		{Response: []string{"normalize_params"}},
+		{Request: []string{"rewrite_method"}},
+		{Response: []string{"floor_gas_price:abc"}},
+		{Response: []string{"strip_fields"}},
+	} {
+		if _, err := newPipelines(map[string]TransformConfig{"eth_call": invalid}); err == nil {
+			t.Errorf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestRoundTrip_transforms(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var reqs []struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			t.Errorf("invalid upstream request %s: %v", body, err)
+			return
+		}
+		var resps []string
+		for _, r := range reqs {
+			var result string
+			switch r.Method {
+			case "eth_gasPrice":
+				result = `"0x5"`
+			case "eth_getBlockByNumber":
+				result = `{"number":"0x1","logsBloom":"0x00"}`
+			default:
+				result = `"` + r.Method + `"` // Echo rewritten methods.
+			}
+			resps = append(resps, `{"jsonrpc":"2.0","id":`+string(r.ID)+`,"result":`+result+`}`)
+		}
+		w.Write([]byte("[" + strings.Join(resps, ",") + "]"))
+	})
+
+	tr := newTestTransport(t, "eth_gasPrice", "eth_getBlockByNumber", "eth_chainId")
+	var err error
+	tr.pipelines, err = newPipelines(map[string]TransformConfig{
+		"eth_gasPrice":         {Response: []string{"floor_gas_price:0x10"}},
+		"eth_getBlockByNumber": {Response: []string{"strip_fields:logsBloom"}},
+		"eth_chainId":          {Request: []string{"rewrite_method:net_version"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice"},
+{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByNumber","params":["0x1",false]},
+{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}]`
+	resp := testRoundTrip(t, tr, upstream.URL, body)
+	defer resp.Body.Close()
+	var got []struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[int]string{
+		1: `"0x10"`,
+		2: `{"number":"0x1"}`,
+		3: `"net_version"`,
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d responses, got %d", len(exp), len(got))
+	}
+	for _, r := range got {
+		if string(r.Result) != exp[r.ID] {
+			t.Errorf("%d: expected %s, got %s", r.ID, exp[r.ID], r.Result)
+		}
+	}
+}
+
+func TestRegisterResponseTransform(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x5"}`))
+	})
+
+	tr := newTestTransport(t, "eth_chainId")
+	var err error
+	tr.pipelines, err = newPipelines(map[string]TransformConfig{
+		"eth_chainId": {Response: []string{"floor_gas_price:0x7"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered transforms run after configured ones.
+	tr.registerResponseTransform("eth_chainId", "upper", func(result json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(strings.ToUpper(string(result))), nil
+	})
+
+	resp := testRoundTrip(t, tr, upstream.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	defer resp.Body.Close()
+	var got struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Result) != `"0X7"` {
+		t.Errorf("expected transformed result \"0X7\", got %s", got.Result)
+	}
+	if tr.hasResponseTransforms([]string{"eth_blockNumber"}) {
+		t.Error("expected methods without registered transforms to have none")
+	}
+}
+
+func TestTransformRequests(t *testing.T) {
+	tr := newTestTransport(t)
+	var err error
+	tr.pipelines, err = newPipelines(map[string]TransformConfig{
+		"eth_chainId":    {Request: []string{"rewrite_method:eth_getBalance", "validate"}},
+		"eth_getBalance": {Request: []string{"validate"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		body    string
+		exp     string // expected body, empty if rejected
+		getBody bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"],"extra":true}`,
+			`{"extra":true,"id":1,"jsonrpc":"2.0","method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x00","latest"]}`, "", true},
+		// The rewritten method is validated with its own params.
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, "", true},
+		// The body can't be rewritten without a copy.
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}`, "", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		_, _, parsed, err := parseRequests(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.getBody {
+			req.GetBody = nil
+		}
+		err = tr.transformRequests(req, parsed)
+		if test.exp == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", test.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.body, err)
+			continue
+		}
+		if got, err := requestBody(req); err != nil || string(got) != test.exp {
+			t.Errorf("%s: expected body %s, got %s %v", test.body, test.exp, got, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// validate checks cfg, including its listen address, and reports every
+// problem found. It doesn't connect to anything or start any background work.
+func (cfg *ConfigData) validate() []error {
+	var errs []error
+	if _, err := listenAddress(cfg.ListenAddr, cfg.Port); err != nil {
+		errs = append(errs, err)
+	}
+	return append(errs, cfg.problems()...)
+}
+
+// problems returns every problem with cfg which NewServer rejects, rather
+// than only the first, so that validate and NewServer always agree.
+func (cfg *ConfigData) problems() []error {
+	var errs []error
+	check := func(err error, format string) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf(format, err))
+		}
+	}
+
+	check(validURL(cfg.URL), "invalid url: %v")
+	if cfg.WSURL != "" {
+		check(validURL(cfg.WSURL), "invalid ws url: %v")
+	}
+	for _, u := range cfg.WSFailoverURLs {
+		check(validURL(u), "invalid ws failover url: %v")
+	}
+	routes := make([]string, 0, len(cfg.Routes))
+	for method := range cfg.Routes {
+		routes = append(routes, method)
+	}
+	sort.Strings(routes) // Report in a stable order.
+	for _, method := range routes {
+		if err := validURL(cfg.Routes[method]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid route for %s: %v", method, err))
+		}
+	}
+	if cfg.ArchiveURL != "" {
+		check(validURL(cfg.ArchiveURL), "invalid archive url: %v")
+	}
+	if cfg.ShadowURL != "" {
+		_, err := parseShadowURL(cfg.ShadowURL)
+		check(err, "invalid shadow url: %v")
+		if cfg.ShadowSampleRate < 0 || cfg.ShadowSampleRate > 1 {
+			errs = append(errs, fmt.Errorf("shadow sample rate must be between 0 and 1: %v", cfg.ShadowSampleRate))
+		}
+	}
+	if cfg.RedisURL != "" {
+		_, err := redis.ParseURL(cfg.RedisURL)
+		check(err, "invalid redis url: %v")
+	}
+	for _, ip := range cfg.NoLimit {
+		if net.ParseIP(normalizeIP(ip)) == nil {
+			errs = append(errs, fmt.Errorf("invalid nolimit ip: %q", ip))
+		}
+	}
+
+	_, err := parseIPSet(cfg.AllowedIPs)
+	check(err, "invalid allowed ips: %v")
+	_, err = parseIPSet(cfg.TrustedProxies)
+	check(err, "invalid trusted proxies: %v")
+	if cfg.ClientIDHeader != "" && len(cfg.TrustedProxies) == 0 {
+		errs = append(errs, fmt.Errorf("client id header: requires TrustedProxies"))
+	}
+
+	_, err = newMatcher(cfg.Allow, cfg.Deny...)
+	check(err, "invalid allow or deny: %v")
+	_, err = parseAPIKeys(cfg.Keys, cfg.Deny)
+	check(err, "invalid keys: %v")
+	_, err = newSubscriptionFilter(cfg.AllowSubscriptions, cfg.DenySubscriptions)
+	check(err, "invalid subscriptions: %v")
+	_, err = parseBlockedSenders(cfg.BlockedSenders)
+	check(err, "invalid blocked senders: %v")
+	_, err = minParams(cfg.MinParams)
+	check(err, "invalid min params: %v")
+	_, err = methodCosts(cfg.MethodCosts)
+	check(err, "invalid method costs: %v")
+	if cfg.MaxCallDataBytes < 0 {
+		errs = append(errs, fmt.Errorf("max call data bytes: must not be negative"))
+	}
+	_, err = parseDeprecations(cfg.Deprecations)
+	check(err, "invalid deprecations: %v")
+	_, err = parseRateLimitKey(cfg.RateLimitKey)
+	check(err, "invalid rate limit key: %v")
+	check(validPrefixes(cfg.RateLimitIPv4Prefix, cfg.RateLimitIPv6Prefix), "%v")
+	_, err = newPipelines(cfg.Transforms)
+	check(err, "invalid transforms: %v")
+	_, err = parseIDType(cfg.IDType)
+	check(err, "%v")
+	check(tunePool(&http.Transport{}, cfg), "%v")
+	for method, d := range cfg.MethodTimeouts {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("invalid timeout for %s: %s", method, d))
+		}
+	}
+
+	var policies map[string]CachePolicy
+	if cfg.EnableCache {
+		policies, err = cachePolicies(cfg.Cache, cfg.CacheTTL)
+		check(err, "invalid cache: %v")
+	} else {
+		if cfg.SubscribeNewHeads {
+			errs = append(errs, fmt.Errorf("subscribe new heads: requires EnableCache"))
+		}
+		if len(cfg.CacheTTL) > 0 {
+			errs = append(errs, fmt.Errorf("cache TTL: requires EnableCache"))
+		}
+	}
+	for _, m := range cfg.RefreshOnNewHead {
+		if p := policies[m]; !p.Cache {
+			errs = append(errs, fmt.Errorf("refresh on new head: %s is not cached", m))
+		}
+	}
+
+	if cfg.EnablePprof && cfg.AdminToken == "" {
+		errs = append(errs, fmt.Errorf("enable pprof: requires AdminToken"))
+	}
+	if cfg.RPCGetQuery && !cfg.AllowRPCGet {
+		errs = append(errs, fmt.Errorf("rpc get query: requires AllowRPCGet"))
+	}
+	if cfg.WSBridgeInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid ws bridge interval: %s", cfg.WSBridgeInterval))
+	}
+	check(cfg.validBridge(), "%v")
+	if c := cfg.WSViolationCloseCode; c != 0 && (c < 1000 || c > 4999) {
+		errs = append(errs, fmt.Errorf("invalid websocket close code: %d", c))
+	}
+	return errs
+}
+
+// validBridge returns an error if the websocket bridge is enabled along with
+// settings which need a websocket upstream.
+func (cfg *ConfigData) validBridge() error {
+	if cfg.WSBridgeInterval <= 0 {
+		return nil
+	}
+	if cfg.WSURL != "" || len(cfg.WSFailoverURLs) > 0 {
+		return fmt.Errorf("ws bridge interval: conflicts with WSURL")
+	}
+	if cfg.SubscribeNewHeads {
+		return fmt.Errorf("subscribe new heads: requires WSURL, use HeadPollInterval with the ws bridge")
+	}
+	return nil
+}
+
+// validURL returns an error if s doesn't parse as an absolute URL.
+func validURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("missing scheme: %q", s)
+	}
+	return nil
+}
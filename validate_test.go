@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigData_validate(t *testing.T) {
+	cfg := ConfigData{
+		URL:              "http://127.0.0.1:8040",
+		WSURL:            "ws://127.0.0.1:8041",
+		Allow:            []string{"eth_*"},
+		NoLimit:          []string{"10.0.0.1", "[::1]:8545"},
+		ShadowURL:        "http://127.0.0.1:8042",
+		ShadowSampleRate: 0.5,
+	}
+	if errs := cfg.validate(); len(errs) != 0 {
+		t.Fatalf("expected valid config, got: %v", errs)
+	}
+
+	cfg.URL = "127.0.0.1:8040"
+	cfg.Routes = map[string]string{"eth_getLogs": "logs"}
+	cfg.NoLimit = append(cfg.NoLimit, "10.0.0.0/8")
+	cfg.Allow = append(cfg.Allow, "eth_(")
+	cfg.ShadowSampleRate = 2
+	cfg.RefreshOnNewHead = []string{"eth_blockNumber"}
+	errs := cfg.validate()
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	for _, exp := range []string{
+		"invalid url:",
+		"invalid route for eth_getLogs:",
+		`invalid nolimit ip: "10.0.0.0/8"`,
+		"invalid allow or deny:",
+		"shadow sample rate must be between 0 and 1",
+		"refresh on new head: eth_blockNumber is not cached",
+	} {
+		found := false
+		for _, g := range got {
+			found = found || strings.HasPrefix(g, exp)
+		}
+		if !found {
+			t.Errorf("expected error starting with %q, got: %q", exp, got)
+		}
+	}
+	if len(errs) != 6 {
+		t.Errorf("expected 6 errors, got %d: %q", len(errs), got)
+	}
+}
+
+func TestConfigData_validateBridge(t *testing.T) {
+	cfg := ConfigData{URL: "http://127.0.0.1:8040", WSBridgeInterval: time.Second}
+	if errs := cfg.validate(); len(errs) != 0 {
+		t.Fatalf("expected valid config without WSURL, got: %v", errs)
+	}
+	cfg.WSURL = "ws://127.0.0.1:8041"
+	if errs := cfg.validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "conflicts with WSURL") {
+		t.Errorf("expected the bridge to conflict with WSURL, got: %v", errs)
+	}
+	cfg.WSURL = ""
+	cfg.SubscribeNewHeads, cfg.EnableCache = true, true
+	if errs := cfg.validate(); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "subscribe new heads: requires WSURL") {
+		t.Errorf("expected SubscribeNewHeads to require WSURL, got: %v", errs)
+	}
+}
+
+func TestNewServer_rejectsProblems(t *testing.T) {
+	for _, cfg := range []ConfigData{
+		{URL: "http://127.0.0.1:8040", CacheTTL: map[string]time.Duration{"eth_chainId": time.Minute}},
+		{URL: "http://127.0.0.1:8040", MaxCallDataBytes: -1},
+		{URL: "http://127.0.0.1:8040", RPCGetQuery: true},
+		{URL: "127.0.0.1:8040"},
+	} {
+		errs := cfg.validate()
+		if len(errs) == 0 {
+			t.Errorf("%+v: expected validate to report a problem", cfg)
+			continue
+		}
+		if _, err := cfg.NewServer(); err == nil || err.Error() != errs[0].Error() {
+			t.Errorf("%+v: expected NewServer to fail with %q, got: %v", cfg, errs[0], err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,9 +11,13 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/treeder/gotils/v2"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -44,6 +49,10 @@ type WebsocketProxy struct {
 	// unmodified request.
 	Backend func(*http.Request) *url.URL
 
+	// Failover, if non-nil, returns backup backend URLs which are tried in
+	// order when connecting to the Backend URL fails.
+	Failover func(*http.Request) []*url.URL
+
 	// Upgrader specifies the parameters for upgrading a incoming HTTP
 	// connection to a WebSocket connection. If nil, DefaultUpgrader is used.
 	Upgrader *websocket.Upgrader
@@ -53,12 +62,61 @@ type WebsocketProxy struct {
 	Dialer *websocket.Dialer
 
 	Transport *myTransport
+
+	// MessagesPerMinute limits the rate of client messages on a single
+	// connection, in addition to the per-IP limit shared with HTTP requests.
+	// 0 means none.
+	MessagesPerMinute int
+	// MaxViolations is the number of rate limited client messages after which
+	// the connection is closed. 0 means never close.
+	MaxViolations int
+
+	// ViolationCloseCode is the close code sent when a connection is closed
+	// after MaxViolations, defaults to 1008 (policy violation). Codes from
+	// 4000 to 4999 are reserved for applications.
+	ViolationCloseCode int
+
+	// LogDropped enables logging of each dropped client message with the
+	// reason it was dropped.
+	LogDropped bool
+
+	// PingInterval is how often the client is pinged. A client which doesn't
+	// answer a ping within PongTimeout is disconnected. 0 means never ping.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for a pong, defaults to PingInterval.
+	PongTimeout time.Duration
+	// IdleTimeout closes connections which relayed no messages in either
+	// direction for this long. Pings and pongs don't count. 0 means none.
+	IdleTimeout time.Duration
+
+	// ReconnectTimeout is how long to keep trying to reconnect to the backend
+	// after the connection was lost, before closing the client connection.
+	// Active subscriptions are replayed on the new connection. 0 means the
+	// client connection is closed right away.
+	ReconnectTimeout time.Duration
+
+	// Bridge, if positive, serves connections without a websocket backend.
+	// Subscriptions are emulated by polling the HTTP upstream of Transport
+	// this often, and other requests are sent to it over HTTP.
+	Bridge time.Duration
+
+	// MaxConnections caps the number of live proxied connections. 0 means none.
+	MaxConnections int64
+	// MaxConnectionsPerIP caps the number of live proxied connections from a
+	// single client IP. 0 means none.
+	MaxConnectionsPerIP int
+
+	conns int64 // Live connections, accessed atomically.
+
+	ipConnsMu sync.Mutex // Protects ipConns.
+	ipConns   map[string]int
 }
 
 // NewProxy returns a new Websocket reverse proxy that rewrites the
-// URL's to the scheme, host and base path provider in target.
-func NewProxy(target *url.URL) *WebsocketProxy {
-	backend := func(r *http.Request) *url.URL {
+// URL's to the scheme, host and base path provider in target. Any failover
+// targets are rewritten the same way, and tried in order if target is down.
+func NewProxy(target *url.URL, failover ...*url.URL) *WebsocketProxy {
+	rewrite := func(target *url.URL, r *http.Request) *url.URL {
 		// Shallow copy
 		u := *target
 		u.Fragment = r.URL.Fragment
@@ -66,7 +124,19 @@ func NewProxy(target *url.URL) *WebsocketProxy {
 		u.RawQuery = r.URL.RawQuery
 		return &u
 	}
-	return &WebsocketProxy{Backend: backend}
+	w := &WebsocketProxy{Backend: func(r *http.Request) *url.URL {
+		return rewrite(target, r)
+	}}
+	if len(failover) > 0 {
+		w.Failover = func(r *http.Request) []*url.URL {
+			us := make([]*url.URL, len(failover))
+			for i, f := range failover {
+				us[i] = rewrite(f, r)
+			}
+			return us
+		}
+	}
+	return w
 }
 
 // ServeHTTP implements the http.Handler that proxies WebSocket connections.
@@ -85,6 +155,29 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	ip := getIP(req)
+	// The key and client ID apply to every message on the connection.
+	key := req.Header.Get(apiKeyHeader)
+	var clientID string
+	if w.Transport != nil {
+		if !w.Transport.knownAPIKey(key) {
+			gotils.L(ctx).Info().Print("Connection rejected: Invalid API key")
+			http.Error(rw, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		clientID = w.Transport.clientID(req)
+	}
+	if !w.acquireConn(ctx, ip) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer w.releaseConn(ip)
+
+	if w.Bridge > 0 {
+		w.serveBridge(rw, req, ip, key, clientID)
+		return
+	}
+
 	dialer := w.Dialer
 	if w.Dialer == nil {
 		dialer = DefaultDialer
@@ -99,9 +192,6 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	for _, prot := range req.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
 		requestHeader.Add("Sec-WebSocket-Protocol", prot)
 	}
-	for _, cookie := range req.Header[http.CanonicalHeaderKey("Cookie")] {
-		requestHeader.Add("Cookie", cookie)
-	}
 	if req.Host != "" {
 		requestHeader.Set("Host", req.Host)
 	}
@@ -140,7 +230,22 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// opening a new TCP connection time for each request. This should be
 	// optional:
 	// http://tools.ietf.org/html/draft-ietf-hybi-websocket-multiplexing-01
-	connBackend, resp, err := dialer.Dial(backendURL.String(), requestHeader)
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		u := backendURL
+		conn, resp, err := dialer.Dial(u.String(), requestHeader)
+		if err != nil && w.Failover != nil {
+			for _, f := range w.Failover(req) {
+				gotils.L(ctx).Error().Printf("websocketproxy: failed to dial %s, failing over to %s: %s", u.Host, f.Host, err)
+				u = f
+				conn, resp, err = dialer.Dial(u.String(), requestHeader)
+				if err == nil {
+					break
+				}
+			}
+		}
+		return conn, resp, err
+	}
+	connBackend, resp, err := dial()
 	if err != nil {
 		gotils.L(ctx).Error().Printf("websocketproxy:%s", err)
 		if resp != nil {
@@ -155,7 +260,8 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	defer connBackend.Close()
+	backend := &syncConn{Conn: connBackend}
+	defer backend.Close()
 
 	upgrader := w.Upgrader
 	if w.Upgrader == nil {
@@ -180,12 +286,41 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	defer connPub.Close()
 
+	done := make(chan struct{}) // Closed once the handler returns.
+	defer close(done)
+
+	var lastActive int64 // Unix nanoseconds of the last relayed message, accessed atomically.
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+	w.expectPongs(connPub)
+
+	connLimiter := w.connLimiter()
+
+	var subs *wsSubscriptions // nil unless subscriptions are replayed on reconnect.
+	if w.ReconnectTimeout > 0 {
+		subs = newWSSubscriptions()
+	}
+	var clientClosed int32 // Set once the client connection is done, accessed atomically.
+
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(ctx context.Context, ip string, limit bool, dst, src *websocket.Conn, errc chan error) {
+	replicateWebsocketConn := func(ctx context.Context, ip string, limit bool, dst, src *syncConn, errc chan error) {
+		var violations int // Rate limited client messages.
 		for {
 			msgType, msg, err := src.ReadMessage()
 			if err != nil {
+				if limit {
+					atomic.StoreInt32(&clientClosed, 1)
+				} else if subs != nil && atomic.LoadInt32(&clientClosed) == 0 {
+					gotils.L(ctx).Info().Printf("websocketproxy: backend connection lost, reconnecting: %v", err)
+					if err = w.reconnect(ctx, dst, src, dial, subs, done); err == nil {
+						continue
+					}
+					gotils.L(ctx).Error().Printf("websocketproxy: failed to reconnect: %v", err)
+					errc <- err
+					dst.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream unavailable"))
+					break
+				}
 				gotils.L(ctx).Error().Printf("websocketproxy: ReadMessage %s", err)
 				m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
 				if e, ok := err.(*websocket.CloseError); ok {
@@ -197,28 +332,52 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				dst.WriteMessage(websocket.CloseMessage, m)
 				break
 			}
+			touch()
+			var res []ModifiedRequest // Parsed client message.
 			if limit && len(msg) > 0 {
-				methods, res, err := parseMessage(msg, ip)
+				if msgType != websocket.TextMessage {
+					err := errors.New("unsupported message type")
+					w.logDropped(ctx, ip, err.Error(), nil)
+					errc <- err
+					src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+					break
+				}
+				var methods []string
+				methods, res, err = parseMessage(msg, ip)
 				if err != nil {
+					w.logDropped(ctx, ip, err.Error(), nil)
 					errc <- err
-					err = src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err)))
-					if err != nil {
-						errc <- err
-					}
+					src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, err.Error()))
+					break
+				}
+				setAPIKey(res, key)
+				setClientID(res, clientID)
+				msgCtx := gotils.With(ctx, "remoteIp", ip)
+				msgCtx = gotils.With(msgCtx, "methods", methods)
+				resp, err := w.check(msgCtx, ip, connLimiter, &violations, methods, res)
+				if err != nil {
+					errc <- err
+					src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(w.violationCloseCode(), err.Error()))
 					break
 				}
-				ctx = gotils.With(ctx, "remoteIp", ip)
-				ctx = gotils.With(ctx, "methods", methods)
-				if len(methods) > 0 {
-					_, resp := w.Transport.block(ctx, res)
-					if resp != nil {
-						errc <- errors.New(resp.(ErrResponse).Error.Message)
-						err = src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, resp.(ErrResponse).Error.Message))
-						if err != nil {
-							errc <- err
-						}
+				if resp != nil {
+					// Drop the frame and reply with the error instead.
+					b, err := json.Marshal(resp)
+					if err == nil {
+						err = src.WriteMessage(websocket.TextMessage, b)
+					}
+					if err != nil {
+						errc <- err
 						break
 					}
+					continue
+				}
+				if subs != nil {
+					msg = subs.request(msg, res)
+				}
+			} else if !limit && subs != nil && len(msg) > 0 {
+				if msg = subs.response(msg); msg == nil {
+					continue
 				}
 			}
 			if len(msg) == 0 { //workaround for empty message and a wrong type
@@ -229,15 +388,33 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				}
 			}
 			err = dst.WriteMessage(msgType, msg)
+			if err != nil && limit && subs != nil && len(res) > 0 {
+				// The backend is being reconnected, so the message is lost.
+				subs.forget(res)
+				b, err := json.Marshal(jsonRPCUpstreamUnavailable(res[0].ID))
+				if err == nil {
+					err = src.WriteMessage(websocket.TextMessage, b)
+				}
+				if err != nil {
+					errc <- err
+					break
+				}
+				continue
+			}
 			if err != nil {
 				errc <- err
 				break
 			}
 		}
 	}
-	ip := getIP(req)
-	go replicateWebsocketConn(ctx, ip, true, connBackend, connPub, errBackend)
-	go replicateWebsocketConn(ctx, ip, false, connPub, connBackend, errClient)
+	pub := &syncConn{Conn: connPub}
+	go replicateWebsocketConn(ctx, ip, true, backend, pub, errBackend)
+	go replicateWebsocketConn(ctx, ip, false, pub, backend, errClient)
+
+	errKeepalive := make(chan error, 1)
+	if w.PingInterval > 0 || w.IdleTimeout > 0 {
+		go w.keepalive(pub, &lastActive, done, errKeepalive)
+	}
 
 	var message string
 	select {
@@ -245,13 +422,265 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		message = "websocketproxy: Error when copying from backend to client: %v"
 	case err = <-errBackend:
 		message = "websocketproxy: Error when copying from client to backend: %v"
-
+	case err = <-errKeepalive:
+		gotils.L(ctx).Info().Printf("websocketproxy: closing connection: %v", err)
+		return
 	}
 	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
 		gotils.L(ctx).Error().Printf("%s %s", message, err)
 	}
 }
 
+// connLimiter returns a limiter for the messages of a single client
+// connection, or nil if MessagesPerMinute is 0.
+func (w *WebsocketProxy) connLimiter() *rate.Limiter {
+	if w.MessagesPerMinute <= 0 {
+		return nil
+	}
+	burst := w.MessagesPerMinute / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(w.MessagesPerMinute)), burst)
+}
+
+// expectPongs sets a read deadline on the client connection conn which each
+// pong extends, so a client which stops answering pings is disconnected.
+func (w *WebsocketProxy) expectPongs(conn *websocket.Conn) {
+	if w.PingInterval <= 0 {
+		return
+	}
+	pongWait := w.PingInterval + w.pongTimeout()
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// check applies the connection limiter and the limits shared with HTTP
+// requests to the client message res, returning the error to reply with if
+// it must be dropped. It returns an error once the client has been rate
+// limited MaxViolations times, and the connection must be closed.
+func (w *WebsocketProxy) check(ctx context.Context, ip string, limiter *rate.Limiter, violations *int, methods []string, res []ModifiedRequest) (interface{}, error) {
+	code, resp := 0, interface{}(nil)
+	if limiter != nil && !limiter.Allow() {
+		gotils.L(ctx).Info().Print("Message blocked: Connection rate limited")
+		code, resp = http.StatusTooManyRequests, jsonRPCLimit(res[0].ID, time.Minute/time.Duration(w.MessagesPerMinute))
+	} else if len(methods) > 0 {
+		code, resp = w.Transport.block(ctx, res)
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	w.logDropped(ctx, ip, resp.(ErrResponse).Error.Message, res)
+	if code == http.StatusTooManyRequests {
+		if err := w.violation(ctx, ip, violations); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// violation counts a rate limited client message, returning an error once
+// there have been MaxViolations of them.
+func (w *WebsocketProxy) violation(ctx context.Context, ip string, violations *int) error {
+	*violations++
+	if w.MaxViolations > 0 && *violations >= w.MaxViolations {
+		err := errors.New("too many rate limited messages")
+		w.logDropped(ctx, ip, err.Error(), nil)
+		return err
+	}
+	return nil
+}
+
+func (w *WebsocketProxy) violationCloseCode() int {
+	if w.ViolationCloseCode > 0 {
+		return w.ViolationCloseCode
+	}
+	return websocket.ClosePolicyViolation
+}
+
+var errIdleTimeout = errors.New("idle timeout")
+
+func (w *WebsocketProxy) pongTimeout() time.Duration {
+	if w.PongTimeout > 0 {
+		return w.PongTimeout
+	}
+	return w.PingInterval
+}
+
+// keepalive pings the client every PingInterval and closes the connection
+// once no message has been relayed for IdleTimeout. A missed pong is detected
+// by the read deadline of the client read loop instead. It reports why it
+// closed the connection on errc, and returns early once done is closed.
+func (w *WebsocketProxy) keepalive(conn *syncConn, lastActive *int64, done <-chan struct{}, errc chan<- error) {
+	var ping, idle <-chan time.Time
+	if w.PingInterval > 0 {
+		ticker := time.NewTicker(w.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	var idleTimer *time.Timer
+	if w.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(w.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(w.pongTimeout())); err != nil {
+				errc <- fmt.Errorf("failed to ping: %v", err)
+				return
+			}
+		case <-idle:
+			last := time.Unix(0, atomic.LoadInt64(lastActive))
+			if remaining := w.IdleTimeout - time.Since(last); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			m := websocket.FormatCloseMessage(websocket.CloseGoingAway, errIdleTimeout.Error())
+			conn.WriteControl(websocket.CloseMessage, m, time.Now().Add(time.Second))
+			errc <- errIdleTimeout
+			return
+		}
+	}
+}
+
+// reconnect replaces the lost backend connection, retrying with backoff for
+// up to ReconnectTimeout, and replays subs on the new connection. Requests in
+// flight to the lost one are first answered with an error on client. It gives
+// up early once done is closed.
+func (w *WebsocketProxy) reconnect(ctx context.Context, client, backend *syncConn, dial func() (*websocket.Conn, *http.Response, error), subs *wsSubscriptions, done <-chan struct{}) error {
+	for _, id := range subs.unanswered() {
+		b, err := json.Marshal(jsonRPCUpstreamUnavailable(id))
+		if err != nil {
+			return err
+		}
+		if err := client.WriteMessage(websocket.TextMessage, b); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(w.ReconnectTimeout)
+	backoff := 100 * time.Millisecond
+	for {
+		conn, _, err := dial()
+		if err == nil {
+			if err = subs.replay(conn); err == nil {
+				backend.swap(conn)
+				gotils.L(ctx).Info().Print("websocketproxy: reconnected to backend")
+				return nil
+			}
+			conn.Close()
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("gave up after %s: %v", w.ReconnectTimeout, err)
+		}
+		select {
+		case <-done:
+			return errors.New("connection closed")
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// logDropped logs a client message which was dropped instead of being relayed
+// to the backend, along with any subscription types it requested. Nothing is
+// logged unless LogDropped is set.
+func (w *WebsocketProxy) logDropped(ctx context.Context, ip, reason string, res []ModifiedRequest) {
+	if !w.LogDropped {
+		return
+	}
+	var subs []string
+	for _, r := range res {
+		if r.Path != "eth_subscribe" || len(r.Params) == 0 {
+			continue
+		}
+		var kind string
+		if err := json.Unmarshal(r.Params[0], &kind); err == nil {
+			subs = append(subs, kind)
+		}
+	}
+	gotils.L(ctx).Info().Println("websocketproxy: dropped message, reason:", reason, "ip:", ip, "subscriptions:", subs)
+}
+
+// syncConn serializes writes to a websocket.Conn, which supports only one
+// concurrent writer. Replies to blocked client messages are written from the
+// client read loop while backend messages are relayed to the same connection.
+type syncConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+// Close closes the underlying connection.
+func (c *syncConn) Close() error {
+	c.mu.Lock()
+	conn := c.Conn
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+// swap replaces the underlying connection, closing the old one. Only the
+// goroutine reading from c may call swap.
+func (c *syncConn) swap(conn *websocket.Conn) {
+	c.mu.Lock()
+	old := c.Conn
+	c.Conn = conn
+	c.mu.Unlock()
+	old.Close()
+}
+
+func (c *syncConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// acquireConn reserves a connection slot for ip, returning false if either the
+// total or the per-IP connection cap has been reached. Every successful
+// acquireConn must be paired with a call to releaseConn.
+func (w *WebsocketProxy) acquireConn(ctx context.Context, ip string) bool {
+	if n := atomic.AddInt64(&w.conns, 1); w.MaxConnections > 0 && n > w.MaxConnections {
+		atomic.AddInt64(&w.conns, -1)
+		gotils.L(ctx).Info().Printf("websocketproxy: connection cap reached, max: %d", w.MaxConnections)
+		return false
+	}
+	if w.MaxConnectionsPerIP > 0 {
+		w.ipConnsMu.Lock()
+		if w.ipConns[ip] >= w.MaxConnectionsPerIP {
+			w.ipConnsMu.Unlock()
+			atomic.AddInt64(&w.conns, -1)
+			gotils.L(ctx).Info().Printf("websocketproxy: per-IP connection cap reached, ip: %s max: %d", ip, w.MaxConnectionsPerIP)
+			return false
+		}
+		if w.ipConns == nil {
+			w.ipConns = make(map[string]int)
+		}
+		w.ipConns[ip]++
+		w.ipConnsMu.Unlock()
+	}
+	return true
+}
+
+// releaseConn frees a slot reserved by acquireConn.
+func (w *WebsocketProxy) releaseConn(ip string) {
+	atomic.AddInt64(&w.conns, -1)
+	if w.MaxConnectionsPerIP > 0 {
+		w.ipConnsMu.Lock()
+		if n := w.ipConns[ip]; n > 1 {
+			w.ipConns[ip] = n - 1
+		} else {
+			delete(w.ipConns, ip)
+		}
+		w.ipConnsMu.Unlock()
+	}
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
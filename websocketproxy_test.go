@@ -0,0 +1,824 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSProxy starts an echo websocket backend and a proxy in front of it,
+// returning the proxy's websocket URL.
+func newTestWSProxy(t *testing.T, w *WebsocketProxy) string {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := DefaultUpgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	u, err := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(u)
+	p.Transport = w.Transport
+	p.MessagesPerMinute = w.MessagesPerMinute
+	p.MaxViolations = w.MaxViolations
+	p.ViolationCloseCode = w.ViolationCloseCode
+	p.PingInterval = w.PingInterval
+	p.PongTimeout = w.PongTimeout
+	p.IdleTimeout = w.IdleTimeout
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestWebsocketProxy_messageRateLimit(t *testing.T) {
+	u := newTestWSProxy(t, &WebsocketProxy{
+		Transport:         newTestTransport(t, "eth_chainId"),
+		MessagesPerMinute: 1,
+		MaxViolations:     2,
+	})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := c.ReadMessage(); err != nil || string(got) != msg {
+		t.Fatalf("expected echo, got: %s %v", got, err)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Error struct {
+			Code int       `json:"code"`
+			Data retryData `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(got, &resp); err != nil || resp.Error.Code != jsonRPCRateLimited {
+		t.Fatalf("expected rate limit error, got: %s %v", got, err)
+	}
+	if resp.Error.Data.RetryAfter != 60 {
+		t.Errorf("expected retry after 60s, got: %s", got)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got: %v", err)
+	}
+}
+
+func TestWebsocketProxy_violationCloseCode(t *testing.T) {
+	u := newTestWSProxy(t, &WebsocketProxy{
+		Transport:          newTestTransport(t, "eth_chainId"),
+		MessagesPerMinute:  1,
+		MaxViolations:      1,
+		ViolationCloseCode: 4429,
+	})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	for i := 0; i < 2; i++ {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for err == nil {
+		_, _, err = c.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, 4429) {
+		t.Errorf("expected custom close code, got: %v", err)
+	}
+}
+
+func TestWebsocketProxy_methodNotAllowed(t *testing.T) {
+	u := newTestWSProxy(t, &WebsocketProxy{Transport: newTestTransport(t, "eth_chainId")})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":7,"method":"debug_traceBlock"}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ErrResponse
+	if err := json.Unmarshal(got, &resp); err != nil || resp.Error.Code != jsonRPCMethodNotAllowed || string(resp.ID) != "7" {
+		t.Fatalf("expected method not allowed error, got: %s %v", got, err)
+	}
+
+	if err := c.WriteMessage(websocket.BinaryMessage, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Errorf("expected unsupported data close, got: %v", err)
+	}
+}
+
+func TestWebsocketProxy_visitorRateLimit(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 10 // Burst of 1, shared with HTTP requests from the same IP.
+	u := newTestWSProxy(t, &WebsocketProxy{Transport: tr})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := c.ReadMessage(); err != nil || string(got) != msg {
+		t.Fatalf("expected echo, got: %s %v", got, err)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ErrResponse
+	if err := json.Unmarshal(got, &resp); err != nil || resp.Error.Code != jsonRPCRateLimited || string(resp.ID) != "2" {
+		t.Fatalf("expected rate limit error, got: %s %v", got, err)
+	}
+	tr.RLock()
+	defer tr.RUnlock()
+	if len(tr.visitors) != 1 {
+		t.Errorf("expected a single visitor but got %d", len(tr.visitors))
+	}
+}
+
+func TestWebsocketProxy_clientID(t *testing.T) {
+	tr := newTestTransport(t, "eth_chainId")
+	trusted, err := parseIPSet([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.clientIDHeader, tr.trustedProxies = "X-Consumer-ID", trusted
+	defer func(limit int) { requestLimit = limit }(requestLimit)
+	requestLimit = 10 // Burst of 1 per client.
+	u := newTestWSProxy(t, &WebsocketProxy{Transport: tr})
+
+	for _, test := range []struct {
+		id   string
+		code int // 0 means allowed
+	}{
+		{"alice", 0},
+		{"bob", 0}, // Behind the same proxy IP as alice.
+		{"alice", jsonRPCRateLimited},
+	} {
+		c, _, err := websocket.DefaultDialer.Dial(u, http.Header{"X-Consumer-ID": {test.id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := c.ReadMessage()
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp ErrResponse
+		json.Unmarshal(got, &resp)
+		if test.code == 0 && string(got) != msg {
+			t.Errorf("%s: expected echo, got: %s", test.id, got)
+		} else if test.code != 0 && resp.Error.Code != test.code {
+			t.Errorf("%s: expected error %d, got: %s", test.id, test.code, got)
+		}
+	}
+}
+
+func TestWebsocketProxy_ping(t *testing.T) {
+	u := newTestWSProxy(t, &WebsocketProxy{
+		Transport:    newTestTransport(t, "eth_chainId"),
+		PingInterval: 20 * time.Millisecond,
+	})
+
+	// A client answering pings stays connected.
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pinged := make(chan struct{}, 1)
+	c.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	msgs := make(chan string)
+	go func() {
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- string(msg)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pinged:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected ping %d", i+1)
+		}
+	}
+	msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-msgs; got != msg {
+		t.Fatalf("expected echo, got: %q", got)
+	}
+
+	// A client which doesn't answer is disconnected.
+	c2, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetPingHandler(func(string) error { return nil })
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := c2.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("expected the proxy to close the connection")
+			}
+			break
+		}
+	}
+}
+
+func TestWebsocketProxy_idleTimeout(t *testing.T) {
+	const idleTimeout = 200 * time.Millisecond
+	u := newTestWSProxy(t, &WebsocketProxy{
+		Transport:   newTestTransport(t, "eth_chainId"),
+		IdleTimeout: idleTimeout,
+	})
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Traffic keeps the connection open past the timeout.
+	msg := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+	for i := 0; i < 8; i++ {
+		<-ticker.C
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected going away close, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected close after idle timeout, took %s", d)
+	}
+}
+
+// subscriptionBackend is a websocket backend answering eth_subscribe with a
+// new subscription ID, followed by a notification for it.
+type subscriptionBackend struct {
+	*httptest.Server
+	mu           sync.Mutex
+	conns        []*websocket.Conn
+	subs         int
+	unsubscribed chan string
+	ignored      chan string // Methods of requests left unanswered.
+}
+
+func newSubscriptionBackend(t *testing.T) *subscriptionBackend {
+	b := &subscriptionBackend{unsubscribed: make(chan string, 10), ignored: make(chan string, 10)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c, err := DefaultUpgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b.mu.Lock()
+		b.conns = append(b.conns, c)
+		b.mu.Unlock()
+		for {
+			var req wsRequest
+			if err := c.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Method {
+			case "eth_subscribe":
+				b.mu.Lock()
+				b.subs++
+				id := fmt.Sprintf("0xsub%d", b.subs)
+				b.mu.Unlock()
+				c.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": id})
+				c.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "eth_subscription", "params": map[string]interface{}{"subscription": id, "result": "0x1"}})
+			case "eth_unsubscribe":
+				var id string
+				json.Unmarshal(req.Params[0], &id)
+				b.unsubscribed <- id
+				c.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": true})
+			default:
+				b.ignored <- req.Method
+			}
+		}
+	}))
+	t.Cleanup(b.Server.Close)
+	return b
+}
+
+// drop abruptly closes every backend connection.
+func (b *subscriptionBackend) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.UnderlyingConn().Close()
+	}
+	b.conns = nil
+}
+
+func TestWebsocketProxy_reconnect(t *testing.T) {
+	backend := newSubscriptionBackend(t)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	p := NewProxy(u)
+	p.Transport = newTestTransport(t, "eth_subscribe", "eth_unsubscribe", "eth_blockNumber")
+	p.ReconnectTimeout = 2 * time.Second
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg wsMessage
+	expectSubscription := func(id string) {
+		t.Helper()
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Method != "eth_subscription" || msg.Params.Subscription != id {
+			t.Fatalf("expected notification for %s, got %+v", id, msg)
+		}
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&msg); err != nil || string(msg.Result) != `"0xsub1"` {
+		t.Fatalf("expected subscription id, got %+v %v", msg, err)
+	}
+	expectSubscription("0xsub1")
+
+	// A request in flight to the lost backend connection is answered with an
+	// error, and the subscription is replayed on the new one, under the ID the
+	// client knows.
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}`)); err != nil {
+		t.Fatal(err)
+	}
+	<-backend.ignored
+	backend.drop()
+	var errResp ErrResponse
+	if err := c.ReadJSON(&errResp); err != nil || string(errResp.ID) != "2" || errResp.Error.Code != jsonRPCUpstreamDown {
+		t.Fatalf("expected upstream unavailable error, got %+v %v", errResp, err)
+	}
+	expectSubscription("0xsub1")
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":3,"method":"eth_unsubscribe","params":["0xsub1"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&msg); err != nil || string(msg.Result) != "true" {
+		t.Fatalf("expected unsubscribe result, got %+v %v", msg, err)
+	}
+	if got := <-backend.unsubscribed; got != "0xsub2" {
+		t.Errorf("expected backend to unsubscribe 0xsub2, got %s", got)
+	}
+}
+
+func TestWebsocketProxy_failover(t *testing.T) {
+	primary, backup := newSubscriptionBackend(t), newSubscriptionBackend(t)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(primary.URL, "http"))
+	f, _ := url.Parse("ws" + strings.TrimPrefix(backup.URL, "http"))
+	p := NewProxy(u, f)
+	p.Transport = newTestTransport(t, "eth_subscribe")
+	p.ReconnectTimeout = 2 * time.Second
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	dial := func() *websocket.Conn {
+		t.Helper()
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	subscribe := func(c *websocket.Conn) {
+		t.Helper()
+		if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)); err != nil {
+			t.Fatal(err)
+		}
+		var msg wsMessage
+		for i := 0; i < 2; i++ { // The subscription ID, then a notification.
+			if err := c.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	subs := func(b *subscriptionBackend) int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.subs
+	}
+
+	c := dial()
+	defer c.Close()
+	subscribe(c)
+	if n := subs(primary); n != 1 {
+		t.Fatalf("expected the primary to serve the subscription, got %d", n)
+	}
+
+	// Killing the primary moves the open connection to the backup.
+	primary.Close()
+	primary.drop()
+	var msg wsMessage
+	if err := c.ReadJSON(&msg); err != nil || msg.Method != "eth_subscription" || msg.Params.Subscription != "0xsub1" {
+		t.Fatalf("expected replayed notification, got %+v %v", msg, err)
+	}
+	if n := subs(backup); n != 1 {
+		t.Errorf("expected the subscription to be replayed on the backup, got %d", n)
+	}
+
+	// New connections go straight to the backup.
+	c2 := dial()
+	defer c2.Close()
+	subscribe(c2)
+	if n := subs(backup); n != 2 {
+		t.Errorf("expected the backup to serve the new connection, got %d subscriptions", n)
+	}
+}
+
+func TestWebsocketProxy_reconnectTimeout(t *testing.T) {
+	backend := newSubscriptionBackend(t)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	p := NewProxy(u)
+	p.Transport = newTestTransport(t, "eth_subscribe")
+	p.ReconnectTimeout = 300 * time.Millisecond
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	backend.Close()
+	backend.drop()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("expected try again later close, got: %v", err)
+	}
+}
+
+func TestWebsocketProxy_bridge(t *testing.T) {
+	var head uint64 = 10
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer node-secret" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var result string
+		switch req.Method {
+		case "eth_chainId":
+			result = `"0x5"`
+		case "eth_blockNumber":
+			// Every poll finds a new head.
+			result = fmt.Sprintf(`"0x%x"`, atomic.AddUint64(&head, 1))
+		case "eth_getBlockByNumber":
+			result = fmt.Sprintf(`{"number":%s,"transactions":[]}`, req.Params[0])
+		case "eth_getLogs":
+			var filter logFilter
+			json.Unmarshal(req.Params[0], &filter)
+			result = fmt.Sprintf(`[{"address":%s,"blockNumber":%q}]`, filter.Address, filter.FromBlock)
+		}
+		fmt.Fprintf(rw, `{"jsonrpc":"2.0","id":%s,"result":%s}`, req.ID, result)
+	}))
+	defer upstream.Close()
+
+	p := NewProxy(&url.URL{})
+	p.Transport = newTestTransport(t, "eth_chainId", "eth_subscribe", "eth_unsubscribe", "eth_blockNumber", "eth_getBlockByNumber", "eth_getLogs")
+	p.Transport.url = upstream.URL
+	p.Transport.upstreamHeaders = map[string]string{"Authorization": "Bearer node-secret"}
+	p.Bridge = 20 * time.Millisecond
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		wsMessage
+		Params struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result"`
+		} `json:"params"`
+	}
+	call := func(req string) {
+		t.Helper()
+		if err := c.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		msg.Result, msg.Error = nil, nil
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Other requests are sent to the upstream over HTTP.
+	call(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	if string(msg.Result) != `"0x5"` {
+		t.Fatalf("expected chain id from upstream, got %s %s", msg.Result, msg.Error)
+	}
+	// And checked like HTTP requests.
+	call(`{"jsonrpc":"2.0","id":7,"method":"eth_sendTransaction"}`)
+	if !strings.Contains(string(msg.Error), "not authorized") {
+		t.Errorf("expected eth_sendTransaction to be blocked, got %s %s", msg.Result, msg.Error)
+	}
+	call(`{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["newPendingTransactions"]}`)
+	if !strings.Contains(string(msg.Error), "not supported") {
+		t.Errorf("expected newPendingTransactions to be rejected, got %s %s", msg.Result, msg.Error)
+	}
+	call(`[{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["newHeads"]}]`)
+	if msg.Error == nil {
+		t.Errorf("expected batched subscription to be rejected, got %s", msg.Result)
+	}
+
+	var heads, logs string
+	call(`{"jsonrpc":"2.0","id":4,"method":"eth_subscribe","params":["newHeads"]}`)
+	json.Unmarshal(msg.Result, &heads)
+	call(`{"jsonrpc":"2.0","id":5,"method":"eth_subscribe","params":["logs",{"address":"0x01","fromBlock":"0x0"}]}`)
+	json.Unmarshal(msg.Result, &logs)
+	if heads == "" || logs == "" || heads == logs {
+		t.Fatalf("expected two subscription ids, got %q %q", heads, logs)
+	}
+
+	got := make(map[string]string)
+	for len(got) < 2 {
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Method != "eth_subscription" {
+			t.Fatalf("expected a notification, got %+v", msg)
+		}
+		got[msg.Params.Subscription] = string(msg.Params.Result)
+	}
+	if h := got[heads]; !strings.Contains(h, `"number"`) || strings.Contains(h, "transactions") {
+		t.Errorf("expected a header without transactions, got %s", h)
+	}
+	if l := got[logs]; !strings.Contains(l, `"address":"0x01"`) || strings.Contains(l, `"blockNumber":"0x0"`) {
+		t.Errorf("expected a log matching the filter from a new block, got %s", l)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":6,"method":"eth_unsubscribe","params":["`+heads+`"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg.Result = nil
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.ID) == "6" {
+			break
+		}
+	}
+	if string(msg.Result) != "true" {
+		t.Errorf("expected unsubscribe result, got %s", msg.Result)
+	}
+}
+
+func TestWebsocketProxy_bridgeFailures(t *testing.T) {
+	var head uint64 = 10
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "eth_blockNumber":
+			// Every poll finds a gap wider than BlockRangeLimit.
+			fmt.Fprintf(rw, `{"jsonrpc":"2.0","id":%s,"result":"0x%x"}`, req.ID, atomic.AddUint64(&head, 10))
+		case "eth_getLogs":
+			var filter logFilter
+			json.Unmarshal(req.Params[0], &filter)
+			if string(filter.Address) == `"0xbad"` {
+				fmt.Fprintf(rw, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32099,"message":"bad address"}}`, req.ID)
+				return
+			}
+			fmt.Fprintf(rw, `{"jsonrpc":"2.0","id":%s,"result":[{"fromBlock":%q,"toBlock":%q}]}`, req.ID, filter.FromBlock, filter.ToBlock)
+		}
+	}))
+	defer upstream.Close()
+
+	p := NewProxy(&url.URL{})
+	p.Transport = newTestTransport(t, "eth_subscribe", "eth_blockNumber", "eth_getLogs")
+	p.Transport.url = upstream.URL
+	p.Transport.blockRangeLimit = 5
+	p.Bridge = 20 * time.Millisecond
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		wsMessage
+		Params struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result"`
+			Error        *rpcError       `json:"error"`
+		} `json:"params"`
+	}
+	subscribe := func(req string) string {
+		t.Helper()
+		if err := c.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		msg.Result, msg.Error = nil, nil
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		var id string
+		json.Unmarshal(msg.Result, &id)
+		return id
+	}
+
+	// Polled methods must be allowed.
+	subscribe(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+	if !strings.Contains(string(msg.Error), "eth_getBlockByNumber") {
+		t.Errorf("expected newHeads to be rejected for eth_getBlockByNumber, got %s %s", msg.Result, msg.Error)
+	}
+
+	good := subscribe(`{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["logs",{"address":"0x01"}]}`)
+	bad := subscribe(`{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["logs",{"address":"0xbad"}]}`)
+	if good == "" || bad == "" {
+		t.Fatalf("expected two subscription ids, got %q %q", good, bad)
+	}
+
+	var closed bool
+	var after int // Notifications of good once bad is closed.
+	for after < 2 {
+		msg.Params.Result, msg.Params.Error = nil, nil
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg.Params.Subscription {
+		case good:
+			var log struct{ FromBlock, ToBlock hexutil.Uint64 }
+			if err := json.Unmarshal(msg.Params.Result, &log); err != nil {
+				t.Fatalf("expected a log, got %s", msg.Params.Result)
+			}
+			if n := log.ToBlock - log.FromBlock + 1; n != 5 {
+				t.Errorf("expected polls capped to BlockRangeLimit of 5 blocks, got %d", n)
+			}
+			if closed {
+				after++
+			}
+		case bad:
+			if closed {
+				t.Fatal("expected no notifications once closed")
+			}
+			if e := msg.Params.Error; e == nil || e.Code != -32099 {
+				t.Fatalf("expected the poll's error, got %s %+v", msg.Params.Result, e)
+			}
+			closed = true
+		}
+	}
+}
+
+func TestWebsocketProxy_forwardHeaders(t *testing.T) {
+	forwarded := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Clone()
+		if c, err := DefaultUpgrader.Upgrade(rw, r, nil); err == nil {
+			c.Close()
+		}
+	}))
+	defer backend.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTestTransport(t, "eth_chainId")
+	tr.forwardHeaders = map[string]struct{}{"X-Tenant-Id": {}, "Cookie": {}}
+	tr.upstreamHeaders = map[string]string{"Authorization": "Bearer node-secret"}
+	p := NewProxy(u)
+	p.Director = tr.wsHeaders
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("X-Tenant-ID", "acme")
+	header.Set("X-Internal", "leak")
+	header.Set("Cookie", "session=secret")
+	header.Set("Authorization", "Bearer client-secret")
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	got := <-forwarded
+	for h, exp := range map[string]string{
+		"X-Tenant-ID":   "acme",
+		"X-Internal":    "",
+		"Cookie":        "",
+		"Authorization": "Bearer node-secret",
+	} {
+		if v := got.Get(h); v != exp {
+			t.Errorf("expected %s %q, got %q", h, exp, v)
+		}
+	}
+}
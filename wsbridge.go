@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gorilla/websocket"
+	"github.com/treeder/gotils/v2"
+)
+
+// bridgeMaxBlocks caps how many blocks a bridged subscription catches up on
+// in a single poll. Older blocks are skipped, so a long gap doesn't flood the
+// client.
+const bridgeMaxBlocks = 32
+
+// bridgeMaxFailures is how many polls in a row may fail for a bridged
+// subscription before it is closed.
+const bridgeMaxFailures = 3
+
+// bridgePolled lists the methods polled for each kind of bridged
+// subscription. They are sent as the client, so it must be allowed them.
+var bridgePolled = map[string][]string{
+	"newHeads": {"eth_blockNumber", "eth_getBlockByNumber"},
+	"logs":     {"eth_blockNumber", "eth_getLogs"},
+}
+
+// serveBridge serves a client websocket connection without a websocket
+// backend: newHeads and logs subscriptions are emulated by polling the HTTP
+// upstream of Transport every Bridge, and other requests are sent to it over
+// HTTP. Both go through Transport like HTTP clients' requests, so they are
+// checked, rate limited and counted against the daily quota the same way.
+func (w *WebsocketProxy) serveBridge(rw http.ResponseWriter, req *http.Request, ip, key, clientID string) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	upgrader := w.Upgrader
+	if w.Upgrader == nil {
+		upgrader = DefaultUpgrader
+	}
+	connPub, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("websocketproxy: couldn't upgrade %s", err)
+		return
+	}
+	pub := &syncConn{Conn: connPub}
+	defer pub.Close()
+
+	done := make(chan struct{}) // Closed once the handler returns.
+	defer close(done)
+
+	var lastActive int64 // Unix nanoseconds of the last relayed message, accessed atomically.
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+	w.expectPongs(connPub)
+	errKeepalive := make(chan error, 1)
+	if w.PingInterval > 0 || w.IdleTimeout > 0 {
+		go w.keepalive(pub, &lastActive, done, errKeepalive)
+	}
+
+	b := &wsBridge{t: w.Transport, ip: ip, key: key, clientID: clientID, peer: req.RemoteAddr, conn: pub, touch: touch, subs: make(map[string]*bridgeSubscription)}
+	go b.poll(ctx, w.Bridge)
+
+	connLimiter := w.connLimiter()
+	var violations int // Rate limited client messages.
+	for {
+		msgType, msg, err := pub.ReadMessage()
+		if err != nil {
+			select {
+			case err := <-errKeepalive:
+				gotils.L(ctx).Info().Printf("websocketproxy: closing connection: %v", err)
+				return
+			default:
+			}
+			if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
+				gotils.L(ctx).Error().Printf("websocketproxy: ReadMessage %s", err)
+			}
+			return
+		}
+		touch()
+		if len(msg) == 0 {
+			continue
+		}
+		if msgType != websocket.TextMessage {
+			err := errors.New("unsupported message type")
+			w.logDropped(ctx, ip, err.Error(), nil)
+			pub.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+			return
+		}
+		methods, res, err := parseMessage(msg, ip)
+		if err != nil {
+			w.logDropped(ctx, ip, err.Error(), nil)
+			pub.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, err.Error()))
+			return
+		}
+		setAPIKey(res, key)
+		setClientID(res, clientID)
+		msgCtx := gotils.With(ctx, "remoteIp", ip)
+		msgCtx = gotils.With(msgCtx, "methods", methods)
+		if !isSubscription(res) {
+			// Transport checks the methods of forwarded messages.
+			methods = nil
+		}
+		resp, err := w.check(msgCtx, ip, connLimiter, &violations, methods, res)
+		if err != nil {
+			pub.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(w.violationCloseCode(), err.Error()))
+			return
+		}
+		var reply []byte
+		if resp != nil {
+			reply, err = json.Marshal(resp)
+		} else {
+			var code int
+			reply, code, err = b.handle(msgCtx, msg, res)
+			if err == nil && code == http.StatusTooManyRequests {
+				if err := w.violation(msgCtx, ip, &violations); err != nil {
+					pub.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(w.violationCloseCode(), err.Error()))
+					return
+				}
+			}
+		}
+		if err == nil {
+			err = pub.WriteMessage(websocket.TextMessage, reply)
+		}
+		if err != nil {
+			gotils.L(ctx).Error().Printf("websocketproxy: failed to reply: %v", err)
+			return
+		}
+	}
+}
+
+// wsBridge emulates subscriptions for a single bridged client connection.
+type wsBridge struct {
+	t        *myTransport
+	ip       string // The client's.
+	key      string // API key presented by the client, "" means none.
+	clientID string // Set by a trusted proxy at the handshake, "" means none.
+	peer     string // RemoteAddr of the handshake.
+	conn     *syncConn
+	touch    func() // Marks the connection as active.
+
+	mu   sync.Mutex // Protects subs.
+	subs map[string]*bridgeSubscription
+}
+
+// bridgeSubscription is a subscription emulated by a wsBridge.
+type bridgeSubscription struct {
+	kind     string    // newHeads or logs
+	filter   logFilter // logs only
+	next     uint64    // Next block to notify, 0 until the first poll. Only accessed by poll.
+	failures int       // Failed polls in a row. Only accessed by poll.
+}
+
+// logFilter is the part of a logs subscription filter which applies to
+// eth_getLogs.
+type logFilter struct {
+	FromBlock string          `json:"fromBlock,omitempty"`
+	ToBlock   string          `json:"toBlock,omitempty"`
+	Address   json.RawMessage `json:"address,omitempty"`
+	Topics    json.RawMessage `json:"topics,omitempty"`
+}
+
+// isSubscription reports whether res subscribes or unsubscribes.
+func isSubscription(res []ModifiedRequest) bool {
+	for _, r := range res {
+		if r.Path == "eth_subscribe" || r.Path == "eth_unsubscribe" {
+			return true
+		}
+	}
+	return false
+}
+
+// handle answers the client message msg, already parsed as res, along with
+// the HTTP status of the answer. Subscriptions are handled by the bridge, and
+// anything else is sent to the upstream.
+func (b *wsBridge) handle(ctx context.Context, msg []byte, res []ModifiedRequest) ([]byte, int, error) {
+	if !isSubscription(res) {
+		return b.forward(ctx, msg, res)
+	}
+	var resp interface{}
+	switch {
+	case isBatch(msg):
+		resp = jsonRPCError(nil, jsonRPCInvalidRequest, "subscriptions can't be batched")
+	case res[0].Path == "eth_subscribe":
+		resp = b.subscribe(res[0])
+	default:
+		resp = b.unsubscribe(res[0])
+	}
+	reply, err := json.Marshal(resp)
+	return reply, http.StatusOK, err
+}
+
+// subscribe starts emulating the subscription requested by r.
+func (b *wsBridge) subscribe(r ModifiedRequest) interface{} {
+	var kind string
+	if len(r.Params) == 0 || json.Unmarshal(r.Params[0], &kind) != nil {
+		return jsonRPCError(r.ID, jsonRPCInvalidParams, "invalid subscription type")
+	}
+	sub := &bridgeSubscription{kind: kind}
+	switch kind {
+	case "newHeads":
+	case "logs":
+		if len(r.Params) > 1 {
+			if err := json.Unmarshal(r.Params[1], &sub.filter); err != nil {
+				return jsonRPCError(r.ID, jsonRPCInvalidParams, fmt.Sprintf("invalid logs filter: %v", err))
+			}
+			sub.filter.FromBlock, sub.filter.ToBlock = "", ""
+		}
+	default:
+		return jsonRPCError(r.ID, jsonRPCMethodNotAllowed, fmt.Sprintf("subscription not supported without a websocket upstream: %s", kind))
+	}
+	for _, method := range bridgePolled[kind] {
+		if !b.allows(method) {
+			return jsonRPCError(r.ID, jsonRPCMethodNotAllowed, fmt.Sprintf("%s subscriptions poll %s, which you are not authorized to call", kind, method))
+		}
+	}
+	id, err := newSubscriptionID()
+	if err != nil {
+		return jsonRPCError(r.ID, jsonRPCInternal, err.Error())
+	}
+	b.mu.Lock()
+	b.subs[id] = sub
+	b.mu.Unlock()
+	result, _ := json.Marshal(id)
+	return cachedResponse(r.ID, result)
+}
+
+// allows reports whether the client may call method, with its API key's
+// allow list if it has one.
+func (b *wsBridge) allows(method string) bool {
+	m := b.t.matcher
+	if key, ok := b.t.apiKeys[b.key]; ok && key.matcher != nil {
+		m = *key.matcher
+	}
+	return m.MatchAnyRule(method)
+}
+
+// unsubscribe stops emulating the subscription named by r, answering whether
+// it existed.
+func (b *wsBridge) unsubscribe(r ModifiedRequest) interface{} {
+	var id string
+	if len(r.Params) == 0 || json.Unmarshal(r.Params[0], &id) != nil {
+		return jsonRPCError(r.ID, jsonRPCInvalidParams, "invalid subscription id")
+	}
+	b.mu.Lock()
+	_, ok := b.subs[id]
+	delete(b.subs, id)
+	b.mu.Unlock()
+	result, _ := json.Marshal(ok)
+	return cachedResponse(r.ID, result)
+}
+
+// newSubscriptionID returns a random subscription ID, like the ones nodes
+// issue.
+func newSubscriptionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hexutil.Encode(b[:]), nil
+}
+
+// forward sends the client message msg to the upstream through the transport
+// and returns its response and status, or an error response if there is none.
+func (b *wsBridge) forward(ctx context.Context, msg []byte, res []ModifiedRequest) ([]byte, int, error) {
+	resp, err := b.roundTrip(ctx, msg)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("websocketproxy: bridged request failed: %v", err)
+		reply, err := json.Marshal(jsonRPCUpstreamUnavailable(res[0].ID))
+		return reply, http.StatusBadGateway, err
+	}
+	body, err := readBody(resp, b.t.maxResponseBytes)
+	if err == errResponseTooLarge {
+		reply, err := json.Marshal(jsonRPCResponseTooLarge(res[0].ID, b.t.maxResponseBytes))
+		return reply, http.StatusBadGateway, err
+	}
+	if err != nil {
+		reply, err := json.Marshal(jsonRPCUpstreamUnavailable(res[0].ID))
+		return reply, http.StatusBadGateway, err
+	}
+	if resp.StatusCode != http.StatusOK && !json.Valid(body) {
+		// Errors of the transport itself are JSON-RPC responses already.
+		reply, err := json.Marshal(jsonRPCInvalidUpstreamResponse(res[0].ID, resp.StatusCode))
+		return reply, resp.StatusCode, err
+	}
+	return body, resp.StatusCode, nil
+}
+
+// roundTrip sends body to the upstream through the transport, as an HTTP
+// request from the client.
+func (b *wsBridge) roundTrip(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.t.url, ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", b.ip)
+	if b.key != "" {
+		req.Header.Set(apiKeyHeader, b.key)
+	}
+	if b.clientID != "" {
+		// Vouched for by the same trusted proxy at the handshake.
+		req.RemoteAddr = b.peer
+		req.Header.Set(b.t.clientIDHeader, b.clientID)
+	}
+	return b.t.RoundTrip(req)
+}
+
+// poll notifies the active subscriptions of new blocks every interval, until
+// ctx is done.
+func (b *wsBridge) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := b.notify(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			gotils.L(ctx).Error().Printf("websocketproxy: failed to notify subscriptions: %v", err)
+		}
+	}
+}
+
+// notify sends each active subscription the heads or logs of the blocks
+// since it was last notified, up to the latest one. New subscriptions start
+// from the block after the latest one. A failed poll is retried on the next
+// one, from the same block, until it fails bridgeMaxFailures times in a row
+// and the subscription is closed. The error returned is from writing to the
+// client.
+func (b *wsBridge) notify(ctx context.Context) error {
+	b.mu.Lock()
+	subs := make(map[string]*bridgeSubscription, len(b.subs))
+	for id, sub := range b.subs {
+		subs[id] = sub
+	}
+	b.mu.Unlock()
+	if len(subs) == 0 {
+		return nil
+	}
+
+	var latest hexutil.Uint64
+	result, errLatest := b.call(ctx, "eth_blockNumber")
+	if errLatest == nil {
+		errLatest = json.Unmarshal(result, &latest)
+	}
+	num := uint64(latest)
+	heads := make(map[uint64]json.RawMessage) // Fetched once for every newHeads subscription.
+	for id, sub := range subs {
+		if errLatest != nil {
+			// Every subscription needs the latest block.
+			if err := b.fail(ctx, id, sub, errLatest); err != nil {
+				return err
+			}
+			continue
+		}
+		if sub.next == 0 {
+			sub.next = num + 1
+			continue
+		}
+		if sub.next > num {
+			continue
+		}
+		if max := b.maxBlocks(sub.kind); num-sub.next >= max {
+			sub.next = num - max + 1
+		}
+		results, err := b.results(ctx, sub, num, heads)
+		if err != nil {
+			if err := b.fail(ctx, id, sub, err); err != nil {
+				return err
+			}
+			continue
+		}
+		sub.next, sub.failures = num+1, 0
+		for _, result := range results {
+			if err := b.send(id, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// maxBlocks returns how many blocks a subscription of kind may catch up on
+// in a single poll: bridgeMaxBlocks, or fewer for logs if BlockRangeLimit
+// wouldn't allow an eth_getLogs range that wide.
+func (b *wsBridge) maxBlocks(kind string) uint64 {
+	if kind == "logs" && b.t.blockRangeLimit > 0 && b.t.blockRangeLimit < bridgeMaxBlocks {
+		return b.t.blockRangeLimit
+	}
+	return bridgeMaxBlocks
+}
+
+// results returns the heads or logs of sub for its blocks up to num. Heads are
+// looked up in and added to heads.
+func (b *wsBridge) results(ctx context.Context, sub *bridgeSubscription, num uint64, heads map[uint64]json.RawMessage) ([]json.RawMessage, error) {
+	var results []json.RawMessage
+	switch sub.kind {
+	case "newHeads":
+		for n := sub.next; n <= num; n++ {
+			head, ok := heads[n]
+			if !ok {
+				var err error
+				if head, err = b.header(ctx, n); err != nil {
+					return nil, err
+				}
+				heads[n] = head
+			}
+			results = append(results, head)
+		}
+	case "logs":
+		filter := sub.filter
+		filter.FromBlock, filter.ToBlock = hexutil.EncodeUint64(sub.next), hexutil.EncodeUint64(num)
+		params, err := json.Marshal(filter)
+		if err != nil {
+			return nil, err
+		}
+		result, err := b.call(ctx, "eth_getLogs", params)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(result, &results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// fail records a failed poll for subscription id. After bridgeMaxFailures in
+// a row, the subscription is closed, and the client is sent an error
+// notification for it rather than left waiting for notifications.
+func (b *wsBridge) fail(ctx context.Context, id string, sub *bridgeSubscription, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	sub.failures++
+	if sub.failures < bridgeMaxFailures {
+		gotils.L(ctx).Debug().Printf("websocketproxy: poll failed for subscription %s: %v", id, err)
+		return nil
+	}
+	gotils.L(ctx).Info().Printf("websocketproxy: closing subscription %s after %d failed polls: %v", id, sub.failures, err)
+	b.mu.Lock()
+	_, ok := b.subs[id]
+	delete(b.subs, id)
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	rpcErr, ok := err.(*rpcError)
+	if !ok {
+		rpcErr = &rpcError{Code: jsonRPCUpstreamDown, Message: err.Error()}
+	}
+	return b.write(id, nil, rpcErr)
+}
+
+// header returns the header of block n, as eth_getBlockByNumber returns it
+// without the transactions and uncles, which newHeads notifications leave out.
+func (b *wsBridge) header(ctx context.Context, n uint64) (json.RawMessage, error) {
+	num, _ := json.Marshal(hexutil.EncodeUint64(n))
+	result, err := b.call(ctx, "eth_getBlockByNumber", num, json.RawMessage("false"))
+	if err != nil {
+		return nil, err
+	}
+	var block map[string]json.RawMessage
+	if err := json.Unmarshal(result, &block); err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", n)
+	}
+	delete(block, "transactions")
+	delete(block, "uncles")
+	return json.Marshal(block)
+}
+
+// call calls method on the upstream through the transport.
+func (b *wsBridge) call(ctx context.Context, method string, params ...json.RawMessage) (json.RawMessage, error) {
+	body, err := rpcRequest(method, params)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.roundTrip(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	return rpcResult(res, b.t.maxResponseBytes)
+}
+
+// send sends result to the client as a notification for subscription id,
+// unless it was unsubscribed in the meantime.
+func (b *wsBridge) send(id string, result json.RawMessage) error {
+	b.mu.Lock()
+	_, ok := b.subs[id]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return b.write(id, result, nil)
+}
+
+// write writes a notification for subscription id to the client, with either
+// result or, once the subscription is closed, the error which closed it.
+func (b *wsBridge) write(id string, result json.RawMessage, rpcErr *rpcError) error {
+	var n struct {
+		Version string `json:"jsonrpc"`
+		Method  string `json:"method"`
+		Params  struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result,omitempty"`
+			Error        *rpcError       `json:"error,omitempty"`
+		} `json:"params"`
+	}
+	n.Version, n.Method = "2.0", "eth_subscription"
+	n.Params.Subscription, n.Params.Result, n.Params.Error = id, result, rpcErr
+	msg, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	b.touch()
+	return b.conn.WriteMessage(websocket.TextMessage, msg)
+}
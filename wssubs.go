@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsSubscriptions tracks the eth_subscribe subscriptions made over a proxied
+// websocket connection, so that they can be replayed when the backend
+// connection is replaced. Replayed subscriptions get new IDs from the new
+// backend, which are translated back to the IDs the client knows.
+type wsSubscriptions struct {
+	mu        sync.Mutex
+	inflight  map[string]json.RawMessage   // request id -> id, of requests awaiting a backend response
+	pending   map[string][]json.RawMessage // request id -> eth_subscribe params
+	active    map[string][]json.RawMessage // client subscription id -> eth_subscribe params
+	replaying map[string]string            // replay request id -> client subscription id
+	toClient  map[string]string            // backend subscription id -> client subscription id
+	toBackend map[string]string            // client subscription id -> backend subscription id
+	replays   int                          // Replay requests sent, for unique ids.
+}
+
+func newWSSubscriptions() *wsSubscriptions {
+	return &wsSubscriptions{
+		inflight:  make(map[string]json.RawMessage),
+		pending:   make(map[string][]json.RawMessage),
+		active:    make(map[string][]json.RawMessage),
+		replaying: make(map[string]string),
+		toClient:  make(map[string]string),
+		toBackend: make(map[string]string),
+	}
+}
+
+// wsRequest is a JSON-RPC request as relayed to the backend.
+type wsRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id,omitempty"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params,omitempty"`
+}
+
+// request records the subscribe and unsubscribe requests in res, parsed from
+// the client message msg, and returns msg with subscription IDs translated
+// for the current backend.
+func (s *wsSubscriptions) request(msg []byte, res []ModifiedRequest) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	translated := false
+	for i, r := range res {
+		if len(r.ID) > 0 {
+			s.inflight[string(r.ID)] = r.ID
+		}
+		switch r.Path {
+		case "eth_subscribe":
+			s.pending[string(r.ID)] = r.Params
+		case "eth_unsubscribe":
+			if len(r.Params) == 0 {
+				continue
+			}
+			var id string
+			if err := json.Unmarshal(r.Params[0], &id); err != nil {
+				continue
+			}
+			delete(s.active, id)
+			if backendID, ok := s.toBackend[id]; ok {
+				delete(s.toBackend, id)
+				delete(s.toClient, backendID)
+				b, _ := json.Marshal(backendID)
+				params := append([]json.RawMessage{b}, r.Params[1:]...)
+				res[i].Params = params
+				translated = true
+			}
+		}
+	}
+	if !translated {
+		return msg
+	}
+	reqs := make([]wsRequest, len(res))
+	for i, r := range res {
+		reqs[i] = wsRequest{JSONRPC: "2.0", ID: r.ID, Method: r.Path, Params: r.Params}
+	}
+	var b []byte
+	var err error
+	if isBatch(msg) {
+		b, err = json.Marshal(reqs)
+	} else {
+		b, err = json.Marshal(reqs[0])
+	}
+	if err != nil {
+		return msg
+	}
+	return b
+}
+
+// wsMessage is a JSON-RPC response or subscription notification from the
+// backend.
+type wsMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+	Params struct {
+		Subscription string `json:"subscription"`
+	} `json:"params"`
+}
+
+// response records the subscription IDs returned in the backend message msg
+// and returns msg with IDs translated for the client, or nil if msg answers
+// a replayed subscription and must not be relayed.
+func (s *wsSubscriptions) response(msg []byte) []byte {
+	var msgs []wsMessage
+	if isBatch(msg) {
+		if err := json.Unmarshal(msg, &msgs); err != nil {
+			return msg
+		}
+	} else {
+		var m wsMessage
+		if err := json.Unmarshal(msg, &m); err != nil {
+			return msg
+		}
+		msgs = append(msgs, m)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range msgs {
+		if m.Method == "eth_subscription" {
+			if clientID, ok := s.toClient[m.Params.Subscription]; ok {
+				return withSubscription(msg, clientID)
+			}
+			return msg
+		}
+		id := string(m.ID)
+		delete(s.inflight, id)
+		if clientID, ok := s.replaying[id]; ok {
+			delete(s.replaying, id)
+			var backendID string
+			if m.Error != nil || json.Unmarshal(m.Result, &backendID) != nil {
+				delete(s.active, clientID)
+				return nil
+			}
+			s.toClient[backendID] = clientID
+			s.toBackend[clientID] = backendID
+			return nil
+		}
+		if params, ok := s.pending[id]; ok {
+			delete(s.pending, id)
+			var subID string
+			if m.Error == nil && json.Unmarshal(m.Result, &subID) == nil {
+				s.active[subID] = params
+			}
+		}
+	}
+	return msg
+}
+
+// withSubscription returns the notification msg with its subscription ID
+// replaced by id.
+func withSubscription(msg []byte, id string) []byte {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return msg
+	}
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(m["params"], &params); err != nil {
+		return msg
+	}
+	params["subscription"], _ = json.Marshal(id)
+	var err error
+	if m["params"], err = json.Marshal(params); err != nil {
+		return msg
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return msg
+	}
+	return b
+}
+
+// forget stops tracking the requests in res, which were answered without
+// reaching the backend.
+func (s *wsSubscriptions) forget(res []ModifiedRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range res {
+		delete(s.inflight, string(r.ID))
+		delete(s.pending, string(r.ID))
+	}
+}
+
+// unanswered returns the IDs of the requests the backend never answered, and
+// stops tracking them. Requests to a lost backend connection never will be.
+func (s *wsSubscriptions) unanswered() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []json.RawMessage
+	for _, id := range s.inflight {
+		ids = append(ids, id)
+	}
+	s.inflight = make(map[string]json.RawMessage)
+	s.pending = make(map[string][]json.RawMessage)
+	return ids
+}
+
+// replay resubscribes the active subscriptions on conn, a new backend
+// connection. IDs issued by the previous backend are forgotten.
+func (s *wsSubscriptions) replay(conn *websocket.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaying = make(map[string]string)
+	s.toClient = make(map[string]string)
+	s.toBackend = make(map[string]string)
+	for clientID, params := range s.active {
+		s.replays++
+		id := json.RawMessage(fmt.Sprintf(`"rpc-proxy-resubscribe-%d"`, s.replays))
+		b, err := json.Marshal(wsRequest{JSONRPC: "2.0", ID: id, Method: "eth_subscribe", Params: params})
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			return err
+		}
+		s.replaying[string(id)] = clientID
+	}
+	return nil
+}